@@ -0,0 +1,175 @@
+package cony
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ackCoalescer collects acks of deliveries on a single channel and sends
+// them as single multiple-ack. Methods are nil safe.
+type ackCoalescer struct {
+	m           sync.Mutex
+	ack         amqp.Acknowledger // channel acks are sent to
+	outstanding map[uint64]struct{}
+	acked       map[uint64]struct{}
+	max         int
+}
+
+func newAckCoalescer(max int) *ackCoalescer {
+	return &ackCoalescer{
+		outstanding: make(map[uint64]struct{}),
+		acked:       make(map[uint64]struct{}),
+		max:         max,
+	}
+}
+
+// track delivery, its acks are coalesced
+func (a *ackCoalescer) track(d *amqp.Delivery) {
+	if a == nil || d.Acknowledger == nil {
+		return
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.ack = d.Acknowledger
+	a.outstanding[d.DeliveryTag] = struct{}{}
+	d.Acknowledger = coalescedAcknowledger{a}
+}
+
+// run flushes acks every interval, returned func stops it with final flush
+func (a *ackCoalescer) run(interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = a.flush()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		_ = a.flush()
+	}
+}
+
+func (a *ackCoalescer) flush() error {
+	if a == nil {
+		return nil
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.flushLocked()
+}
+
+// flushLocked acks everything up to the first outstanding delivery with
+// multiple-ack, acks after it are sent one by one
+func (a *ackCoalescer) flushLocked() error {
+	if len(a.acked) == 0 {
+		return nil
+	}
+
+	tags := make([]uint64, 0, len(a.acked))
+	for t := range a.acked {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	a.acked = make(map[uint64]struct{})
+
+	var first uint64 // first tag still outstanding, zero if none
+	for t := range a.outstanding {
+		if first == 0 || t < first {
+			first = t
+		}
+	}
+
+	i := sort.Search(len(tags), func(i int) bool { return first != 0 && tags[i] > first })
+	if i > 0 {
+		if err := a.ack.Ack(tags[i-1], true); err != nil {
+			return err
+		}
+	}
+	for _, t := range tags[i:] {
+		if err := a.ack.Ack(t, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle marks tags as settled by user, returns them
+func (a *ackCoalescer) settle(tag uint64, multiple bool) []uint64 {
+	var tags []uint64
+	for t := range a.outstanding {
+		if t == tag || (multiple && t <= tag) {
+			delete(a.outstanding, t)
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+type coalescedAcknowledger struct {
+	a *ackCoalescer
+}
+
+func (c coalescedAcknowledger) Ack(tag uint64, multiple bool) error {
+	a := c.a
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for _, t := range a.settle(tag, multiple) {
+		a.acked[t] = struct{}{}
+	}
+	if len(a.acked) >= a.max {
+		return a.flushLocked()
+	}
+	return nil
+}
+
+func (c coalescedAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a := c.a
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	// multiple nack would cover acks not sent yet
+	if err := a.flushLocked(); err != nil {
+		return err
+	}
+	a.settle(tag, multiple)
+	return a.ack.Nack(tag, multiple, requeue)
+}
+
+func (c coalescedAcknowledger) Reject(tag uint64, requeue bool) error {
+	a := c.a
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	a.settle(tag, false)
+	return a.ack.Reject(tag, requeue)
+}
+
+// CoalesceAcks set this consumer to send acks in bulk: acks are collected and
+// sent every interval or once maxPending of them are collected, using single
+// multiple-ack where possible. Pending acks are sent when consumer is
+// cancelled, acks not sent before connection loss are lost and messages are
+// redelivered.
+func CoalesceAcks(interval time.Duration, maxPending int) ConsumerOpt {
+	return func(c *Consumer) {
+		c.ackEvery = interval
+		c.ackMax = maxPending
+	}
+}
@@ -0,0 +1,80 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type multipleAcknowledger struct {
+	testAcknowledger
+	multiple []bool
+}
+
+func (a *multipleAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.multiple = append(a.multiple, multiple)
+	return a.testAcknowledger.Ack(tag, multiple)
+}
+
+func TestAckCoalescer(t *testing.T) {
+	ack := &multipleAcknowledger{}
+	acks := newAckCoalescer(100)
+
+	ds := make([]amqp.Delivery, 5)
+	for i := range ds {
+		ds[i] = amqp.Delivery{DeliveryTag: uint64(i + 1), Acknowledger: ack}
+		acks.track(&ds[i])
+	}
+
+	ds[0].Ack(false)
+	ds[1].Ack(false)
+	ds[3].Ack(false)
+	if len(ack.acked) != 0 {
+		t.Error("acks should be collected")
+	}
+
+	acks.flush()
+	if len(ack.acked) != 2 || ack.acked[0] != 2 || !ack.multiple[0] || ack.acked[1] != 4 || ack.multiple[1] {
+		t.Error("should multiple-ack contiguous tags only", ack.acked, ack.multiple)
+	}
+
+	ds[2].Ack(false)
+	ds[4].Ack(false)
+	acks.flush()
+	if len(ack.acked) != 3 || ack.acked[2] != 5 || !ack.multiple[2] {
+		t.Error("should multiple-ack the rest", ack.acked, ack.multiple)
+	}
+}
+
+func TestAckCoalescer_maxPending(t *testing.T) {
+	ack := &multipleAcknowledger{}
+	acks := newAckCoalescer(2)
+	stop := acks.run(time.Hour)
+
+	ds := make([]amqp.Delivery, 3)
+	for i := range ds {
+		ds[i] = amqp.Delivery{DeliveryTag: uint64(i + 1), Acknowledger: ack}
+		acks.track(&ds[i])
+		ds[i].Ack(false)
+	}
+
+	if len(ack.acked) != 1 || ack.acked[0] != 2 {
+		t.Error("should flush once maxPending acks collected", ack.acked)
+	}
+
+	stop()
+	if len(ack.acked) != 2 || ack.acked[1] != 3 {
+		t.Error("should flush on stop", ack.acked)
+	}
+}
+
+func TestAckCoalescer_nil(t *testing.T) {
+	var acks *ackCoalescer
+	d := amqp.Delivery{Acknowledger: &testAcknowledger{}}
+	acks.track(&d)
+
+	if _, ok := d.Acknowledger.(*testAcknowledger); !ok || acks.flush() != nil {
+		t.Error("nil coalescer should be no-op")
+	}
+}
@@ -0,0 +1,409 @@
+package cony
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrNacked is passed to PublishAsync callback if broker nacked publishing
+var ErrNacked = errors.New("Publishing nacked by broker")
+
+// RepublishedHeader marks publishings republished by RepublishUnconfirmed
+const RepublishedHeader = "x-republished"
+
+// asyncBuffer is a capacity of PublishAsync queue
+const asyncBuffer = 256
+
+// maxRepublishNacks limits how many times RepublishUnconfirmed republishes
+// publishing nacked by broker, e.g. by queue with reject-publish overflow
+const maxRepublishNacks = 5
+
+// asyncPublishing is queued by PublishAsync
+type asyncPublishing struct {
+	pubs []amqp.Publishing // chunks of single publishing
+	key  string
+	res  *asyncResult
+}
+
+// asyncResult calls done once all chunks of publishing are settled. Chunks
+// are settled by serve loop, Cancel and expiry timer, so it's guarded by mutex
+type asyncResult struct {
+	m         sync.Mutex
+	done      func(error)
+	remaining int
+	err       error
+}
+
+// settle settles one chunk, settlements after done was called are ignored
+func (r *asyncResult) settle(err error) {
+	r.settleN(1, err)
+}
+
+// abort settles all remaining chunks with err
+func (r *asyncResult) abort(err error) {
+	r.settleN(-1, err)
+}
+
+func (r *asyncResult) settleN(n int, err error) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	if r.remaining <= 0 {
+		r.m.Unlock()
+		return
+	}
+	if r.err == nil {
+		r.err = err
+	}
+	if n < 0 || n > r.remaining {
+		n = r.remaining
+	}
+	r.remaining -= n
+	finished := r.remaining == 0
+	r.m.Unlock()
+
+	if finished && r.done != nil {
+		r.done(r.err)
+	}
+}
+
+// PublishAsync queues publishing and returns without waiting for it to be
+// written. done is called from publisher goroutine once publishing is written
+// to channel, or confirmed by broker if WithConfirmation option is used. done
+// receives ErrNacked if broker nacked publishing, channel error if channel
+// was closed before confirmation, ErrPublisherDead if publisher was
+// cancelled and ErrPublisherNotRegistered right away if publisher isn't
+// registered, see AwaitRegistration. done could be nil and should not block.
+//
+// Queue holds 256 publishings, PublishAsync blocks once it's full. Queued
+// publishings wait for channel across reconnects, see PrioritizeAsync to
+// let some of them jump ahead.
+func (p *Publisher) PublishAsync(pub amqp.Publishing, done func(error)) {
+	if p == nil {
+		if done != nil {
+			done(ErrPublisherNotRegistered)
+		}
+		return
+	}
+	p.PublishAsyncWithRoutingKey(pub, p.key, done)
+}
+
+// PublishAsyncWithRoutingKey is like PublishAsync, but publishes with
+// custom routing key
+func (p *Publisher) PublishAsyncWithRoutingKey(pub amqp.Publishing, key string, done func(error)) {
+	if err := p.asyncReady(); err != nil {
+		if done != nil {
+			done(err)
+		}
+		return
+	}
+
+	pubs, err := p.prepare(pub, key, nil)
+	if err != nil {
+		if done != nil {
+			done(err)
+		}
+		return
+	}
+
+	a := asyncPublishing{
+		pubs: pubs,
+		key:  key,
+		res:  &asyncResult{done: done, remaining: len(pubs)},
+	}
+
+	queue := p.async
+	if p.urgent != nil && pubs[0].Priority >= p.urgentMin {
+		queue = p.urgent
+	}
+
+	select {
+	case <-p.stop:
+		a.res.abort(ErrPublisherDead)
+		return
+	case queue <- a:
+	}
+
+	// publisher could be cancelled while queueing
+	select {
+	case <-p.stop:
+		p.drainAsync()
+	default:
+	}
+}
+
+// asyncReady is like ready, but ignores error of the last channel, as queued
+// publishings wait for the next one
+func (p *Publisher) asyncReady() error {
+	if p == nil {
+		return ErrPublisherNotRegistered
+	}
+	if p.optErr != nil {
+		return p.optErr
+	}
+	if err := p.waitRegistration(); err != nil {
+		return err
+	}
+	return p.waitLimiter()
+}
+
+// drainAsync fails queued async publishings with ErrPublisherDead
+func (p *Publisher) drainAsync() {
+	for {
+		select {
+		case a := <-p.urgent:
+			a.res.abort(ErrPublisherDead)
+		case a := <-p.async:
+			a.res.abort(ErrPublisherDead)
+		default:
+			return
+		}
+	}
+}
+
+// publishUrgent writes queued publishings of PrioritizeAsync to channel,
+// ahead of other queued ones
+func (p *Publisher) publishUrgent(ch mqChannel, confirms *confirmTracker) {
+	for {
+		select {
+		case a := <-p.urgent:
+			p.publishAsync(ch, a, confirms)
+		default:
+			return
+		}
+	}
+}
+
+// unconfirmed is a publishing written to channel, but not confirmed yet
+type unconfirmed struct {
+	msg   amqp.Publishing
+	key   string
+	res   *asyncResult // nil for synchronous publishings
+	sent  time.Time
+	nacks int
+}
+
+// confirmTracker matches confirmations of a single channel with async
+// publishings. Methods are nil safe, nil tracker is used without confirms.
+// Delivery tags of channel are translated into publisher wide sequence by
+// adding base, number of publishings tracked on previous channels
+type confirmTracker struct {
+	m       sync.Mutex
+	base    uint64
+	total   *uint64
+	seq     uint64
+	pending map[uint64]unconfirmed
+	keep    bool          // keep all publishings for republishing
+	timeout time.Duration // keep all publishings to expire them
+}
+
+func newConfirmTracker(keep bool, timeout time.Duration, total *uint64) *confirmTracker {
+	return &confirmTracker{
+		pending: make(map[uint64]unconfirmed),
+		keep:    keep,
+		timeout: timeout,
+		base:    atomic.LoadUint64(total),
+		total:   total,
+	}
+}
+
+// published records successfully written publishing. Returns its publisher
+// wide delivery tag, 0 if confirmation of it is not tracked.
+func (t *confirmTracker) published(u unconfirmed) uint64 {
+	if t == nil {
+		return 0
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.seq++
+	atomic.AddUint64(t.total, 1)
+	if u.res != nil || t.keep || t.timeout > 0 {
+		u.sent = time.Now()
+		t.pending[t.seq] = u
+	}
+	return t.base + t.seq
+}
+
+// confirm settles confirmed publishing, returns nacked publishing if it
+// should be republished
+func (t *confirmTracker) confirm(c amqp.Confirmation) (unconfirmed, bool) {
+	if t == nil {
+		return unconfirmed{}, false
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	u, ok := t.pending[c.DeliveryTag]
+	if !ok {
+		return u, false
+	}
+	delete(t.pending, c.DeliveryTag)
+
+	switch {
+	case c.Ack:
+		u.res.settle(nil)
+	case t.keep && u.nacks < maxRepublishNacks:
+		u.nacks++
+		return u, true
+	default:
+		u.res.settle(ErrNacked)
+	}
+	return u, false
+}
+
+// detach returns unconfirmed publishings in order they were published and
+// stops tracking them
+func (t *confirmTracker) detach() []unconfirmed {
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	tags := make([]uint64, 0, len(t.pending))
+	for tag := range t.pending {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	us := make([]unconfirmed, 0, len(tags))
+	for _, tag := range tags {
+		us = append(us, t.pending[tag])
+		delete(t.pending, tag)
+	}
+	return us
+}
+
+// fail settles all publishings waiting for confirmation with err
+func (t *confirmTracker) fail(err error) {
+	for _, u := range t.detach() {
+		u.res.settle(err)
+	}
+}
+
+// republish writes unconfirmed publishing again, marked with
+// RepublishedHeader. It's kept for next channel if write fails
+func (p *Publisher) republish(ch mqChannel, u unconfirmed, confirms *confirmTracker) {
+	msg := u.msg
+	msg.Headers = amqp.Table{}
+	for k, v := range u.msg.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[RepublishedHeader] = true
+
+	if err := ch.Publish(p.exchange, u.key, p.mandatory, false, msg); err != nil {
+		p.retryLater([]unconfirmed{u})
+		return
+	}
+	atomic.AddUint64(&p.stats.published, 1)
+	confirms.published(u)
+}
+
+// retryLater keeps unconfirmed publishings to be republished on next channel.
+// With ConfirmTimeout they expire while waiting for it
+func (p *Publisher) retryLater(us []unconfirmed) {
+	p.m.Lock()
+	if p.dead {
+		p.m.Unlock()
+		for _, u := range us {
+			u.res.settle(ErrPublisherDead)
+		}
+		return
+	}
+	p.retry = append(p.retry, us...)
+	if p.confirmTimeout > 0 && p.retryTimer == nil && len(p.retry) > 0 {
+		p.retryTimer = time.AfterFunc(p.confirmTimeout/2+1, p.expireRetry)
+	}
+	p.m.Unlock()
+}
+
+// expireRetry settles publishings waiting for next channel, which were not
+// confirmed within ConfirmTimeout, with ErrConfirmTimeout
+func (p *Publisher) expireRetry() {
+	now := time.Now()
+	var expired []unconfirmed
+
+	p.m.Lock()
+	kept := p.retry[:0]
+	for _, u := range p.retry {
+		if now.Sub(u.sent) >= p.confirmTimeout {
+			expired = append(expired, u)
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	p.retry = kept
+	p.retryTimer = nil
+	if len(kept) > 0 && !p.dead {
+		p.retryTimer = time.AfterFunc(p.confirmTimeout/2+1, p.expireRetry)
+	}
+	p.m.Unlock()
+
+	for _, u := range expired {
+		u.res.settle(ErrConfirmTimeout)
+	}
+}
+
+func (p *Publisher) takeRetry() []unconfirmed {
+	p.m.Lock()
+	defer p.m.Unlock()
+	us := p.retry
+	p.retry = nil
+	return us
+}
+
+// publishAsync writes queued publishing to channel
+func (p *Publisher) publishAsync(ch mqChannel, a asyncPublishing, confirms *confirmTracker) {
+	if p.tx {
+		envelop := publishMaybeErr{batch: a.pubs, err: make(chan error, 2), key: a.key}
+		p.publishTx(ch, envelop)
+		a.res.abort(<-envelop.err)
+		return
+	}
+
+	for i, msg := range a.pubs {
+		if err := ch.Publish(p.exchange, a.key, p.mandatory, false, msg); err != nil {
+			atomic.AddUint64(&p.stats.failed, 1)
+			// chunks written already are settled by confirmations
+			a.res.settleN(len(a.pubs)-i, err)
+			return
+		}
+		atomic.AddUint64(&p.stats.published, 1)
+		if confirms.published(unconfirmed{msg: msg, key: a.key, res: a.res}) == 0 {
+			a.res.settle(nil)
+		}
+	}
+}
+
+// PrioritizeAsync Publisher's functional option. PublishAsync publishings
+// with Priority of min and higher, e.g. control messages, are queued
+// separately and written to channel ahead of other queued publishings, like
+// when queue is flushed after reconnect. Urgent queue holds 256 publishings
+// as well.
+func PrioritizeAsync(min uint8) PublisherOpt {
+	return func(p *Publisher) {
+		p.urgent = make(chan asyncPublishing, asyncBuffer)
+		p.urgentMin = min
+	}
+}
+
+// RepublishUnconfirmed Publisher's functional option. Publishings nacked by
+// broker or not confirmed before channel was closed are published again,
+// after reconnect in the latter case. Republished copies are marked with
+// RepublishedHeader and keep MessageId, which is stamped like with MessageIDs
+// option, so consumers could drop duplicates with Dedup. Publishing nacked 5
+// times in a row fails with ErrNacked. Requires WithConfirmation option,
+// PublishAsync callbacks are called once publishing is finally confirmed.
+func RepublishUnconfirmed() PublisherOpt {
+	return func(p *Publisher) {
+		p.republishing = true
+		p.stampIDs = true
+	}
+}
@@ -15,6 +15,47 @@ type Backoffer interface {
 	Backoff(int) time.Duration
 }
 
+// ErrorBackoffer is Backoffer deciding on delay by error which caused
+// attempt to reconnect, e.g. to stop on auth failures or to retry channel
+// errors faster. Client uses it instead of Backoff if Backoffer implements
+// it. err is nil for the first attempt of Client to connect. Returning false
+// stops reconnecting: Loop closes Client and returns false, WithChannel
+// returns err, dedicated connection of consumer is not re-established
+type ErrorBackoffer interface {
+	Backoffer
+	BackoffErr(attempt int, err error) (delay time.Duration, retry bool)
+}
+
+// BackoffFunc is an ErrorBackoffer, Backoff calls it with nil error:
+//
+//	cony.Backoff(cony.BackoffFunc(func(n int, err error) (time.Duration, bool) {
+//		if errors.Is(err, amqp.ErrCredentials) {
+//			return 0, false
+//		}
+//		return cony.DefaultBackoff.Backoff(n), true
+//	}))
+type BackoffFunc func(attempt int, err error) (time.Duration, bool)
+
+// Backoff implements Backoffer
+func (f BackoffFunc) Backoff(n int) time.Duration {
+	d, _ := f(n, nil)
+	return d
+}
+
+// BackoffErr implements ErrorBackoffer
+func (f BackoffFunc) BackoffErr(n int, err error) (time.Duration, bool) {
+	return f(n, err)
+}
+
+// backoffErr returns delay of attempt caused by err, using ErrorBackoffer if
+// bo implements it
+func backoffErr(bo Backoffer, n int, err error) (time.Duration, bool) {
+	if eb, ok := bo.(ErrorBackoffer); ok {
+		return eb.BackoffErr(n, err)
+	}
+	return bo.Backoff(n), true
+}
+
 // BackoffPolicy is a default Backoffer implementation
 type BackoffPolicy struct {
 	ms []int
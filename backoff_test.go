@@ -1,8 +1,10 @@
 package cony
 
 import (
+	"errors"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestBackoffPolicy_Backoff(t *testing.T) {
@@ -34,3 +36,20 @@ func TestBackoffPolicy_Backoff(t *testing.T) {
 		}
 	}
 }
+
+func TestBackoffErr(t *testing.T) {
+	fatal := errors.New("fatal")
+	var f BackoffFunc = func(n int, err error) (time.Duration, bool) {
+		return time.Duration(n) * time.Second, err != fatal
+	}
+
+	if d, retry := backoffErr(f, 2, fatal); retry || d != 2*time.Second {
+		t.Error("should pass attempt and error to ErrorBackoffer", d, retry)
+	}
+	if d := f.Backoff(1); d != time.Second {
+		t.Error("Backoff should call func with nil error", d)
+	}
+	if _, retry := backoffErr(BackoffPolicy{[]int{0}}, 5, fatal); !retry {
+		t.Error("plain Backoffer should always retry")
+	}
+}
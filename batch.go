@@ -0,0 +1,75 @@
+package cony
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Batches groups deliveries of consumer into batches of up to maxSize
+// deliveries, partial batch is shipped once maxWait passed since its first
+// delivery. Batch never spans reconnect, so it could be acknowledged with
+// AckBatch. Channel is closed after consumer is cancelled.
+//
+// Batches reads from Deliveries(), it should be called once and Deliveries()
+// should not be read elsewhere.
+func (c *Consumer) Batches(maxSize int, maxWait time.Duration) <-chan []amqp.Delivery {
+	out := make(chan []amqp.Delivery)
+	go c.batch(out, maxSize, maxWait)
+	return out
+}
+
+func (c *Consumer) batch(out chan<- []amqp.Delivery, maxSize int, maxWait time.Duration) {
+	defer close(out)
+
+	var (
+		batch []amqp.Delivery
+		timer = time.NewTimer(maxWait)
+	)
+	timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			out <- batch
+			batch = nil
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+
+	for {
+		select {
+		case d, ok := <-c.deliveries:
+			if !ok {
+				flush()
+				return
+			}
+			// delivery tags restart on a new channel
+			if len(batch) > 0 && d.DeliveryTag <= batch[len(batch)-1].DeliveryTag {
+				flush()
+			}
+			if len(batch) == 0 {
+				timer.Reset(maxWait)
+			}
+			batch = append(batch, d)
+			if len(batch) >= maxSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// AckBatch acknowledges all deliveries of batch received from Batches with
+// single multiple-ack
+func AckBatch(batch []amqp.Delivery) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return batch[len(batch)-1].Ack(true)
+}
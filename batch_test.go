@@ -0,0 +1,49 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConsumer_Batches(t *testing.T) {
+	c := newTestConsumer()
+	batches := c.Batches(2, 10*time.Millisecond)
+
+	go func() {
+		for _, tag := range []uint64{1, 2, 3, 1} {
+			c.deliveries <- amqp.Delivery{DeliveryTag: tag}
+		}
+		time.Sleep(50 * time.Millisecond)
+		c.deliveries <- amqp.Delivery{DeliveryTag: 2}
+		close(c.deliveries)
+	}()
+
+	var sizes []int
+	for b := range batches {
+		sizes = append(sizes, len(b))
+	}
+
+	// full batch, batch flushed by reconnect, batch flushed by timer and
+	// batch flushed by cancel
+	if len(sizes) != 4 || sizes[0] != 2 || sizes[1] != 1 || sizes[2] != 1 || sizes[3] != 1 {
+		t.Error("should flush batches on size, reconnect, timeout and cancel", sizes)
+	}
+}
+
+func TestAckBatch(t *testing.T) {
+	ack := &testAcknowledger{}
+	batch := []amqp.Delivery{
+		{DeliveryTag: 1, Acknowledger: ack},
+		{DeliveryTag: 2, Acknowledger: ack},
+	}
+
+	if err := AckBatch(batch); err != nil || len(ack.acked) != 1 || ack.acked[0] != 2 {
+		t.Error("should ack last delivery with multiple flag", ack.acked)
+	}
+
+	if AckBatch(nil) != nil {
+		t.Error("empty batch should be no-op")
+	}
+}
@@ -0,0 +1,208 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrBridgeSkip is returned by BridgeTransform to drop message, it's acked
+// on source without being published to destination
+var ErrBridgeSkip = errors.New("Message skipped by bridge")
+
+// BridgeOpt is a Bridge's functional option type
+type BridgeOpt func(*Bridge)
+
+// BridgeMessage is a message moved by Bridge, changed in place by
+// BridgeTransform functions
+type BridgeMessage struct {
+	Delivery   amqp.Delivery   // source delivery, settled by Bridge
+	Key        string          // routing key of publishing, the one of delivery by default
+	Publishing amqp.Publishing // copy of delivery by default
+}
+
+// BridgeStats is a snapshot of Bridge counters
+type BridgeStats struct {
+	Moved    uint64        // messages confirmed by destination and acked on source
+	Skipped  uint64        // messages dropped with ErrBridgeSkip
+	Failed   uint64        // messages rejected on source, since transformation failed
+	Requeued uint64        // messages requeued on source, since publishing failed
+	InFlight int64         // messages published, but not confirmed yet
+	Lag      time.Duration // age of the last moved message once it was confirmed
+}
+
+// bridgeCounters are updated atomically, kept first in Bridge for 64-bit
+// alignment
+type bridgeCounters struct {
+	moved    uint64
+	skipped  uint64
+	failed   uint64
+	requeued uint64
+	inFlight int64
+	lag      int64
+}
+
+// Bridge moves messages of queue on one broker to exchange on another, e.g.
+// to migrate between clusters, like shovel does. Source delivery is acked
+// only once destination confirmed its publishing, so messages are moved at
+// least once: they could be duplicated if bridge stops between confirmation
+// and ack, but never lost. Bridges in both directions keep clusters in sync
+// while clients move over, BridgeTransform should then skip messages bridged
+// already, so they don't loop.
+//
+//	bridge := cony.NewBridge(oldCluster, &cony.Queue{Name: "orders"}, newCluster, "orders",
+//		cony.BridgeConsumer(cony.Qos(500)),
+//		cony.BridgeTransform(func(m *cony.BridgeMessage) error {
+//			m.Publishing.Headers["x-migrated"] = true
+//			return nil
+//		}),
+//	)
+//	err := bridge.Run(ctx)
+type Bridge struct {
+	stats      bridgeCounters
+	src        *Client
+	dst        *Client
+	cons       *Consumer
+	pub        *Publisher
+	consOpts   []ConsumerOpt
+	pubOpts    []PublisherOpt
+	transforms []func(*BridgeMessage) error
+	confirms   chan amqp.Confirmation
+	errs       chan error
+}
+
+// NewBridge is a Bridge constructor. Messages of q consumed with src are
+// published to exchange with dst, keeping their routing keys, headers and
+// properties. q and exchange should be declared by user. Consumer has Qos
+// of 100, unless BridgeConsumer sets another one
+func NewBridge(src *Client, q *Queue, dst *Client, exchange string, opts ...BridgeOpt) *Bridge {
+	b := &Bridge{
+		src:      src,
+		dst:      dst,
+		consOpts: []ConsumerOpt{Qos(100)},
+		confirms: make(chan amqp.Confirmation, 100),
+		errs:     make(chan error, 100),
+	}
+	for _, o := range opts {
+		o(b)
+	}
+	b.cons = NewConsumer(q, b.consOpts...)
+	b.pub = NewPublisher(exchange, "", append(b.pubOpts, WithConfirmation(b.confirms))...)
+	return b
+}
+
+// BridgeConsumer set options of source Consumer, e.g. Qos limiting number of
+// messages in flight
+func BridgeConsumer(opts ...ConsumerOpt) BridgeOpt {
+	return func(b *Bridge) {
+		b.consOpts = append(b.consOpts, opts...)
+	}
+}
+
+// BridgePublisher set options of destination Publisher, WithConfirmation is
+// always set by Bridge
+func BridgePublisher(opts ...PublisherOpt) BridgeOpt {
+	return func(b *Bridge) {
+		b.pubOpts = append(b.pubOpts, opts...)
+	}
+}
+
+// BridgeTransform adds transformation applied to every message before it's
+// published, in order of options. Message is acked on source without being
+// published if f returns ErrBridgeSkip, other errors are reported to
+// Errors() and message is rejected on source, so it's dead-lettered if
+// queue has dead-letter-exchange
+func BridgeTransform(f func(m *BridgeMessage) error) BridgeOpt {
+	return func(b *Bridge) {
+		b.transforms = append(b.transforms, f)
+	}
+}
+
+// Run registers source consumer and destination publisher and moves
+// messages until ctx is done or consumer is cancelled. Messages which aren't
+// confirmed by then are redelivered by source broker.
+func (b *Bridge) Run(ctx context.Context) error {
+	b.src.Consume(b.cons)
+	b.dst.Publish(b.pub)
+	defer b.dst.RemovePublisher(b.pub)
+	defer b.src.RemoveConsumer(b.cons)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-b.cons.Deliveries():
+			if !ok {
+				return nil
+			}
+			b.move(d)
+		case err := <-b.cons.Errors():
+			b.reportErr(err)
+		case <-b.confirms:
+			// confirmations settle deliveries through PublishAsync callbacks
+		}
+	}
+}
+
+// move transforms delivery and publishes it, delivery is settled once
+// publishing is confirmed
+func (b *Bridge) move(d amqp.Delivery) {
+	m := &BridgeMessage{Delivery: d, Key: d.RoutingKey, Publishing: publishing(d)}
+	for _, f := range b.transforms {
+		if err := f(m); err == ErrBridgeSkip {
+			atomic.AddUint64(&b.stats.skipped, 1)
+			_ = d.Ack(false)
+			return
+		} else if err != nil {
+			atomic.AddUint64(&b.stats.failed, 1)
+			b.reportErr(err)
+			_ = d.Reject(false)
+			return
+		}
+	}
+
+	atomic.AddInt64(&b.stats.inFlight, 1)
+	b.pub.PublishAsyncWithRoutingKey(m.Publishing, m.Key, func(err error) {
+		atomic.AddInt64(&b.stats.inFlight, -1)
+		if err != nil {
+			atomic.AddUint64(&b.stats.requeued, 1)
+			b.reportErr(err)
+			_ = d.Nack(false, true)
+			return
+		}
+		if published := publishTime(d); !published.IsZero() {
+			atomic.StoreInt64(&b.stats.lag, int64(time.Since(published)))
+		}
+		atomic.AddUint64(&b.stats.moved, 1)
+		_ = d.Ack(false)
+	})
+}
+
+// Errors returns errors of source consumer, failed transformations and
+// publishings. Default buffer size is 100, errors are dropped in case if
+// receiver can't keep up
+func (b *Bridge) Errors() <-chan error {
+	return b.errs
+}
+
+func (b *Bridge) reportErr(err error) {
+	select {
+	case b.errs <- err:
+	default:
+	}
+}
+
+// Stats returns snapshot of bridge counters
+func (b *Bridge) Stats() BridgeStats {
+	return BridgeStats{
+		Moved:    atomic.LoadUint64(&b.stats.moved),
+		Skipped:  atomic.LoadUint64(&b.stats.skipped),
+		Failed:   atomic.LoadUint64(&b.stats.failed),
+		Requeued: atomic.LoadUint64(&b.stats.requeued),
+		InFlight: atomic.LoadInt64(&b.stats.inFlight),
+		Lag:      time.Duration(atomic.LoadInt64(&b.stats.lag)),
+	}
+}
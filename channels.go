@@ -0,0 +1,122 @@
+package cony
+
+import (
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrChannelLimit is reported once consumer or publisher can't get channel
+// because of MaxChannels. It's served later, once other channel is closed
+var ErrChannelLimit = errors.New("Channel limit reached")
+
+// MaxChannels is a functional option, used to limit number of channels open
+// by Client on its connection, to stay within broker `channel_max`. Consumers
+// and publishers exceeding the limit report ErrChannelLimit and are served
+// lazily, once other channels are closed
+func MaxChannels(n int) ClientOpt {
+	return func(c *Client) {
+		c.maxChannels = n
+	}
+}
+
+// DeclareRateLimit is a functional option, used to throttle declarations run
+// by Client, e.g. redeclaring topology of many consumers during reconnect
+// storm. rate is declarations per second, burst is a number of declarations
+// run at once
+func DeclareRateLimit(rate float64, burst int) ClientOpt {
+	return func(c *Client) {
+		c.declLimiter = newTokenBucket(rate, burst)
+	}
+}
+
+// waitDeclare waits for declaration rate limiter, returns error once Client
+// is closed
+func (c *Client) waitDeclare() error {
+	if c.declLimiter != nil {
+		return c.declLimiter.Wait(c.context())
+	}
+	return nil
+}
+
+// limitedChannel opens channel counted against MaxChannels
+func (c *Client) limitedChannel(conn Connection) (Channel, error) {
+	c.cm.Lock()
+	if c.openChannels >= c.maxChannels {
+		c.cm.Unlock()
+		return nil, ErrChannelLimit
+	}
+	c.openChannels++
+	gen := c.connGen
+	c.cm.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		c.releaseChannel(gen)
+		return nil, err
+	}
+
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		for range closes {
+		}
+		c.releaseChannel(gen)
+		c.serveLazy()
+	}()
+	return ch, nil
+}
+
+// releaseChannel frees channel slot, slots of previous connections are reset
+func (c *Client) releaseChannel(gen uint64) {
+	c.cm.Lock()
+	defer c.cm.Unlock()
+	if gen == c.connGen && c.openChannels > 0 {
+		c.openChannels--
+	}
+}
+
+// resetChannels forgets channels of previous connection
+func (c *Client) resetChannels() {
+	c.cm.Lock()
+	defer c.cm.Unlock()
+	c.connGen++
+	c.openChannels = 0
+}
+
+// serveLater queues consumer or publisher which hit channel limit, should be
+// called with lock held
+func (c *Client) serveLater(key interface{}, err error) {
+	if err == ErrChannelLimit {
+		c.reportErr(err)
+		c.lazy = append(c.lazy, key)
+	}
+}
+
+// serveLazy serves queued consumers and publishers, while channels are
+// available
+func (c *Client) serveLazy() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	for len(c.lazy) > 0 {
+		switch key := c.lazy[0].(type) {
+		case *Consumer:
+			if _, ok := c.consumers[key]; ok {
+				ch, err := c.consumerChannel(key)
+				if err != nil {
+					return
+				}
+				c.spawn(key, func() { key.serve(c, ch) })
+			}
+		case *Publisher:
+			if _, ok := c.publishers[key]; ok {
+				ch, err := c.channel()
+				if err != nil {
+					return
+				}
+				c.spawn(key, func() { key.serve(c, ch) })
+			}
+		}
+		c.lazy = c.lazy[1:]
+	}
+}
@@ -0,0 +1,475 @@
+package cony
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// FailureOp is an operation which could be failed with FailureInjector
+type FailureOp int
+
+// Operations which could be failed with FailureInjector
+const (
+	OpDial FailureOp = iota
+	OpChannel
+	OpDeclare
+	OpConsume
+	OpPublish
+)
+
+// FailureInjector lets tests force failures at specific points, so reconnect
+// and retry handling could be verified deterministically. It wraps
+// connections and channels established by Client, use it with
+// WithFailureInjector option.
+type FailureInjector struct {
+	m        sync.Mutex
+	failures map[FailureOp][]error
+	delay    time.Duration
+	returns  int
+	conns    map[*chaosConn]struct{}
+	chans    map[*chaosChannel]struct{}
+}
+
+// NewFailureInjector is a FailureInjector constructor
+func NewFailureInjector() *FailureInjector {
+	return &FailureInjector{
+		failures: make(map[FailureOp][]error),
+		conns:    make(map[*chaosConn]struct{}),
+		chans:    make(map[*chaosChannel]struct{}),
+	}
+}
+
+// FailNext makes next call of op fail with err. Multiple calls are queued
+func (f *FailureInjector) FailNext(op FailureOp, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.failures[op] = append(f.failures[op], err)
+}
+
+// DropConnections closes established connections with err, like network
+// failure happened
+func (f *FailureInjector) DropConnections(err *amqp.Error) {
+	f.m.Lock()
+	conns := make([]*chaosConn, 0, len(f.conns))
+	for c := range f.conns {
+		conns = append(conns, c)
+	}
+	f.m.Unlock()
+
+	for _, c := range conns {
+		c.closes.fire(err)
+		_ = c.Connection.Close()
+	}
+}
+
+// CloseChannels closes open channels with err, like broker channel exception
+// happened
+func (f *FailureInjector) CloseChannels(err *amqp.Error) {
+	f.m.Lock()
+	chans := make([]*chaosChannel, 0, len(f.chans))
+	for ch := range f.chans {
+		chans = append(chans, ch)
+	}
+	f.m.Unlock()
+
+	for _, ch := range chans {
+		ch.closes.fire(err)
+		_ = ch.Channel.Close()
+	}
+}
+
+// DelayConfirms delays every publisher confirmation by d
+func (f *FailureInjector) DelayConfirms(d time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.delay = d
+}
+
+// ReturnNext makes next n publishings returned back with NO_ROUTE basic.return
+// instead of being published
+func (f *FailureInjector) ReturnNext(n int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.returns += n
+}
+
+func (f *FailureInjector) fail(op FailureOp) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	errs := f.failures[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	f.failures[op] = errs[1:]
+	return errs[0]
+}
+
+func (f *FailureInjector) confirmDelay() time.Duration {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.delay
+}
+
+func (f *FailureInjector) takeReturn() bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.returns == 0 {
+		return false
+	}
+	f.returns--
+	return true
+}
+
+func (f *FailureInjector) wrap(dial DialFunc) DialFunc {
+	return func(url string, config amqp.Config) (Connection, error) {
+		if err := f.fail(OpDial); err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(url, config)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &chaosConn{Connection: conn, f: f}
+		c.closes.listen(conn.NotifyClose(make(chan *amqp.Error, 1)))
+
+		f.m.Lock()
+		f.conns[c] = struct{}{}
+		f.m.Unlock()
+		go func() {
+			c.closes.wait()
+			f.m.Lock()
+			delete(f.conns, c)
+			f.m.Unlock()
+		}()
+
+		return c, nil
+	}
+}
+
+// closeNotifier fans out close notification, either received from wrapped
+// connection/channel or injected
+type closeNotifier struct {
+	m     sync.Mutex
+	ls    []chan *amqp.Error
+	fired bool
+	done  chan struct{}
+}
+
+func (n *closeNotifier) listen(src chan *amqp.Error) {
+	n.m.Lock()
+	n.done = make(chan struct{})
+	n.m.Unlock()
+
+	go func() {
+		err, ok := <-src
+		if !ok {
+			err = nil
+		}
+		n.fire(err)
+	}()
+}
+
+func (n *closeNotifier) add(l chan *amqp.Error) chan *amqp.Error {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if n.fired {
+		close(l)
+	} else {
+		n.ls = append(n.ls, l)
+	}
+	return l
+}
+
+func (n *closeNotifier) fire(err *amqp.Error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if n.fired {
+		return
+	}
+	n.fired = true
+
+	for _, l := range n.ls {
+		if err != nil {
+			l <- err
+		}
+		close(l)
+	}
+	n.ls = nil
+	close(n.done)
+}
+
+func (n *closeNotifier) wait() {
+	<-n.done
+}
+
+type chaosConn struct {
+	Connection
+	f      *FailureInjector
+	closes closeNotifier
+}
+
+func (c *chaosConn) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	return c.closes.add(l)
+}
+
+func (c *chaosConn) Channel() (Channel, error) {
+	if err := c.f.fail(OpChannel); err != nil {
+		return nil, err
+	}
+
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	cch := &chaosChannel{Channel: ch, f: c.f, d: newNullDispatcher()}
+	cch.closes.listen(ch.NotifyClose(make(chan *amqp.Error, 1)))
+
+	c.f.m.Lock()
+	c.f.chans[cch] = struct{}{}
+	c.f.m.Unlock()
+	go func() {
+		cch.closes.wait()
+		c.f.m.Lock()
+		delete(c.f.chans, cch)
+		c.f.m.Unlock()
+		cch.shutdown()
+	}()
+
+	return cch, nil
+}
+
+type chaosChannel struct {
+	Channel
+	f      *FailureInjector
+	closes closeNotifier
+
+	// returns and confirmations are sent to listeners by dispatcher, in order
+	// and without holding m
+	d   *nullDispatcher
+	fwd sync.WaitGroup // forwarders of notifications of wrapped channel
+
+	m        sync.Mutex
+	closed   bool
+	seq      uint64            // publishings seen by caller
+	realSeq  uint64            // publishings passed to wrapped channel
+	tags     map[uint64]uint64 // wrapped channel delivery tag to caller's one
+	confirms chan amqp.Confirmation
+	order    []uint64                     // caller's tags waiting for confirmation
+	ready    map[uint64]amqp.Confirmation // confirmations held until previous ones are sent
+	returns  []chan amqp.Return
+}
+
+// shutdown stops dispatcher once forwarders closed their listeners
+func (ch *chaosChannel) shutdown() {
+	ch.m.Lock()
+	ch.closed = true
+	ch.m.Unlock()
+	ch.fwd.Wait()
+	ch.d.close()
+}
+
+// send runs f on dispatcher, f should give up once channel is closed
+func (ch *chaosChannel) send(f func(done <-chan struct{})) {
+	done := ch.closes.done
+	ch.d.do(func() { f(done) })
+}
+
+func (ch *chaosChannel) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	return ch.closes.add(l)
+}
+
+func (ch *chaosChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if err := ch.f.fail(OpDeclare); err != nil {
+		return amqp.Queue{Name: name}, err
+	}
+	return ch.Channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (ch *chaosChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if err := ch.f.fail(OpDeclare); err != nil {
+		return err
+	}
+	return ch.Channel.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+func (ch *chaosChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	if err := ch.f.fail(OpDeclare); err != nil {
+		return err
+	}
+	return ch.Channel.QueueBind(name, key, exchange, noWait, args)
+}
+
+func (ch *chaosChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if err := ch.f.fail(OpConsume); err != nil {
+		return nil, err
+	}
+	return ch.Channel.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+}
+
+func (ch *chaosChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ch.f.fail(OpPublish); err != nil {
+		return err
+	}
+
+	ch.m.Lock()
+	defer ch.m.Unlock()
+	ch.seq++
+
+	if ch.f.takeReturn() {
+		ret := amqp.Return{
+			ReplyCode:  amqp.NoRoute,
+			ReplyText:  "NO_ROUTE",
+			Exchange:   exchange,
+			RoutingKey: key,
+			Headers:    msg.Headers,
+			MessageId:  msg.MessageId,
+			Body:       msg.Body,
+		}
+		for _, l := range ch.returns {
+			l := l
+			ch.send(func(done <-chan struct{}) {
+				select {
+				case l <- ret:
+				case <-done:
+				}
+			})
+		}
+		// broker acks returned messages
+		if ch.confirms != nil {
+			ch.order = append(ch.order, ch.seq)
+			ch.ready[ch.seq] = amqp.Confirmation{DeliveryTag: ch.seq, Ack: true}
+			ch.flushConfirms()
+		}
+		return nil
+	}
+
+	if err := ch.Channel.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	ch.realSeq++
+	if ch.tags != nil {
+		ch.tags[ch.realSeq] = ch.seq
+		ch.order = append(ch.order, ch.seq)
+	}
+	return nil
+}
+
+// flushConfirms sends confirmations in order of caller's tags, should be
+// called with lock held
+func (ch *chaosChannel) flushConfirms() {
+	for len(ch.order) > 0 {
+		c, ok := ch.ready[ch.order[0]]
+		if !ok {
+			return
+		}
+		delete(ch.ready, ch.order[0])
+		ch.order = ch.order[1:]
+
+		l := ch.confirms
+		ch.send(func(done <-chan struct{}) {
+			if d := ch.f.confirmDelay(); d > 0 {
+				time.Sleep(d)
+			}
+			select {
+			case l <- c:
+			case <-done:
+			}
+		})
+	}
+}
+
+// forward registers forwarder of notifications, returns false if channel is
+// already closed
+func (ch *chaosChannel) forward() bool {
+	ch.m.Lock()
+	defer ch.m.Unlock()
+	if ch.closed {
+		return false
+	}
+	ch.fwd.Add(1)
+	return true
+}
+
+func (ch *chaosChannel) NotifyReturn(l chan amqp.Return) chan amqp.Return {
+	src := ch.Channel.NotifyReturn(make(chan amqp.Return, cap(l)))
+	if !ch.forward() {
+		close(l)
+		return l
+	}
+
+	ch.m.Lock()
+	ch.returns = append(ch.returns, l)
+	ch.m.Unlock()
+
+	go func() {
+		defer ch.fwd.Done()
+		for ret := range src {
+			ret := ret
+			ch.send(func(done <-chan struct{}) {
+				select {
+				case l <- ret:
+				case <-done:
+				}
+			})
+		}
+
+		ch.m.Lock()
+		for i, r := range ch.returns {
+			if r == l {
+				ch.returns = append(ch.returns[:i], ch.returns[i+1:]...)
+				break
+			}
+		}
+		ch.m.Unlock()
+		ch.d.do(func() { close(l) })
+	}()
+
+	return l
+}
+
+func (ch *chaosChannel) NotifyPublish(l chan amqp.Confirmation) chan amqp.Confirmation {
+	src := ch.Channel.NotifyPublish(make(chan amqp.Confirmation, cap(l)))
+	if !ch.forward() {
+		close(l)
+		return l
+	}
+
+	ch.m.Lock()
+	ch.confirms = l
+	ch.tags = make(map[uint64]uint64)
+	ch.ready = make(map[uint64]amqp.Confirmation)
+	ch.m.Unlock()
+
+	go func() {
+		defer ch.fwd.Done()
+		for c := range src {
+			ch.m.Lock()
+			real := c.DeliveryTag
+			c.DeliveryTag = ch.tags[real]
+			delete(ch.tags, real)
+			ch.ready[c.DeliveryTag] = c
+			ch.flushConfirms()
+			ch.m.Unlock()
+		}
+		ch.d.do(func() { close(l) })
+	}()
+
+	return l
+}
+
+// WithFailureInjector is a functional option, used to inject failures into
+// connections and channels established by Client. Meant for tests only.
+func WithFailureInjector(f *FailureInjector) ClientOpt {
+	return func(c *Client) {
+		c.injector = f
+	}
+}
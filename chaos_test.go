@@ -0,0 +1,212 @@
+package cony_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/integration-system/cony"
+	"github.com/integration-system/cony/conytest"
+	"github.com/streadway/amqp"
+)
+
+func TestFailureInjector(t *testing.T) {
+	b := conytest.NewBroker()
+	f := cony.NewFailureInjector()
+	dialErr := errors.New("dial error")
+	f.FailNext(cony.OpDial, dialErr)
+
+	client := cony.NewClient(cony.Dial(b.Dial), cony.WithFailureInjector(f))
+	defer client.Close()
+
+	q := &cony.Queue{Name: "q1"}
+	client.Declare([]cony.Declaration{cony.DeclareQueue(q)})
+	confirms := make(chan amqp.Confirmation, 10)
+	pub := cony.NewPublisher("", "q1", cony.WithConfirmation(confirms))
+	client.Publish(pub)
+
+	if !client.Loop() {
+		t.Fatal("should keep looping")
+	}
+	if err := <-client.Errors(); err != dialErr {
+		t.Error("should fail first dial")
+	}
+	client.Loop()
+
+	publishErr := errors.New("publish error")
+	f.FailNext(cony.OpPublish, publishErr)
+	if err := pub.Publish(amqp.Publishing{Body: []byte("test")}); err != publishErr {
+		t.Error("should fail publish with injected error", err)
+	}
+
+	f.ReturnNext(1)
+	f.DelayConfirms(20 * time.Millisecond)
+	started := time.Now()
+	if err := pub.Publish(amqp.Publishing{Body: []byte("test")}); err != nil {
+		t.Fatal("should publish", err)
+	}
+
+	select {
+	case c := <-confirms:
+		if c.DeliveryTag != 1 {
+			t.Error("confirmation should keep publisher's sequence", c.DeliveryTag)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should confirm returned message")
+	}
+
+	if time.Since(started) < 20*time.Millisecond {
+		t.Error("should delay confirmation")
+	}
+
+	if len(b.Messages("q1")) != 0 {
+		t.Error("returned message should not reach queue")
+	}
+
+	f.DropConnections(&amqp.Error{Code: amqp.ConnectionForced, Reason: "chaos"})
+	var err error
+	for i := 0; i < 100; i++ {
+		select {
+		case err = <-client.Errors():
+		case <-time.After(10 * time.Millisecond):
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Reason != "chaos" {
+		t.Error("should report injected connection drop", err)
+	}
+}
+
+func TestRepublishUnconfirmed(t *testing.T) {
+	f := cony.NewFailureInjector()
+	b, client := newTestClient(t, cony.WithFailureInjector(f))
+	defer client.Close()
+
+	client.WithChannel(func(ch cony.Channel) error {
+		return cony.DeclareQueue(&cony.Queue{Name: "q1"})(ch)
+	})
+
+	confirms := make(chan amqp.Confirmation, 10)
+	pub := cony.NewPublisher("", "q1", cony.WithConfirmation(confirms), cony.RepublishUnconfirmed())
+	client.Publish(pub)
+
+	f.DelayConfirms(100 * time.Millisecond)
+	done := make(chan error, 1)
+	pub.PublishAsync(amqp.Publishing{Body: []byte("m1")}, func(err error) { done <- err })
+
+	waitFor(t, func() bool { return len(b.Messages("q1")) == 1 })
+	f.DelayConfirms(0)
+	f.DropConnections(&amqp.Error{Code: amqp.ConnectionForced, Reason: "test"})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("republished message should be confirmed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("confirmation timeout")
+	}
+
+	msgs := b.Messages("q1")
+	if len(msgs) != 2 || msgs[0].MessageId == "" || msgs[0].MessageId != msgs[1].MessageId {
+		t.Fatal("should republish with the same MessageId", msgs)
+	}
+
+	if msgs[1].Headers[cony.RepublishedHeader] != true {
+		t.Error("republished copy should be marked", msgs[1].Headers)
+	}
+}
+
+func TestConfirmTimeout(t *testing.T) {
+	f := cony.NewFailureInjector()
+	_, client := newTestClient(t, cony.WithFailureInjector(f))
+	defer client.Close()
+
+	client.WithChannel(func(ch cony.Channel) error {
+		return cony.DeclareQueue(&cony.Queue{Name: "q1"})(ch)
+	})
+
+	confirms := make(chan amqp.Confirmation, 10)
+	pub := cony.NewPublisher("", "q1", cony.WithConfirmation(confirms), cony.ConfirmTimeout(20*time.Millisecond))
+	client.Publish(pub)
+	waitFor(t, func() bool { return pub.Publish(amqp.Publishing{}) == nil })
+
+	f.DelayConfirms(200 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- pub.Publish(amqp.Publishing{Body: []byte("m1")}) }()
+
+	waitFor(t, func() bool { return len(pub.Unconfirmed()) == 1 })
+	select {
+	case err := <-done:
+		if err != cony.ErrConfirmTimeout {
+			t.Error("should time out waiting for confirmation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish should not wait forever")
+	}
+
+	if tags := pub.Unconfirmed(); len(tags) != 0 {
+		t.Error("expired publishing should not be tracked", tags)
+	}
+}
+
+func TestConfirmSequence(t *testing.T) {
+	b, client := newTestClient(t)
+	defer client.Close()
+
+	confirms := make(chan amqp.Confirmation, 10)
+	pub := cony.NewPublisher("", "q1", cony.WithConfirmation(confirms))
+	client.Publish(pub)
+	waitFor(t, func() bool { return pub.Publish(amqp.Publishing{}) == nil })
+	if c := <-confirms; c.DeliveryTag != 1 {
+		t.Error("first tag should be 1", c)
+	}
+
+	b.DropConnections(&amqp.Error{Code: amqp.ConnectionForced, Reason: "test"})
+	waitFor(t, func() bool { return pub.Publish(amqp.Publishing{}) == nil })
+	select {
+	case c := <-confirms:
+		if c.DeliveryTag != 2 {
+			t.Error("tags should continue across reconnects", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("confirmation timeout")
+	}
+}
+
+func TestFailureInjector_confirmOrder(t *testing.T) {
+	b := conytest.NewBroker()
+	f := cony.NewFailureInjector()
+	client := cony.NewClient(cony.Dial(b.Dial), cony.WithFailureInjector(f))
+	defer client.Close()
+
+	client.Declare([]cony.Declaration{cony.DeclareQueue(&cony.Queue{Name: "q1"})})
+	confirms := make(chan amqp.Confirmation, 10)
+	pub := cony.NewPublisher("", "q1", cony.WithConfirmation(confirms))
+	client.Publish(pub)
+	client.Loop()
+
+	if err := pub.Publish(amqp.Publishing{Body: []byte("test")}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		f.ReturnNext(i % 2)
+		if err := pub.Publish(amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for tag := uint64(1); tag <= 5; tag++ {
+		select {
+		case c := <-confirms:
+			if c.DeliveryTag != tag {
+				t.Fatal("confirmations should keep order", tag, c.DeliveryTag)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("confirmation timeout")
+		}
+	}
+}
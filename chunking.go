@@ -0,0 +1,280 @@
+package cony
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers used to mark chunks of large messages
+const (
+	ChunkIDHeader    = "x-chunk-id"
+	ChunkIndexHeader = "x-chunk-index"
+	ChunkTotalHeader = "x-chunk-total"
+)
+
+// newID returns random 128 bit hex identifier
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// split body of publishing into chunks of at most size bytes, each chunk is
+// marked with chunk headers
+func split(pub amqp.Publishing, size int) []amqp.Publishing {
+	total := (len(pub.Body) + size - 1) / size
+	id := newID()
+	chunks := make([]amqp.Publishing, 0, total)
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(pub.Body) {
+			end = len(pub.Body)
+		}
+
+		chunk := pub
+		chunk.Body = pub.Body[i*size : end]
+		chunk.Headers = amqp.Table{}
+		for k, v := range pub.Headers {
+			chunk.Headers[k] = v
+		}
+		chunk.Headers[ChunkIDHeader] = id
+		chunk.Headers[ChunkIndexHeader] = int32(i)
+		chunk.Headers[ChunkTotalHeader] = int32(total)
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// Limits of reassembly, sets breaking them are rejected
+const (
+	maxChunks          = 1 << 16
+	maxReassembledSize = 1 << 30
+)
+
+// defaultChunkTTL is a time incomplete set of chunks is kept for
+const defaultChunkTTL = time.Minute
+
+// ChunksExpired is reported to Consumer.Errors() when chunks of message were
+// not all received within ChunkTTL. They are nacked without requeue
+type ChunksExpired struct {
+	ID       string
+	Received int
+	Total    int
+}
+
+func (e ChunksExpired) Error() string {
+	return fmt.Sprintf("chunks of message %s expired, received %d of %d", e.ID, e.Received, e.Total)
+}
+
+// chunkSet is incomplete set of chunks
+type chunkSet struct {
+	chunks   []amqp.Delivery
+	received int
+	started  time.Time
+}
+
+// assembler collects chunks of large messages until all of them arrived.
+// Acknowledgers of reassembled deliveries consult it from other goroutines
+type assembler struct {
+	m       sync.Mutex
+	sets    map[string]*chunkSet
+	unacked *unackedSet
+	ttl     time.Duration
+	max     int // prefetch of consumer, zero if unlimited
+	report  func(error)
+}
+
+func newAssembler(unacked *unackedSet, ttl time.Duration, max int, report func(error)) *assembler {
+	if ttl <= 0 {
+		ttl = defaultChunkTTL
+	}
+	return &assembler{
+		sets:    make(map[string]*chunkSet),
+		unacked: unacked,
+		ttl:     ttl,
+		max:     max,
+		report:  report,
+	}
+}
+
+// add delivery to assembler, returns true and reassembled delivery once last
+// chunk is received. Deliveries without chunk headers are passed as is.
+// Chunks of sets which can't be reassembled are rejected
+func (a *assembler) add(d *amqp.Delivery) bool {
+	id, ok := d.Headers[ChunkIDHeader].(string)
+	if !ok {
+		return true
+	}
+	index, _ := d.Headers[ChunkIndexHeader].(int32)
+	total, _ := d.Headers[ChunkTotalHeader].(int32)
+	if index < 0 || index >= total {
+		return true
+	}
+
+	if err := a.check(int(index), int(total), len(d.Body)); err != nil {
+		a.report(fmt.Errorf("reassemble %s: %v", id, err))
+		if d.Acknowledger != nil {
+			_ = d.Reject(false)
+		}
+		return false
+	}
+
+	a.m.Lock()
+	set, ok := a.sets[id]
+	if !ok {
+		set = &chunkSet{chunks: make([]amqp.Delivery, total), started: time.Now()}
+		a.sets[id] = set
+	} else if len(set.chunks) != int(total) {
+		// chunks disagree on total, set could never be reassembled
+		delete(a.sets, id)
+		a.m.Unlock()
+		a.report(fmt.Errorf("reassemble %s: chunk %d of %d, others are of %d", id, index, total, len(set.chunks)))
+		for _, chunk := range append(set.chunks, *d) {
+			if chunk.Acknowledger != nil {
+				_ = chunk.Reject(false)
+			}
+		}
+		return false
+	}
+	if set.chunks[index].Headers == nil {
+		set.received++
+	}
+	set.chunks[index] = *d
+	if set.received < int(total) {
+		a.m.Unlock()
+		return false
+	}
+	delete(a.sets, id)
+	a.m.Unlock()
+
+	chunks := set.chunks
+	var body []byte
+	tags := make([]uint64, 0, total)
+	for _, chunk := range chunks {
+		body = append(body, chunk.Body...)
+		tags = append(tags, chunk.DeliveryTag)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range chunks[0].Headers {
+		headers[k] = v
+	}
+	delete(headers, ChunkIDHeader)
+	delete(headers, ChunkIndexHeader)
+	delete(headers, ChunkTotalHeader)
+
+	*d = chunks[0]
+	d.Headers = headers
+	d.Body = body
+	d.DeliveryTag = chunks[total-1].DeliveryTag
+	if chunks[0].Acknowledger != nil {
+		d.Acknowledger = chunkAcknowledger{chunks[0].Acknowledger, tags, a}
+	}
+	return true
+}
+
+// check returns error if set of total chunks could never be reassembled
+func (a *assembler) check(index, total, size int) error {
+	switch {
+	case total > maxChunks:
+		return fmt.Errorf("%d chunks, at most %d are allowed", total, maxChunks)
+	case index < total-1 && int64(total)*int64(size) > maxReassembledSize:
+		return fmt.Errorf("%d chunks of %d bytes exceed %d bytes", total, size, maxReassembledSize)
+	case a.max > 0 && total > a.max:
+		return fmt.Errorf("%d chunks don't fit into prefetch of %d", total, a.max)
+	}
+	return nil
+}
+
+// expire nacks chunks of sets not completed within ttl
+func (a *assembler) expire(now time.Time) {
+	a.m.Lock()
+	var expired []*chunkSet
+	for id, set := range a.sets {
+		if now.Sub(set.started) >= a.ttl {
+			delete(a.sets, id)
+			expired = append(expired, set)
+			a.report(ChunksExpired{ID: id, Received: set.received, Total: len(set.chunks)})
+		}
+	}
+	a.m.Unlock()
+
+	for _, set := range expired {
+		for _, chunk := range set.chunks {
+			if chunk.Acknowledger != nil {
+				_ = chunk.Nack(false, false)
+			}
+		}
+	}
+}
+
+// held reports whether tag is a chunk of incomplete set
+func (a *assembler) held(tag uint64) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	for _, set := range a.sets {
+		for _, chunk := range set.chunks {
+			if chunk.Headers != nil && chunk.DeliveryTag == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chunkAcknowledger acknowledges every chunk of reassembled delivery. Multiple
+// acks and nacks settle deliveries up to tag one by one, skipping chunks held
+// by assembler
+type chunkAcknowledger struct {
+	ack  amqp.Acknowledger
+	tags []uint64
+	a    *assembler
+}
+
+func (c chunkAcknowledger) Ack(tag uint64, multiple bool) error {
+	return c.each(tag, multiple, func(tag uint64) error {
+		return c.ack.Ack(tag, false)
+	})
+}
+
+func (c chunkAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return c.each(tag, multiple, func(tag uint64) error {
+		return c.ack.Nack(tag, false, requeue)
+	})
+}
+
+func (c chunkAcknowledger) Reject(tag uint64, requeue bool) error {
+	return c.each(tag, false, func(tag uint64) error {
+		return c.ack.Reject(tag, requeue)
+	})
+}
+
+func (c chunkAcknowledger) each(tag uint64, multiple bool, f func(uint64) error) error {
+	tags := c.tags
+	if multiple {
+		tags = nil
+		for _, t := range c.a.unacked.upto(tag) {
+			if !c.a.held(t) {
+				tags = append(tags, t)
+			}
+		}
+		for _, t := range c.tags {
+			if t > tag {
+				tags = append(tags, t)
+			}
+		}
+	}
+	for _, tag := range tags {
+		if err := f(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
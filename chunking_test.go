@@ -0,0 +1,200 @@
+package cony
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type testAcknowledger struct {
+	acked    []uint64
+	nacked   []uint64
+	rejected []uint64
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = append(a.nacked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejected = append(a.rejected, tag)
+	return nil
+}
+
+func TestSplit(t *testing.T) {
+	chunks := split(amqp.Publishing{
+		Headers: amqp.Table{"a": "b"},
+		Body:    []byte("0123456789"),
+	}, 4)
+
+	if len(chunks) != 3 {
+		t.Fatal("should split into 3 chunks")
+	}
+
+	if string(chunks[2].Body) != "89" {
+		t.Error("last chunk should have remainder")
+	}
+
+	if chunks[0].Headers[ChunkIDHeader] != chunks[2].Headers[ChunkIDHeader] {
+		t.Error("chunks should share id")
+	}
+
+	if chunks[1].Headers[ChunkIndexHeader] != int32(1) || chunks[1].Headers[ChunkTotalHeader] != int32(3) {
+		t.Error("chunks should be numbered")
+	}
+
+	if chunks[1].Headers["a"] != "b" {
+		t.Error("chunks should keep headers")
+	}
+}
+
+func TestAssembler_add(t *testing.T) {
+	a := newAssembler(newUnackedSet(), 0, 0, func(error) {})
+	ack := &testAcknowledger{}
+	body := bytes.Repeat([]byte("x"), 25)
+
+	var d amqp.Delivery
+	chunks := split(amqp.Publishing{Body: body}, 10)
+	// deliver out of order, like after requeue
+	for i, n := range []int{2, 0, 1} {
+		d = amqp.Delivery{
+			Headers:      chunks[n].Headers,
+			Body:         chunks[n].Body,
+			DeliveryTag:  uint64(n + 1),
+			Acknowledger: ack,
+		}
+		if ok := a.add(&d); ok != (i == 2) {
+			t.Fatal("should deliver only after last chunk")
+		}
+	}
+
+	if !bytes.Equal(d.Body, body) {
+		t.Error("should reassemble body")
+	}
+
+	if _, ok := d.Headers[ChunkIDHeader]; ok {
+		t.Error("should strip chunk headers")
+	}
+
+	d.Ack(false)
+	if len(ack.acked) != 3 {
+		t.Error("should ack every chunk")
+	}
+
+	if len(a.sets) != 0 {
+		t.Error("should forget reassembled message")
+	}
+
+	plain := amqp.Delivery{Body: []byte("plain")}
+	if !a.add(&plain) {
+		t.Error("should pass plain deliveries")
+	}
+}
+
+func chunkDeliveries(body []byte, size int, ack amqp.Acknowledger, firstTag uint64) []amqp.Delivery {
+	var ds []amqp.Delivery
+	for i, chunk := range split(amqp.Publishing{Body: body}, size) {
+		ds = append(ds, amqp.Delivery{
+			Headers:      chunk.Headers,
+			Body:         chunk.Body,
+			DeliveryTag:  firstTag + uint64(i),
+			Acknowledger: ack,
+		})
+	}
+	return ds
+}
+
+func TestAssembler_limits(t *testing.T) {
+	var errs []error
+	a := newAssembler(newUnackedSet(), 0, 2, func(err error) { errs = append(errs, err) })
+	ack := &testAcknowledger{}
+
+	d := chunkDeliveries(bytes.Repeat([]byte("x"), 25), 10, ack, 1)[0]
+	if a.add(&d) || len(ack.rejected) != 1 || len(errs) != 1 {
+		t.Error("should reject set not fitting into prefetch", errs)
+	}
+
+	d = amqp.Delivery{
+		Headers:      amqp.Table{ChunkIDHeader: "big", ChunkIndexHeader: int32(0), ChunkTotalHeader: int32(1 << 20)},
+		Body:         []byte("x"),
+		Acknowledger: ack,
+	}
+	a.max = 0
+	if a.add(&d) || len(a.sets) != 0 {
+		t.Error("should not allocate huge sets")
+	}
+}
+
+func TestAssembler_totalMismatch(t *testing.T) {
+	var errs []error
+	a := newAssembler(newUnackedSet(), 0, 0, func(err error) { errs = append(errs, err) })
+	ack := &testAcknowledger{}
+
+	ds := chunkDeliveries(bytes.Repeat([]byte("x"), 25), 10, ack, 1)
+	a.add(&ds[0])
+	ds[2].Headers[ChunkTotalHeader] = int32(5)
+	ds[2].Headers[ChunkIndexHeader] = int32(4)
+	if a.add(&ds[2]) || len(a.sets) != 0 || len(errs) != 1 {
+		t.Error("should drop set once chunks disagree on total", errs)
+	}
+	if len(ack.rejected) != 2 || ack.rejected[0] != 1 || ack.rejected[1] != 3 {
+		t.Error("should reject chunks of dropped set", ack.rejected)
+	}
+
+	if a.add(&ds[1]) {
+		t.Error("remaining chunk should start a new set")
+	}
+}
+
+func TestAssembler_expire(t *testing.T) {
+	var errs []error
+	a := newAssembler(newUnackedSet(), time.Second, 0, func(err error) { errs = append(errs, err) })
+	ack := &testAcknowledger{}
+
+	d := chunkDeliveries(bytes.Repeat([]byte("x"), 25), 10, ack, 1)[0]
+	a.add(&d)
+
+	a.expire(time.Now())
+	if len(ack.nacked) != 0 {
+		t.Error("should keep fresh sets")
+	}
+
+	a.expire(time.Now().Add(time.Second))
+	if len(ack.nacked) != 1 || len(a.sets) != 0 {
+		t.Error("should nack expired chunks")
+	}
+	if _, ok := errs[0].(ChunksExpired); !ok {
+		t.Error("should report ChunksExpired", errs)
+	}
+}
+
+func TestChunkAcknowledger_multiple(t *testing.T) {
+	unacked := newUnackedSet()
+	a := newAssembler(unacked, 0, 0, func(error) {})
+	ack := &testAcknowledger{}
+
+	// tag 1 is plain delivery, 2 is chunk of other set, 3-5 are reassembled
+	other := chunkDeliveries([]byte("0123"), 2, ack, 2)[0]
+	ds := chunkDeliveries([]byte("abcdef"), 2, ack, 3)
+	for tag := uint64(1); tag <= 5; tag++ {
+		unacked.add(tag)
+	}
+	a.add(&other)
+	var d amqp.Delivery
+	for _, d = range ds {
+		a.add(&d)
+	}
+
+	d.Ack(true)
+	if len(ack.acked) != 4 || ack.acked[0] != 1 || ack.acked[1] != 3 {
+		t.Error("should ack deliveries up to tag, but held chunk", ack.acked)
+	}
+}
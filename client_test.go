@@ -1,8 +1,11 @@
 package cony
 
 import (
+	"context"
 	"errors"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -91,7 +94,7 @@ func TestClient_Loop(t *testing.T) {
 	}
 
 	// immitate connection
-	c.conn.Store(&amqp.Connection{})
+	c.conn.Store(connBox{amqpConnection{&amqp.Connection{}}})
 	c.run = run
 
 	if !c.Loop() {
@@ -111,10 +114,37 @@ func TestClient_reportErr(t *testing.T) {
 		c.reportErr(errors.New("test err"))
 	}
 
-	// should not block, error will be discarded
-	if !c.reportErr(errors.New("test err")) {
+	// should not block, the oldest error will be discarded
+	latest := errors.New("latest err")
+	if !c.reportErr(latest) {
 		t.Error("should return true")
 	}
+	if c.DroppedErrors() != 1 {
+		t.Error("should count dropped error", c.DroppedErrors())
+	}
+	var last error
+	for len(c.errs) > 0 {
+		last = <-c.errs
+	}
+	if last != latest {
+		t.Error("should keep the latest error", last)
+	}
+
+	unbuffered := NewClient(ErrorsChan(make(chan error)))
+	if !unbuffered.reportErr(latest) || unbuffered.DroppedErrors() != 1 {
+		t.Error("should not block on unbuffered channel")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	var got []error
+	c := NewClient(OnError(func(err error) { got = append(got, err) }))
+	for i := 0; i < 200; i++ {
+		c.reportErr(errors.New("test err"))
+	}
+	if len(got) != 200 || len(c.errs) != 0 || c.DroppedErrors() != 0 {
+		t.Error("should pass all errors to handler", len(got))
+	}
 }
 
 func TestClient_channel(t *testing.T) {}
@@ -126,7 +156,7 @@ func TestClient_connection(t *testing.T) {
 		t.Error("error should be", ErrNoConnection)
 	}
 
-	c.conn.Store(&amqp.Connection{})
+	c.conn.Store(connBox{amqpConnection{&amqp.Connection{}}})
 
 	con, err := c.connection()
 	if con == nil {
@@ -152,6 +182,132 @@ func TestURL(t *testing.T) {
 	}
 }
 
+func TestDial(t *testing.T) {
+	c := NewClient(Dial(func(string, amqp.Config) (Connection, error) {
+		return nil, errors.New("dial error")
+	}))
+
+	if err := c.Ping(time.Second); err == nil || err.Error() != "dial error" {
+		t.Error("should use custom dial func")
+	}
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	var (
+		calls int
+		sasl  []amqp.Authentication
+	)
+
+	c := NewClient(
+		CredentialsProvider(func(context.Context) (string, string, error) {
+			calls++
+			return "user" + strconv.Itoa(calls), "pass", nil
+		}),
+		Dial(func(url string, config amqp.Config) (Connection, error) {
+			sasl = config.SASL
+			return nil, errors.New("dial error")
+		}),
+	)
+
+	c.Loop()
+	c.Loop()
+
+	if calls != 2 {
+		t.Error("should fetch credentials on every dial")
+	}
+
+	if len(sasl) != 1 || sasl[0].Response() != "\x00user2\x00pass" {
+		t.Error("should dial with fresh credentials")
+	}
+
+	credErr := errors.New("vault is sealed")
+	c = NewClient(CredentialsProvider(func(context.Context) (string, string, error) {
+		return "", "", credErr
+	}))
+	c.Loop()
+
+	if err := <-c.Errors(); err != credErr {
+		t.Error("should report credentials error")
+	}
+}
+
+func TestCredentialsProvider_cancel(t *testing.T) {
+	c := NewClient(CredentialsProvider(func(ctx context.Context) (string, string, error) {
+		<-ctx.Done()
+		return "", "", ctx.Err()
+	}))
+	time.AfterFunc(10*time.Millisecond, c.Close)
+	c.Loop()
+
+	if err := <-c.Errors(); err != context.Canceled {
+		t.Error("Close should cancel credentials provider", err)
+	}
+
+	c = NewClient(Auth(ExternalAuth{}), CredentialsProvider(func(context.Context) (string, string, error) {
+		return "user", "pass", nil
+	}))
+	c.Loop()
+
+	if err := <-c.Errors(); err != ErrAuthConflict {
+		t.Error("should report conflicting auth", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	c := NewClient(Auth(ExternalAuth{}, &amqp.PlainAuth{}))
+
+	if len(c.config.SASL) != 2 || c.config.SASL[0].Mechanism() != "EXTERNAL" {
+		t.Error("should set SASL mechanisms")
+	}
+}
+
+func TestClientProperties(t *testing.T) {
+	c := NewClient(
+		ClientProperties(amqp.Table{"product": "orders"}),
+		ConnectionName("orders-service-7f9c"),
+	)
+
+	if c.config.Properties["connection_name"] != "orders-service-7f9c" {
+		t.Error("should set connection name")
+	}
+
+	if c.config.Properties["product"] != "orders" {
+		t.Error("should keep client properties")
+	}
+}
+
+func TestTuningOptions(t *testing.T) {
+	c := NewClient(
+		Heartbeat(2*time.Second),
+		ChannelMax(64),
+		FrameSize(4096),
+		Locale("en_GB"),
+	)
+
+	if c.config.Heartbeat != 2*time.Second {
+		t.Error("should set heartbeat")
+	}
+
+	if c.config.ChannelMax != 64 || c.config.FrameSize != 4096 {
+		t.Error("should set channel max and frame size")
+	}
+
+	if c.config.Locale != "en_GB" {
+		t.Error("should set locale")
+	}
+}
+
+func TestClient_dialConfig_heartbeat(t *testing.T) {
+	c := NewClient()
+	config, err := c.dialConfig()
+	if err != nil || config.Heartbeat != 10*time.Second {
+		t.Error("should default heartbeat to 10 seconds", config.Heartbeat, err)
+	}
+	if c.config.Heartbeat != 0 {
+		t.Error("should not change client config")
+	}
+}
+
 func TestBackoff(t *testing.T) {
 	c := &Client{}
 	Backoff(DefaultBackoff)(c)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/integration-system/cony"
+	"github.com/streadway/amqp"
+)
+
+// topologyFile is a topology description read by declare command
+type topologyFile struct {
+	Exchanges []exchangeSpec `json:"exchanges"`
+	Queues    []queueSpec    `json:"queues"`
+}
+
+type exchangeSpec struct {
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Args       map[string]interface{} `json:"args"`
+}
+
+type queueSpec struct {
+	Name       string                 `json:"name"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Exclusive  bool                   `json:"exclusive"`
+	Args       map[string]interface{} `json:"args"`
+	Bindings   []bindingSpec          `json:"bindings"`
+}
+
+type bindingSpec struct {
+	Exchange string                 `json:"exchange"`
+	Key      string                 `json:"key"`
+	Args     map[string]interface{} `json:"args"`
+}
+
+// readTopology decodes topology description. Integer arguments are kept as
+// int64, so x-max-length and alike pass cony validation and aren't sent as
+// floats
+func readTopology(r io.Reader) (*cony.Topology, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+
+	var f topologyFile
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid topology: %v", err)
+	}
+
+	t := cony.NewTopology()
+	exchanges := make(map[string]cony.Exchange)
+	for _, e := range f.Exchanges {
+		ex := cony.Exchange{
+			Name:       e.Name,
+			Kind:       e.Kind,
+			Durable:    e.Durable,
+			AutoDelete: e.AutoDelete,
+			Args:       table(e.Args),
+		}
+		if ex.Kind == "" {
+			ex.Kind = amqp.ExchangeDirect
+		}
+		exchanges[ex.Name] = ex
+		t.Exchange(ex)
+	}
+
+	for _, q := range f.Queues {
+		que := &cony.Queue{
+			Name:       q.Name,
+			Durable:    q.Durable,
+			AutoDelete: q.AutoDelete,
+			Exclusive:  q.Exclusive,
+			Args:       table(q.Args),
+		}
+		t.Queue(que)
+		for _, b := range q.Bindings {
+			ex, ok := exchanges[b.Exchange]
+			if !ok {
+				ex = cony.Exchange{Name: b.Exchange}
+			}
+			t.Bind(cony.Binding{
+				Queue:    que,
+				Exchange: ex,
+				Key:      b.Key,
+				Args:     table(b.Args),
+			})
+		}
+	}
+	return t, nil
+}
+
+// table converts decoded JSON object to amqp.Table
+func table(m map[string]interface{}) amqp.Table {
+	if m == nil {
+		return nil
+	}
+	t := make(amqp.Table, len(m))
+	for k, v := range m {
+		t[k] = value(v)
+	}
+	return t
+}
+
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		return table(v)
+	case []interface{}:
+		vs := make([]interface{}, len(v))
+		for i := range v {
+			vs[i] = value(v[i])
+		}
+		return vs
+	}
+	return v
+}
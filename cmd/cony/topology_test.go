@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestReadTopology(t *testing.T) {
+	top, err := readTopology(strings.NewReader(`{
+		"exchanges": [{"name": "orders", "kind": "topic", "durable": true}],
+		"queues": [{
+			"name": "orders.new",
+			"args": {"x-max-length": 10, "x-queue-mode": "lazy"},
+			"bindings": [
+				{"exchange": "orders", "key": "new.#"},
+				{"exchange": "amq.fanout"}
+			]
+		}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := top.Declarations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 4 {
+		t.Errorf("should be 4 declarations, got %d", len(ds))
+	}
+}
+
+func TestReadTopology_unresolved(t *testing.T) {
+	top, err := readTopology(strings.NewReader(`{
+		"queues": [{"name": "q", "bindings": [{"exchange": "missing"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := top.Declarations(); err == nil {
+		t.Error("binding to undeclared exchange should be rejected")
+	}
+}
+
+func TestReadTopology_unknownField(t *testing.T) {
+	_, err := readTopology(strings.NewReader(`{"queues": [{"name": "q", "durabel": true}]}`))
+	if err == nil {
+		t.Error("unknown field should be rejected")
+	}
+}
+
+func TestTable(t *testing.T) {
+	tbl := table(map[string]interface{}{"n": json.Number("10"), "f": json.Number("1.5")})
+	if n, ok := tbl["n"].(int64); !ok || n != 10 {
+		t.Errorf("integer should be int64, got %#v", tbl["n"])
+	}
+	if f, ok := tbl["f"].(float64); !ok || f != 1.5 {
+		t.Errorf("fraction should be float64, got %#v", tbl["f"])
+	}
+	if err := amqp.Table(tbl).Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,109 @@
+package cony
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses message bodies. Encoding() is used as
+// amqp.Publishing ContentEncoding, so consumers know how to decode body.
+//
+// Gzip, Zstd and Snappy are built in, other algorithms (lz4) could be plugged
+// in by implementing this interface.
+type Codec interface {
+	Encoding() string
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+// Gzip is a gzip Codec
+var Gzip Codec = gzipCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encoding() string {
+	return "gzip"
+}
+
+func (gzipCodec) Encode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Zstd is a zstd Codec, faster than gzip at similar ratio
+var Zstd Codec = &zstdCodec{}
+
+// zstdCodec shares encoder and decoder, their EncodeAll and DecodeAll are
+// safe for concurrent use
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (z *zstdCodec) init() error {
+	z.once.Do(func() {
+		if z.enc, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.dec, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCodec) Encoding() string {
+	return "zstd"
+}
+
+func (z *zstdCodec) Encode(b []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(b, nil), nil
+}
+
+func (z *zstdCodec) Decode(b []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(b, nil)
+}
+
+// Snappy is a snappy Codec of block format, the fastest one with lower ratio
+var Snappy Codec = snappyCodec{}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encoding() string {
+	return "snappy"
+}
+
+func (snappyCodec) Encode(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCodec) Decode(b []byte) ([]byte, error) {
+	return snappy.Decode(nil, b)
+}
@@ -0,0 +1,76 @@
+package cony
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	body := bytes.Repeat([]byte("ololo"), 100)
+
+	compressed, err := Gzip.Encode(body)
+	if err != nil {
+		t.Fatal("should compress", err)
+	}
+
+	if len(compressed) >= len(body) {
+		t.Error("should reduce size")
+	}
+
+	decompressed, err := Gzip.Decode(compressed)
+	if err != nil {
+		t.Fatal("should decompress", err)
+	}
+
+	if !bytes.Equal(decompressed, body) {
+		t.Error("should restore body")
+	}
+
+	if _, err := Gzip.Decode(body); err == nil {
+		t.Error("should fail on garbage")
+	}
+}
+
+func TestZstd(t *testing.T) {
+	body := bytes.Repeat([]byte("ololo"), 100)
+
+	compressed, err := Zstd.Encode(body)
+	if err != nil {
+		t.Fatal("should compress", err)
+	}
+
+	if len(compressed) >= len(body) || Zstd.Encoding() != "zstd" {
+		t.Error("should reduce size")
+	}
+
+	decompressed, err := Zstd.Decode(compressed)
+	if err != nil || !bytes.Equal(decompressed, body) {
+		t.Error("should restore body", err)
+	}
+
+	if _, err := Zstd.Decode(body); err == nil {
+		t.Error("should fail on garbage")
+	}
+}
+
+func TestSnappy(t *testing.T) {
+	body := bytes.Repeat([]byte("ololo"), 100)
+
+	compressed, err := Snappy.Encode(body)
+	if err != nil {
+		t.Fatal("should compress", err)
+	}
+
+	if len(compressed) >= len(body) || Snappy.Encoding() != "snappy" {
+		t.Error("should reduce size")
+	}
+
+	decompressed, err := Snappy.Decode(compressed)
+	if err != nil || !bytes.Equal(decompressed, body) {
+		t.Error("should restore body", err)
+	}
+
+	if _, err := Snappy.Decode([]byte{0xff, 0xff, 0xff}); err == nil {
+		t.Error("should fail on garbage")
+	}
+}
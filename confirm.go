@@ -0,0 +1,69 @@
+package cony
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrConfirmTimeout is returned if broker didn't confirm publishing within
+// ConfirmTimeout
+var ErrConfirmTimeout = errors.New("Publishing confirmation timed out")
+
+// expire settles publishings not confirmed within timeout with
+// ErrConfirmTimeout and stops tracking them
+func (t *confirmTracker) expire(now time.Time) {
+	t.m.Lock()
+	var expired []unconfirmed
+	for tag, u := range t.pending {
+		if now.Sub(u.sent) >= t.timeout {
+			expired = append(expired, u)
+			delete(t.pending, tag)
+		}
+	}
+	t.m.Unlock()
+
+	for _, u := range expired {
+		u.res.settle(ErrConfirmTimeout)
+	}
+}
+
+// tags returns sorted publisher wide tags of publishings waiting for
+// confirmation
+func (t *confirmTracker) tags() []uint64 {
+	if t == nil {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	tags := make([]uint64, 0, len(t.pending))
+	for tag := range t.pending {
+		tags = append(tags, tag+t.base)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+// Unconfirmed returns sorted delivery tags of publishings written to current
+// channel, but not confirmed by broker yet. Tags match ones of confirmations
+// passed to WithConfirmation channel. Synchronous publishings are
+// tracked with ConfirmTimeout or RepublishUnconfirmed options only.
+func (p *Publisher) Unconfirmed() []uint64 {
+	p.m.Lock()
+	tracker := p.tracker
+	p.m.Unlock()
+	return tracker.tags()
+}
+
+// ConfirmTimeout Publisher's functional option. Publish waits for
+// confirmation of publishing and returns ErrNacked if broker nacked it or
+// ErrConfirmTimeout if confirmation didn't arrive within d, PublishAsync
+// callbacks get the same errors. Publishings waiting for reconnect with
+// RepublishUnconfirmed expire as well. Cancel interrupts waiting Publish with
+// ErrPublisherDead. Requires WithConfirmation option.
+func ConfirmTimeout(d time.Duration) PublisherOpt {
+	return func(p *Publisher) {
+		p.confirmTimeout = d
+	}
+}
@@ -0,0 +1,76 @@
+package cony
+
+import "github.com/streadway/amqp"
+
+// DialFunc establishes AMQP connection, default one uses amqp.DialConfig.
+// Could be replaced with Dial option, e.g. with in-memory broker from conytest
+// package
+type DialFunc func(url string, config amqp.Config) (Connection, error)
+
+// Connection is an AMQP connection used by Client
+type Connection interface {
+	Channel() (Channel, error)
+	Close() error
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	NotifyBlocked(chan amqp.Blocking) chan amqp.Blocking
+}
+
+// Channel is an AMQP channel used by Client, Consumer and Publisher. It is
+// implemented by *amqp.Channel
+type Channel interface {
+	Declarer
+	Close() error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	NotifyCancel(chan string) chan string
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+	NotifyReturn(chan amqp.Return) chan amqp.Return
+	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyFlow(chan bool) chan bool
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	ExchangeDelete(name string, ifUnused, noWait bool) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Tx() error
+	TxCommit() error
+	TxRollback() error
+}
+
+// amqpConnection adapts *amqp.Connection to Connection
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// dial is a default DialFunc. It applies query parameters of URI to config and
+// reports invalid URI with password redacted
+func dial(url string, config amqp.Config) (Connection, error) {
+	uri, err := ParseURI(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := uri.apply(&config); err != nil {
+		return nil, err
+	}
+	conn, err := amqp.DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// connBox is stored in Client's atomic.Value, since it requires consistent
+// concrete type
+type connBox struct {
+	conn Connection
+}
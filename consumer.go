@@ -1,9 +1,13 @@
 package cony
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -11,8 +15,88 @@ import (
 // ConsumerOpt is a consumer's functional option type
 type ConsumerOpt func(*Consumer)
 
+// CancelPolicy defines Consumer behavior when broker cancels it, e.g. queue
+// was deleted or HA failover happened
+type CancelPolicy int
+
+const (
+	// CancelResubscribe re-runs client declarations and consumes again.
+	// This is the default policy
+	CancelResubscribe CancelPolicy = iota
+	// CancelStop stops consuming until next reconnect
+	CancelStop
+)
+
+// ConsumerCancelled is reported to Consumer.Errors() when broker cancels
+// consumer
+type ConsumerCancelled struct {
+	Queue string
+	Tag   string
+}
+
+func (e ConsumerCancelled) Error() string {
+	return "consumer " + e.Tag + " cancelled by broker"
+}
+
+// ConsumerError is reported to Consumer.Errors() when consumer channel is
+// closed with error, e.g. by PRECONDITION_FAILED on ack of unknown delivery
+// tag or consumer timeout
+type ConsumerError struct {
+	Queue string
+	Tag   string
+	Err   error
+}
+
+func (e ConsumerError) Error() string {
+	return fmt.Sprintf("consumer %s of queue %s: %v", e.Tag, e.Queue, e.Err)
+}
+
+// Unwrap returns error of consumer channel
+func (e ConsumerError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownEncoding is passed to OnUndecodable callback for delivery with
+// ContentEncoding there's no Decompression codec for
+type UnknownEncoding struct {
+	Encoding string
+}
+
+func (e UnknownEncoding) Error() string {
+	return fmt.Sprintf("unknown content encoding %s", e.Encoding)
+}
+
+// ConsumerStats is a snapshot of Consumer counters
+type ConsumerStats struct {
+	Delivered    uint64    // deliveries received from broker
+	Acked        uint64    // deliveries acked, not counted in AutoAck mode
+	Nacked       uint64    // deliveries nacked or rejected
+	Requeued     uint64    // deliveries nacked or rejected with requeue
+	TimedOut     uint64    // handlers exceeded HandlerTimeout
+	Expired      uint64    // deliveries dropped by DropExpired
+	Overdue      uint64    // deliveries unacked close to ConsumerTimeout
+	InFlight     int64     // deliveries received, but not acked yet
+	LastDelivery time.Time // time of last delivery, zero if none
+}
+
+// consumerCounters are updated atomically, kept first in Consumer for 64-bit
+// alignment
+type consumerCounters struct {
+	delivered    uint64
+	acked        uint64
+	nacked       uint64
+	requeued     uint64
+	inFlight     int64
+	lastDelivery int64 // unix nano
+	nextOffset   int64 // stream offset to resume from, zero if unknown
+	timedOut     uint64
+	expired      uint64
+	overdue      uint64
+}
+
 // Consumer holds definition for AMQP consumer
 type Consumer struct {
+	stats      consumerCounters
 	q          *Queue
 	deliveries chan amqp.Delivery
 	errs       chan error
@@ -21,7 +105,37 @@ type Consumer struct {
 	autoAck    bool
 	exclusive  bool
 	noLocal    bool
+	noWait     bool
+	args       amqp.Table
+	onCancel   CancelPolicy
+	decoders   map[string]Codec
+	decodeFail bool // Undecodable option is set
+	decodeQ    string
+	decodeFn   func(amqp.Delivery, error) // OnUndecodable callback
+	reassemble bool
+	expiring   bool // DropExpired option is set
+	chunkTTL   time.Duration
+	maxAttempt int64
+	quarantine string
+	requeues   *requeueCounter
+	dedup      DedupStore
+	dedupTTL   time.Duration
+	stream     bool
+	ackEvery   time.Duration
+	ackMax     int
+	timeout    time.Duration
+	tmoRequeue bool
+	ackTimeout time.Duration // ConsumerTimeout option
+	dueRequeue bool
+	workers    int
+	orderBy    func(amqp.Delivery) string
+	validator  Validator
+	invalidQ   string
+	dedicated  bool
+	shared     bool
+	opts       []ConsumerOpt
 	stop       chan struct{}
+	drain      chan struct{} // closed by Close to cancel basic.consume
 	dead       bool
 	m          sync.Mutex
 }
@@ -32,7 +146,14 @@ func (c *Consumer) Deliveries() <-chan amqp.Delivery {
 	return c.deliveries
 }
 
-// Errors returns channel with AMQP channel level errors
+// Tag returns consumer tag, generated one unless set by Tag or AutoTag
+// option
+func (c *Consumer) Tag() string {
+	return c.tag
+}
+
+// Errors returns channel with AMQP channel level errors, see ConsumerError
+// and ConsumerCancelled
 func (c *Consumer) Errors() <-chan error {
 	return c.errs
 }
@@ -44,11 +165,71 @@ func (c *Consumer) Cancel() {
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	if !c.dead {
+	select {
+	case <-c.stop:
+	default:
 		close(c.stop)
 	}
 }
 
+// Close cancels basic.consume and waits for deliveries received already to be
+// acknowledged, then stops consumer like Cancel. Returns number of deliveries
+// left unacknowledged, which broker requeues, and ctx error if ctx was done
+// before all of them were acknowledged. Deliveries() should be read till
+// Close returns, deliveries received but not read yet count as well.
+func (c *Consumer) Close(ctx context.Context) (int, error) {
+	c.m.Lock()
+	if !c.draining() {
+		close(c.drain)
+	}
+	c.m.Unlock()
+	defer c.Cancel()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		unacked := int(atomic.LoadInt64(&c.stats.inFlight))
+		if unacked == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return unacked, nil
+		case <-ctx.Done():
+			return unacked, ctx.Err()
+		}
+	}
+}
+
+// draining reports whether Close was called
+func (c *Consumer) draining() bool {
+	select {
+	case <-c.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats returns snapshot of consumer counters
+func (c *Consumer) Stats() ConsumerStats {
+	stats := ConsumerStats{
+		Delivered: atomic.LoadUint64(&c.stats.delivered),
+		Acked:     atomic.LoadUint64(&c.stats.acked),
+		Nacked:    atomic.LoadUint64(&c.stats.nacked),
+		Requeued:  atomic.LoadUint64(&c.stats.requeued),
+		TimedOut:  atomic.LoadUint64(&c.stats.timedOut),
+		Expired:   atomic.LoadUint64(&c.stats.expired),
+		Overdue:   atomic.LoadUint64(&c.stats.overdue),
+		InFlight:  atomic.LoadInt64(&c.stats.inFlight),
+	}
+	if last := atomic.LoadInt64(&c.stats.lastDelivery); last != 0 {
+		stats.LastDelivery = time.Unix(0, last)
+	}
+	return stats
+}
+
 func (c *Consumer) reportErr(err error) bool {
 	if err != nil {
 		select {
@@ -61,39 +242,421 @@ func (c *Consumer) reportErr(err error) bool {
 }
 
 func (c *Consumer) serve(client owner, ch mqChannel) {
+	if v, ok := ch.(*sharedView); ok {
+		// shared channel is closed once the last of its consumers exits
+		defer v.Close()
+	}
+
+	if c.stream && (c.qos == 0 || c.autoAck) {
+		c.reportErr(errStreamQos)
+		return
+	}
+
 	if c.reportErr(ch.Qos(c.qos, 0, false)) {
 		return
 	}
 
-	deliveries, err2 := ch.Consume(c.q.Name,
-		c.tag,       // consumer tag
-		c.autoAck,   // autoAck,
-		c.exclusive, // exclusive,
-		c.noLocal,   // noLocal,
-		false,       // noWait,
-		nil,         // args Table
+	cancels := ch.NotifyCancel(make(chan string, 1))
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	// deliveries not acked on this channel will be redelivered by broker
+	unacked := newUnackedSet()
+	defer func() {
+		atomic.AddInt64(&c.stats.inFlight, -int64(unacked.drain()))
+	}()
+
+	var pending *pendingIDs
+	if c.dedup != nil {
+		pending = newPendingIDs()
+		defer pending.drain()
+	}
+
+	var acks *ackCoalescer
+	if c.ackEvery > 0 && !c.autoAck && !c.shared {
+		acks = newAckCoalescer(c.ackMax)
+		defer acks.run(c.ackEvery)()
+	}
+
+	var due *deadlines
+	if timeout := c.consumerTimeout(); timeout > 0 {
+		due = newDeadlines(timeout)
+	}
+
+	for {
+		if c.draining() {
+			// consumer is closing, unacked deliveries of previous channel
+			// are requeued already
+			c.consume(client, ch, nil, cancels, unacked, pending, acks, due)
+			return
+		}
+
+		deliveries, err2 := ch.Consume(c.q.CurrentName(),
+			c.tag,           // consumer tag
+			c.autoAck,       // autoAck,
+			c.exclusive,     // exclusive,
+			c.noLocal,       // noLocal,
+			c.noWait,        // noWait,
+			c.consumeArgs(), // args Table
+		)
+		if c.reportErr(err2) {
+			return
+		}
+
+		tag, cancelled := c.consume(client, ch, deliveries, cancels, unacked, pending, acks, due)
+		if !cancelled {
+			// channel error is sent before deliveries are closed
+			select {
+			case err := <-closes:
+				if err != nil {
+					c.reportErr(ConsumerError{Queue: c.q.CurrentName(), Tag: c.tag, Err: err})
+				}
+			default:
+			}
+			return
+		}
+
+		c.reportErr(ConsumerCancelled{Queue: c.q.CurrentName(), Tag: tag})
+		if c.onCancel != CancelResubscribe {
+			_ = acks.flush()
+			_ = ch.Close()
+			return
+		}
+		client.redeclare()
+	}
+}
+
+// consume ships deliveries until consumer is stopped, channel is closed or
+// broker cancels consumer. Returns cancelled consumer tag in the latter case.
+func (c *Consumer) consume(client owner, ch mqChannel, deliveries <-chan amqp.Delivery, cancels <-chan string, unacked *unackedSet, pending *pendingIDs, acks *ackCoalescer, due *deadlines) (string, bool) {
+	side := &sidePublisher{client: client, stop: c.stop}
+	defer side.close()
+
+	// chunks not acked on this channel will be redelivered by broker
+	var (
+		chunks *assembler
+		sweep  <-chan time.Time
 	)
-	if c.reportErr(err2) {
-		return
+	if c.reassemble {
+		chunks = newAssembler(unacked, c.chunkTTL, c.qos, func(err error) { c.reportErr(err) })
+		ticker := time.NewTicker(chunks.ttl/2 + 1)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
+	var check <-chan time.Time
+	if due != nil {
+		ticker := time.NewTicker(due.interval())
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	drain := c.drain
+	if deliveries == nil {
+		drain = nil
 	}
 
 	for {
 		select {
+		case <-drain:
+			// deliveries already received could still be acked on channel
+			drain = nil
+			c.reportErr(ch.Cancel(c.tag, false))
 		case <-c.stop:
+			_ = acks.flush()
 			ch.Close()
 
 			client.deleteConsumer(c)
-			c.dead = true
-			close(c.deliveries)
-			return
+			c.m.Lock()
+			if !c.dead {
+				c.dead = true
+				close(c.deliveries)
+			}
+			c.m.Unlock()
+			return "", false
+		case tag, ok := <-cancels: // cancels will be closed along with channel
+			return tag, ok
+		case now := <-sweep:
+			chunks.expire(now)
+		case now := <-check:
+			c.overdue(due, unacked, now)
 		case d, ok := <-deliveries: // deliveries will be closed once channel is closed (disconnected from network)
 			if !ok {
-				return
+				if c.draining() {
+					// wait for Close to stop consumer
+					deliveries = nil
+					continue
+				}
+				// broker closes deliveries right after cancel notification
+				select {
+				case tag, ok := <-cancels:
+					return tag, ok
+				default:
+					return "", false
+				}
 			}
-			if !c.dead {
-				c.deliveries <- d
+			acks.track(&d)
+			if due != nil && d.Acknowledger != nil {
+				// before track, so requeue isn't refused as revoked
+				due.watch(&d, time.Now())
+			}
+			c.track(&d, unacked)
+			if c.stream {
+				c.trackOffset(&d)
+			}
+			if c.reassemble && !chunks.add(&d) {
+				continue
+			}
+			if c.expiring && c.expired(&d) {
+				continue
+			}
+			if c.maxAttempt > 0 && c.quarantined(side, &d) {
+				continue
+			}
+			if c.dedup != nil && c.duplicate(&d, pending) {
+				continue
+			}
+			if c.dead || !c.decode(side, &d) {
+				continue
 			}
+			if c.validator != nil && c.invalid(side, &d) {
+				continue
+			}
+			// delivery not shipped before stop is redelivered by broker
+			select {
+			case c.deliveries <- d:
+			case <-c.stop:
+			}
+		}
+	}
+}
+
+// track counts delivery and wraps its Acknowledger to count acks
+func (c *Consumer) track(d *amqp.Delivery, unacked *unackedSet) {
+	atomic.AddUint64(&c.stats.delivered, 1)
+	atomic.StoreInt64(&c.stats.lastDelivery, time.Now().UnixNano())
+
+	if c.autoAck || d.Acknowledger == nil {
+		return
+	}
+	unacked.add(d.DeliveryTag)
+	atomic.AddInt64(&c.stats.inFlight, 1)
+	d.Acknowledger = statsAcknowledger{d.Acknowledger, c, unacked}
+}
+
+// quarantined moves delivery to quarantine queue, if it was delivered more
+// than allowed by MaxDeliveryAttempts. Delivery is acked once broker confirmed
+// its copy, or requeued if it can't be moved
+func (c *Consumer) quarantined(side *sidePublisher, d *amqp.Delivery) bool {
+	name := c.q.CurrentName()
+
+	attempts := deliveryAttempts(*d, name)
+	if requeued := c.requeues.attempts(*d); requeued > attempts {
+		attempts = requeued
+	}
+	if attempts <= c.maxAttempt {
+		return false
+	}
+
+	if err := side.publish(c.quarantine, publishing(*d)); err != nil {
+		c.reportErr(err)
+		if !c.autoAck {
+			_ = d.Nack(false, true)
+		}
+		return true
+	}
+	c.requeues.forget(*d)
+	if !c.autoAck {
+		_ = d.Ack(false)
+	}
+	return true
+}
+
+// decode decompresses delivery body if its ContentEncoding is known.
+// Undecodable deliveries are reported and handled according to Undecodable
+// option, shipped as is without it
+func (c *Consumer) decode(side *sidePublisher, d *amqp.Delivery) bool {
+	codec, ok := c.decoders[d.ContentEncoding]
+	if !ok {
+		if c.decodeFn == nil || d.ContentEncoding == "" || d.ContentEncoding == "identity" {
+			return true
+		}
+		c.decodeFn(*d, UnknownEncoding{Encoding: d.ContentEncoding})
+		return false
+	}
+
+	body, err := codec.Decode(d.Body)
+	if err != nil {
+		err = fmt.Errorf("decode %s body: %v", d.ContentEncoding, err)
+		c.reportErr(err)
+		if c.decodeFn != nil {
+			c.decodeFn(*d, err)
+			return false
+		}
+		if !c.decodeFail {
+			return true
 		}
+		c.sideline(side, d, c.decodeQ, DecodeErrorHeader, err)
+		return false
+	}
+	d.Body = body
+	d.ContentEncoding = ""
+	return true
+}
+
+// unackedSet holds delivery tags not acked yet on a single channel
+type unackedSet struct {
+	m       sync.Mutex
+	tags    map[uint64]struct{}
+	revoked map[uint64]struct{} // requeued by ConsumerTimeout
+	closed  bool
+}
+
+func newUnackedSet() *unackedSet {
+	return &unackedSet{tags: make(map[uint64]struct{})}
+}
+
+func (s *unackedSet) add(tag uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.tags[tag] = struct{}{}
+}
+
+// has reports whether tag is not settled yet
+func (s *unackedSet) has(tag uint64) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.tags[tag]
+	return ok
+}
+
+// revoke settles tag on behalf of user, whose later settlement of it is
+// refused by requeued. Returns false if tag is settled already
+func (s *unackedSet) revoke(tag uint64) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.tags[tag]; !ok {
+		return false
+	}
+	delete(s.tags, tag)
+	if s.revoked == nil {
+		s.revoked = make(map[uint64]struct{})
+	}
+	s.revoked[tag] = struct{}{}
+	return true
+}
+
+// requeued reports whether tag was revoked, forgetting it
+func (s *unackedSet) requeued(tag uint64) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.revoked[tag]; !ok {
+		return false
+	}
+	delete(s.revoked, tag)
+	return true
+}
+
+// settle removes acked tags, returns their count
+func (s *unackedSet) settle(tag uint64, multiple bool) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closed {
+		return 0
+	}
+
+	if !multiple {
+		if _, ok := s.tags[tag]; !ok {
+			return 0
+		}
+		delete(s.tags, tag)
+		return 1
+	}
+
+	n := 0
+	for t := range s.tags {
+		if t <= tag || tag == 0 {
+			delete(s.tags, t)
+			n++
+		}
+	}
+	return n
+}
+
+// upto returns unacked tags up to tag in ascending order
+func (s *unackedSet) upto(tag uint64) []uint64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var tags []uint64
+	for t := range s.tags {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+// drain forgets all tags once channel is closed, returns their count
+func (s *unackedSet) drain() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n := len(s.tags)
+	s.tags = nil
+	s.revoked = nil
+	s.closed = true
+	return n
+}
+
+// statsAcknowledger counts acks of deliveries
+type statsAcknowledger struct {
+	amqp.Acknowledger
+	c       *Consumer
+	unacked *unackedSet
+}
+
+func (a statsAcknowledger) Ack(tag uint64, multiple bool) error {
+	if a.unacked.requeued(tag) {
+		return ErrDeliveryRequeued
+	}
+	err := a.Acknowledger.Ack(tag, multiple)
+	if err == nil {
+		n := a.unacked.settle(tag, multiple)
+		atomic.AddUint64(&a.c.stats.acked, uint64(n))
+		atomic.AddInt64(&a.c.stats.inFlight, -int64(n))
+	}
+	return err
+}
+
+func (a statsAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if a.unacked.requeued(tag) {
+		return ErrDeliveryRequeued
+	}
+	err := a.Acknowledger.Nack(tag, multiple, requeue)
+	if err == nil {
+		a.nacked(a.unacked.settle(tag, multiple), requeue)
+	}
+	return err
+}
+
+func (a statsAcknowledger) Reject(tag uint64, requeue bool) error {
+	if a.unacked.requeued(tag) {
+		return ErrDeliveryRequeued
+	}
+	err := a.Acknowledger.Reject(tag, requeue)
+	if err == nil {
+		a.nacked(a.unacked.settle(tag, false), requeue)
+	}
+	return err
+}
+
+func (a statsAcknowledger) nacked(n int, requeue bool) {
+	atomic.AddUint64(&a.c.stats.nacked, uint64(n))
+	atomic.AddInt64(&a.c.stats.inFlight, -int64(n))
+	if requeue {
+		atomic.AddUint64(&a.c.stats.requeued, uint64(n))
 	}
 }
 
@@ -104,13 +667,25 @@ func NewConsumer(q *Queue, opts ...ConsumerOpt) *Consumer {
 		deliveries: make(chan amqp.Delivery),
 		errs:       make(chan error, 100),
 		stop:       make(chan struct{}),
+		drain:      make(chan struct{}),
+		opts:       opts,
 	}
 	for _, o := range opts {
 		o(c)
 	}
+	if c.tag == "" {
+		c.tag = "ctag-" + newUUID()
+	}
 	return c
 }
 
+// Clone returns fresh Consumer of the same queue with the same options.
+// Cancelled consumer can't be used again, clone it and pass to
+// (*Client).Consume to resume consuming.
+func (c *Consumer) Clone() *Consumer {
+	return NewConsumer(c.q, c.opts...)
+}
+
 // Qos on channel
 func Qos(count int) ConsumerOpt {
 	return func(c *Consumer) {
@@ -155,3 +730,119 @@ func NoLocal() ConsumerOpt {
 		c.noLocal = true
 	}
 }
+
+// NoWait set this consumer to not wait for basic.consume-ok from broker,
+// consume errors are then reported by closing channel
+func NoWait() ConsumerOpt {
+	return func(c *Consumer) {
+		c.noWait = true
+	}
+}
+
+// ConsumeArgs set arbitrary basic.consume arguments, e.g. `x-priority` or
+// `x-cancel-on-ha-failover`. Arguments are merged with ones set by other
+// options.
+func ConsumeArgs(args amqp.Table) ConsumerOpt {
+	return func(c *Consumer) {
+		if c.args == nil {
+			c.args = amqp.Table{}
+		}
+		for k, v := range args {
+			c.args[k] = v
+		}
+	}
+}
+
+// ConsumerPriority set `x-priority` consume argument. Consumers with higher
+// priority receive deliveries first, lower priority ones only get messages
+// when high priority consumers are blocked.
+func ConsumerPriority(priority int32) ConsumerOpt {
+	return func(c *Consumer) {
+		if c.args == nil {
+			c.args = amqp.Table{}
+		}
+		c.args["x-priority"] = priority
+	}
+}
+
+// OnCancel set consumer's reaction on cancel notification from broker
+func OnCancel(policy CancelPolicy) ConsumerOpt {
+	return func(c *Consumer) {
+		c.onCancel = policy
+	}
+}
+
+// Decompression set codecs used to decompress deliveries with matching
+// ContentEncoding, pairs with Compression PublisherOpt
+func Decompression(codecs ...Codec) ConsumerOpt {
+	return func(c *Consumer) {
+		if c.decoders == nil {
+			c.decoders = make(map[string]Codec)
+		}
+		for _, codec := range codecs {
+			c.decoders[codec.Encoding()] = codec
+		}
+	}
+}
+
+// Undecodable set this consumer to move deliveries which fail to decompress
+// to queue with DecodeErrorHeader, instead of shipping them to Deliveries
+// with ContentEncoding and body untouched. With empty queue they are
+// rejected, so dead-lettered if queue has dead-letter-exchange or discarded
+// otherwise. queue should be declared by user.
+func Undecodable(queue string) ConsumerOpt {
+	return func(c *Consumer) {
+		c.decodeFail = true
+		c.decodeQ = queue
+	}
+}
+
+// OnUndecodable set this consumer to pass deliveries with ContentEncoding
+// there's no Decompression codec for, with UnknownEncoding error, or failing
+// to decompress to f instead of Deliveries, so handlers don't get encoded
+// bodies. Takes precedence over Undecodable. f is called by consumer
+// goroutine and should acknowledge delivery, e.g. reject it.
+func OnUndecodable(f func(d amqp.Delivery, err error)) ConsumerOpt {
+	return func(c *Consumer) {
+		c.decodeFn = f
+	}
+}
+
+// Reassemble set this consumer to collect chunks of messages published with
+// Chunking option and deliver them as single amqp.Delivery. Acknowledging
+// it acknowledges every chunk.
+//
+// All chunks should reach the same consumer, so it should be the only one on
+// the queue, see SingleActiveConsumer. Qos should be at least number of chunks
+// of one message, messages with more chunks are rejected. Sets not completed
+// within ChunkTTL are nacked without requeue and reported as ChunksExpired.
+func Reassemble() ConsumerOpt {
+	return func(c *Consumer) {
+		c.reassemble = true
+	}
+}
+
+// ChunkTTL set time Reassemble consumer waits for missing chunks of message,
+// one minute by default
+func ChunkTTL(ttl time.Duration) ConsumerOpt {
+	return func(c *Consumer) {
+		c.chunkTTL = ttl
+	}
+}
+
+// MaxDeliveryAttempts set this consumer to move messages delivered more than
+// n times to quarantineQueue, instead of shipping them to Deliveries, so
+// poison messages are not redelivered forever. Attempts are counted by
+// x-delivery-count of quorum queues, RetryCountHeader set by Republish and
+// x-death rejections from consumed queue. Requeues of classic queues, which
+// only mark deliveries as redelivered, are counted by consumer itself, so
+// they are undercounted with several consumers or after restart. Messages
+// are acked once quarantineQueue copy is confirmed by broker, and requeued if
+// it fails. quarantineQueue should be declared by user.
+func MaxDeliveryAttempts(n int, quarantineQueue string) ConsumerOpt {
+	return func(c *Consumer) {
+		c.maxAttempt = int64(n)
+		c.quarantine = quarantineQueue
+		c.requeues = newRequeueCounter()
+	}
+}
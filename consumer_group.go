@@ -0,0 +1,170 @@
+package cony
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ConsumerGroup manages consumers of a changing set of queues with the same
+// options, e.g. one per tenant queue, and merges their deliveries. Set of
+// queues could be synced with list fetched from management API:
+//
+//	qs, _ := mgmt.Queues(ctx, "/")
+//	var names []string
+//	for _, q := range qs {
+//		if strings.HasPrefix(q.Name, "tenant.") {
+//			names = append(names, q.Name)
+//		}
+//	}
+//	group.Sync(names)
+type ConsumerGroup struct {
+	client     *Client
+	opts       []ConsumerOpt
+	deliveries chan amqp.Delivery
+	errs       chan error
+	members    map[string]*groupMember
+	wg         sync.WaitGroup
+	dead       bool
+	m          sync.Mutex
+}
+
+type groupMember struct {
+	cons *Consumer
+	done chan struct{}
+}
+
+// NewConsumerGroup is a ConsumerGroup constructor, opts are applied to every
+// consumer of group
+func NewConsumerGroup(client *Client, opts ...ConsumerOpt) *ConsumerGroup {
+	return &ConsumerGroup{
+		client:     client,
+		opts:       opts,
+		deliveries: make(chan amqp.Delivery),
+		errs:       make(chan error, 100),
+		members:    make(map[string]*groupMember),
+	}
+}
+
+// Deliveries returns merged deliveries of all consumers of group. Channel is
+// closed after group is cancelled
+func (g *ConsumerGroup) Deliveries() <-chan amqp.Delivery {
+	return g.deliveries
+}
+
+// Errors returns merged errors of all consumers of group. Errors are dropped
+// in case if receiver can't keep up
+func (g *ConsumerGroup) Errors() <-chan error {
+	return g.errs
+}
+
+// Add starts consuming queue, it's no-op if queue is already consumed
+func (g *ConsumerGroup) Add(q *Queue) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if _, ok := g.members[q.Name]; ok || g.dead {
+		return
+	}
+
+	member := &groupMember{
+		cons: NewConsumer(q, g.opts...),
+		done: make(chan struct{}),
+	}
+	g.members[q.Name] = member
+	g.wg.Add(1)
+	go g.forward(member)
+	g.client.Consume(member.cons)
+}
+
+// Remove stops consuming queue. Deliveries of queue not received from
+// Deliveries() yet are redelivered by broker
+func (g *ConsumerGroup) Remove(name string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if member, ok := g.members[name]; ok {
+		delete(g.members, name)
+		g.stop(member)
+	}
+}
+
+// Sync consumes exactly queues with names, adding missing and removing
+// extra consumers
+func (g *ConsumerGroup) Sync(names []string) {
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+		g.Add(&Queue{Name: name})
+	}
+
+	for _, name := range g.Queues() {
+		if !want[name] {
+			g.Remove(name)
+		}
+	}
+}
+
+// Queues returns sorted names of consumed queues
+func (g *ConsumerGroup) Queues() []string {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	names := make([]string, 0, len(g.members))
+	for name := range g.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Cancel stops all consumers of group and closes Deliveries() channel
+func (g *ConsumerGroup) Cancel() {
+	g.m.Lock()
+	if g.dead {
+		g.m.Unlock()
+		return
+	}
+	g.dead = true
+	for name, member := range g.members {
+		delete(g.members, name)
+		g.stop(member)
+	}
+	g.m.Unlock()
+
+	g.wg.Wait()
+	close(g.deliveries)
+}
+
+// stop member consumer, should be called with lock held
+func (g *ConsumerGroup) stop(member *groupMember) {
+	close(member.done)
+	g.client.RemoveConsumer(member.cons)
+}
+
+// forward deliveries and errors of member consumer to group
+func (g *ConsumerGroup) forward(member *groupMember) {
+	defer g.wg.Done()
+
+	for {
+		select {
+		case <-member.done:
+			return
+		case err := <-member.cons.Errors():
+			select {
+			case g.errs <- err:
+			default:
+			}
+		case d, ok := <-member.cons.Deliveries():
+			if !ok {
+				return
+			}
+			select {
+			case g.deliveries <- d:
+			case <-member.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//go:build go1.23
+
+package cony
+
+import (
+	"context"
+	"iter"
+
+	"github.com/streadway/amqp"
+)
+
+// All returns iterator over deliveries of consumer, for use with range.
+// Iteration ends once consumer is cancelled or ctx is done, in the latter
+// case consumer is cancelled too. Breaking out of loop leaves consumer
+// running, so ranging over All could be resumed.
+func (c *Consumer) All(ctx context.Context) iter.Seq[amqp.Delivery] {
+	return func(yield func(amqp.Delivery) bool) {
+		for {
+			select {
+			case <-ctx.Done():
+				c.Cancel()
+				return
+			case d, ok := <-c.deliveries:
+				if !ok || !yield(d) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build go1.23
+
+package cony
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConsumer_All(t *testing.T) {
+	c := newTestConsumer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		c.deliveries <- amqp.Delivery{DeliveryTag: 1}
+		c.deliveries <- amqp.Delivery{DeliveryTag: 2}
+	}()
+
+	var tags []uint64
+	for d := range c.All(ctx) {
+		tags = append(tags, d.DeliveryTag)
+		if len(tags) == 2 {
+			cancel()
+		}
+	}
+
+	if len(tags) != 2 {
+		t.Error("should range over deliveries", tags)
+	}
+
+	select {
+	case <-c.stop:
+	default:
+		t.Error("consumer should be cancelled when context is done")
+	}
+}
@@ -52,18 +52,19 @@ func TestConsumer_Cancel(t *testing.T) {
 }
 
 func TestConsumer_Cancel_willNotBlock(t *testing.T) {
-	var ok bool
+	done := make(chan bool)
 	c := newTestConsumer()
 
 	go func() {
 		c.Cancel()
 		c.Cancel()
 		c.Cancel()
-		ok = true
+		done <- true
 	}()
 
-	time.Sleep(1 * time.Microsecond) // let goroutine to work
-	if !ok {
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
 		t.Error("shold not block")
 	}
 }
@@ -205,6 +206,38 @@ func TestConsumer_serve_Consume(t *testing.T) {
 	}
 }
 
+// sharedTestChannel implements Channel, methods missing from mqChannelTest
+// are promoted from nil Channel
+type sharedTestChannel struct {
+	*mqChannelTest
+	nilChannel
+}
+
+type nilChannel struct{ Channel }
+
+func TestConsumer_serve_sharedConsumeError(t *testing.T) {
+	var closed bool
+	ch := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return nil, errors.New("consume error")
+		},
+		_Close: func() error {
+			closed = true
+			return nil
+		},
+	}
+	v, _ := newSharedChannel(sharedTestChannel{mqChannelTest: ch}, nil).view()
+
+	c := newTestConsumer(SharedChannel())
+	c.serve(nil, v)
+	if !closed {
+		t.Error("should release shared channel once serve exits")
+	}
+}
+
 func TestConsumer_serve_for(t *testing.T) {
 	var (
 		runSync    = make(chan bool)
@@ -272,6 +305,233 @@ func TestConsumer_serve_for(t *testing.T) {
 	<-runSync
 }
 
+func TestConsumer_serve_cancel(t *testing.T) {
+	var (
+		runSync    = make(chan bool)
+		cancels    chan string
+		consumed   int
+		redeclared bool
+		deliveries = make(chan amqp.Delivery)
+	)
+
+	c := newTestConsumer()
+	cli := &mqDeleterTest{
+		_redeclare: func() {
+			redeclared = true
+		},
+	}
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_NotifyCancel: func(c chan string) chan string {
+			cancels = c
+			return c
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			consumed++
+			if consumed > 1 {
+				return nil, errors.New("consume error")
+			}
+			return deliveries, nil
+		},
+	}
+
+	go func() {
+		<-runSync
+		c.serve(cli, ch1)
+		runSync <- true
+	}()
+
+	runSync <- true
+	deliveries <- amqp.Delivery{Body: []byte("test1")}
+	<-c.Deliveries()
+	cancels <- "tag1"
+	err := <-c.Errors()
+	<-runSync
+
+	if cerr, ok := err.(ConsumerCancelled); !ok || cerr.Tag != "tag1" {
+		t.Error("should report ConsumerCancelled")
+	}
+
+	if !redeclared {
+		t.Error("should redeclare on cancel")
+	}
+
+	if consumed != 2 {
+		t.Error("should consume again after cancel")
+	}
+}
+
+func TestOnCancel(t *testing.T) {
+	c := newTestConsumer(OnCancel(CancelStop))
+
+	if c.onCancel != CancelStop {
+		t.Error("cancel policy should be set")
+	}
+
+	closed := false
+	ch := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_NotifyCancel: func(c chan string) chan string {
+			c <- "tag1"
+			return c
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return make(chan amqp.Delivery), nil
+		},
+		_Close: func() error {
+			closed = true
+			return nil
+		},
+	}
+
+	c.serve(&mqDeleterTest{}, ch)
+	if !closed {
+		t.Error("should close channel on CancelStop")
+	}
+}
+
+func TestConsumer_decode(t *testing.T) {
+	c := newTestConsumer(Decompression(Gzip, Zstd), AutoAck())
+	body, _ := Gzip.Encode([]byte("hello"))
+
+	d := amqp.Delivery{ContentEncoding: "gzip", Body: body}
+	if !c.decode(nil, &d) || string(d.Body) != "hello" || d.ContentEncoding != "" {
+		t.Error("should decompress gzip body")
+	}
+
+	body, _ = Zstd.Encode([]byte("hello"))
+	d = amqp.Delivery{ContentEncoding: "zstd", Body: body}
+	if !c.decode(nil, &d) || string(d.Body) != "hello" {
+		t.Error("should decompress zstd body")
+	}
+
+	d = amqp.Delivery{Body: []byte("plain")}
+	if !c.decode(nil, &d) || string(d.Body) != "plain" {
+		t.Error("should pass unencoded body")
+	}
+
+	d = amqp.Delivery{ContentEncoding: "gzip", Body: []byte("garbage")}
+	if !c.decode(nil, &d) || d.ContentEncoding != "gzip" {
+		t.Error("should ship undecodable delivery as is")
+	}
+
+	if err := <-c.Errors(); err == nil {
+		t.Error("should report decode error")
+	}
+}
+
+func TestOnUndecodable(t *testing.T) {
+	var (
+		got  []amqp.Delivery
+		errs []error
+	)
+	c := newTestConsumer(Decompression(Snappy), OnUndecodable(func(d amqp.Delivery, err error) {
+		got = append(got, d)
+		errs = append(errs, err)
+	}))
+
+	d := amqp.Delivery{ContentEncoding: "br", Body: []byte("encoded")}
+	if c.decode(nil, &d) || len(got) != 1 || errs[0] != (UnknownEncoding{Encoding: "br"}) {
+		t.Error("should pass delivery of unknown encoding to callback", errs)
+	}
+
+	d = amqp.Delivery{ContentEncoding: "snappy", Body: []byte{0xff, 0xff, 0xff}}
+	if c.decode(nil, &d) || len(got) != 2 || string(got[1].Body) != string([]byte{0xff, 0xff, 0xff}) {
+		t.Error("should pass delivery failing to decode to callback", errs)
+	}
+
+	body, _ := Snappy.Encode([]byte("hello"))
+	d = amqp.Delivery{ContentEncoding: "snappy", Body: body}
+	if !c.decode(nil, &d) || string(d.Body) != "hello" {
+		t.Error("should decompress snappy body")
+	}
+
+	d = amqp.Delivery{Body: []byte("plain")}
+	if !c.decode(nil, &d) || len(got) != 2 {
+		t.Error("should pass unencoded body")
+	}
+}
+
+func TestUndecodable(t *testing.T) {
+	var published amqp.Publishing
+	confirms := make(chan amqp.Confirmation, 1)
+	ack := true
+	side := &sidePublisher{
+		ch: &mqChannelTest{
+			_Publish: func(_, key string, _, _ bool, pub amqp.Publishing) error {
+				if key == "bad" {
+					published = pub
+				}
+				confirms <- amqp.Confirmation{Ack: ack}
+				return nil
+			},
+		},
+		confirms: confirms,
+	}
+	c := newTestConsumer(Decompression(Gzip), Undecodable("bad"))
+
+	acks := &testAcknowledger{}
+	d := amqp.Delivery{ContentEncoding: "gzip", Body: []byte("garbage"), Acknowledger: acks}
+	if c.decode(side, &d) {
+		t.Error("should not ship undecodable delivery")
+	}
+
+	if published.Headers[DecodeErrorHeader] == nil || len(acks.acked) != 1 {
+		t.Error("should move undecodable delivery to queue", published.Headers)
+	}
+
+	ack = false
+	acks = &testAcknowledger{}
+	d = amqp.Delivery{ContentEncoding: "gzip", Body: []byte("garbage"), Acknowledger: acks}
+	c.decode(side, &d)
+	if len(acks.acked) != 0 || len(acks.nacked) != 1 {
+		t.Error("should requeue delivery when its copy is nacked")
+	}
+}
+
+func TestConsumer_Stats(t *testing.T) {
+	c := newTestConsumer()
+	unacked := newUnackedSet()
+	ack := &testAcknowledger{}
+
+	ds := make([]amqp.Delivery, 4)
+	for i := range ds {
+		ds[i] = amqp.Delivery{DeliveryTag: uint64(i + 1), Acknowledger: ack}
+		c.track(&ds[i], unacked)
+	}
+
+	ds[1].Ack(true)
+	ds[2].Nack(false, true)
+
+	stats := c.Stats()
+	if stats.Delivered != 4 || stats.LastDelivery.IsZero() {
+		t.Error("should count deliveries", stats)
+	}
+
+	if stats.Acked != 2 {
+		t.Error("should count multiple acks", stats)
+	}
+
+	if stats.Nacked != 1 || stats.Requeued != 1 {
+		t.Error("should count nacks", stats)
+	}
+
+	if stats.InFlight != 1 {
+		t.Error("should have one delivery in flight", stats)
+	}
+
+	unacked.drain()
+	ds[3].Ack(false)
+	if c.Stats().Acked != 2 {
+		t.Error("should not count acks after channel is closed")
+	}
+}
+
 func TestExclusive(t *testing.T) {
 	c := newTestConsumer(Exclusive())
 
@@ -316,7 +576,72 @@ func TestTag(t *testing.T) {
 	}
 }
 
+func TestConsumerPriority(t *testing.T) {
+	var args amqp.Table
+
+	c := newTestConsumer(ConsumerPriority(5))
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(name string, tag string, autoAck bool, exclusive bool, noLocal bool, noWait bool, a amqp.Table) (<-chan amqp.Delivery, error) {
+			args = a
+			return nil, errors.New("stop")
+		},
+	}
+
+	c.serve(nil, ch1)
+
+	if args["x-priority"] != int32(5) {
+		t.Error("consume args should have x-priority set to 5")
+	}
+}
+
 func newTestConsumer(opts ...ConsumerOpt) *Consumer {
 	q := &Queue{}
 	return NewConsumer(q, opts...)
 }
+
+func TestConsumer_Tag(t *testing.T) {
+	if newTestConsumer().Tag() == "" {
+		t.Error("tag should be generated")
+	}
+
+	if newTestConsumer().Tag() == newTestConsumer().Tag() {
+		t.Error("generated tags should be unique")
+	}
+
+	if tag := newTestConsumer(Tag("hello")).Tag(); tag != "hello" {
+		t.Error("tag should be `hello`", tag)
+	}
+}
+
+func TestConsumeArgs(t *testing.T) {
+	var (
+		args   amqp.Table
+		noWait bool
+	)
+
+	c := newTestConsumer(ConsumerPriority(5), NoWait(), ConsumeArgs(amqp.Table{"x-cancel-on-ha-failover": true}))
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(name string, tag string, autoAck bool, exclusive bool, noLocal bool, nw bool, a amqp.Table) (<-chan amqp.Delivery, error) {
+			args, noWait = a, nw
+			return nil, errors.New("stop")
+		},
+	}
+
+	c.serve(nil, ch1)
+
+	if args["x-priority"] != int32(5) || args["x-cancel-on-ha-failover"] != true {
+		t.Error("consume args should be merged", args)
+	}
+
+	if !noWait {
+		t.Error("consume should not wait")
+	}
+}
@@ -17,7 +17,18 @@ type Queue struct {
 	Exclusive  bool
 	Args       amqp.Table
 
-	l sync.Mutex
+	declared func(name string) // called after every declaration
+	unnamed  bool              // server-named, Name is assigned by broker
+	l        sync.Mutex
+}
+
+// CurrentName returns name of queue, for server-named queue it's the one
+// assigned by last declaration or empty until queue is declared. Unlike
+// reading Name it's safe while declarations run on reconnect
+func (q *Queue) CurrentName() string {
+	q.l.Lock()
+	defer q.l.Unlock()
+	return q.Name
 }
 
 // Exchange hold definition of AMQP exchange
@@ -41,15 +52,23 @@ type owner interface {
 	deletePublisher(*Publisher)
 	deleteConsumer(*Consumer)
 	reportErr(error) bool
+	redeclare()
+	sideChannel() (mqChannel, error)
 }
 
 type mqChannel interface {
 	Close() error
 	Consume(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(string, bool) error
 	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	NotifyCancel(chan string) chan string
 	Publish(string, string, bool, bool, amqp.Publishing) error
 	Qos(int, int, bool) error
 	Confirm(bool) error
 	NotifyReturn(chan amqp.Return) chan amqp.Return
 	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyFlow(chan bool) chan bool
+	Tx() error
+	TxCommit() error
+	TxRollback() error
 }
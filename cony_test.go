@@ -5,6 +5,9 @@ import "github.com/streadway/amqp"
 type mqDeleterTest struct {
 	_deletePublisher func(*Publisher)
 	_deleteConsumer  func(*Consumer)
+	_reportErr       func(error) bool
+	_redeclare       func()
+	_sideChannel     func() (mqChannel, error)
 }
 
 func (m *mqDeleterTest) deletePublisher(p *Publisher) {
@@ -15,12 +18,41 @@ func (m *mqDeleterTest) deleteConsumer(c *Consumer) {
 	m._deleteConsumer(c)
 }
 
+func (m *mqDeleterTest) reportErr(err error) bool {
+	if m._reportErr == nil {
+		return err != nil
+	}
+	return m._reportErr(err)
+}
+
+func (m *mqDeleterTest) redeclare() {
+	if m._redeclare != nil {
+		m._redeclare()
+	}
+}
+
+func (m *mqDeleterTest) sideChannel() (mqChannel, error) {
+	if m._sideChannel == nil {
+		return nil, ErrNoConnection
+	}
+	return m._sideChannel()
+}
+
 type mqChannelTest struct {
-	_Close       func() error
-	_Consume     func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error)
-	_NotifyClose func(chan *amqp.Error) chan *amqp.Error
-	_Publish     func(string, string, bool, bool, amqp.Publishing) error
-	_Qos         func(int, int, bool) error
+	_Close         func() error
+	_Consume       func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error)
+	_NotifyClose   func(chan *amqp.Error) chan *amqp.Error
+	_NotifyCancel  func(chan string) chan string
+	_Publish       func(string, string, bool, bool, amqp.Publishing) error
+	_Qos           func(int, int, bool) error
+	_Confirm       func(bool) error
+	_NotifyReturn  func(chan amqp.Return) chan amqp.Return
+	_NotifyPublish func(chan amqp.Confirmation) chan amqp.Confirmation
+	_NotifyFlow    func(chan bool) chan bool
+	_Cancel        func(string, bool) error
+	_Tx            func() error
+	_TxCommit      func() error
+	_TxRollback    func() error
 }
 
 func (m *mqChannelTest) Close() error {
@@ -32,9 +64,19 @@ func (m *mqChannelTest) Consume(name string, tag string, autoAck bool, exclusive
 }
 
 func (m *mqChannelTest) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	if m._NotifyClose == nil {
+		return c
+	}
 	return m._NotifyClose(c)
 }
 
+func (m *mqChannelTest) NotifyCancel(c chan string) chan string {
+	if m._NotifyCancel == nil {
+		return c
+	}
+	return m._NotifyCancel(c)
+}
+
 func (m *mqChannelTest) Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
 	return m._Publish(exchange, key, mandatory, immediate, msg)
 }
@@ -42,3 +84,56 @@ func (m *mqChannelTest) Publish(exchange string, key string, mandatory bool, imm
 func (m *mqChannelTest) Qos(prefetchCount int, prefetchSize int, global bool) error {
 	return m._Qos(prefetchCount, prefetchSize, global)
 }
+
+func (m *mqChannelTest) Confirm(noWait bool) error {
+	return m._Confirm(noWait)
+}
+
+func (m *mqChannelTest) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	if m._NotifyReturn == nil {
+		return c
+	}
+	return m._NotifyReturn(c)
+}
+
+func (m *mqChannelTest) Cancel(tag string, noWait bool) error {
+	if m._Cancel == nil {
+		return nil
+	}
+	return m._Cancel(tag, noWait)
+}
+
+func (m *mqChannelTest) NotifyFlow(c chan bool) chan bool {
+	if m._NotifyFlow == nil {
+		return c
+	}
+	return m._NotifyFlow(c)
+}
+
+func (m *mqChannelTest) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	if m._NotifyPublish == nil {
+		return c
+	}
+	return m._NotifyPublish(c)
+}
+
+func (m *mqChannelTest) Tx() error {
+	if m._Tx == nil {
+		return nil
+	}
+	return m._Tx()
+}
+
+func (m *mqChannelTest) TxCommit() error {
+	if m._TxCommit == nil {
+		return nil
+	}
+	return m._TxCommit()
+}
+
+func (m *mqChannelTest) TxRollback() error {
+	if m._TxRollback == nil {
+		return nil
+	}
+	return m._TxRollback()
+}
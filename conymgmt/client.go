@@ -0,0 +1,282 @@
+// Package conymgmt is a client for RabbitMQ management HTTP API, for operator
+// tooling next to cony. It answers questions plain AMQP can't, like queue depth
+// on particular node, node health, policies and shovels status.
+//
+//	mgmt := conymgmt.NewClient("https://rabbit:15671",
+//		conymgmt.AMQPURL(amqpURL),     // same credentials as cony.URL
+//		conymgmt.TLSConfig(tlsConfig), // same as amqp.Config.TLSClientConfig
+//	)
+//	q, err := mgmt.Queue(ctx, "/", "orders")
+package conymgmt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/integration-system/cony"
+	"github.com/streadway/amqp"
+)
+
+// Option is a Client's functional option type
+type Option func(*Client)
+
+// Client is a RabbitMQ management HTTP API client
+type Client struct {
+	endpoint string
+	user     string
+	pass     string
+	http     *http.Client
+}
+
+// APIError is returned when management API responds with non 2xx status
+type APIError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("management API error %d: %s", e.StatusCode, e.Reason)
+}
+
+// Queue holds queue state
+type Queue struct {
+	Name                   string     `json:"name"`
+	Vhost                  string     `json:"vhost"`
+	Node                   string     `json:"node"`
+	State                  string     `json:"state"`
+	Durable                bool       `json:"durable"`
+	AutoDelete             bool       `json:"auto_delete"`
+	Exclusive              bool       `json:"exclusive"`
+	Arguments              amqp.Table `json:"arguments"`
+	Messages               int        `json:"messages"`
+	MessagesReady          int        `json:"messages_ready"`
+	MessagesUnacknowledged int        `json:"messages_unacknowledged"`
+	Consumers              int        `json:"consumers"`
+}
+
+// Exchange holds exchange definition
+type Exchange struct {
+	Name       string     `json:"name"`
+	Vhost      string     `json:"vhost"`
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Internal   bool       `json:"internal"`
+	Arguments  amqp.Table `json:"arguments"`
+}
+
+// Node holds cluster node state
+type Node struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Running       bool   `json:"running"`
+	MemAlarm      bool   `json:"mem_alarm"`
+	DiskFreeAlarm bool   `json:"disk_free_alarm"`
+	MemUsed       int64  `json:"mem_used"`
+	MemLimit      int64  `json:"mem_limit"`
+	DiskFree      int64  `json:"disk_free"`
+	DiskFreeLimit int64  `json:"disk_free_limit"`
+}
+
+// Healthy reports whether node is running without resource alarms
+func (n Node) Healthy() bool {
+	return n.Running && !n.MemAlarm && !n.DiskFreeAlarm
+}
+
+// Policy holds policy definition
+type Policy struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Pattern    string                 `json:"pattern"`
+	ApplyTo    string                 `json:"apply-to"`
+	Definition map[string]interface{} `json:"definition"`
+	Priority   int                    `json:"priority"`
+}
+
+// Shovel holds dynamic or static shovel status
+type Shovel struct {
+	Name  string `json:"name"`
+	Vhost string `json:"vhost"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	Node  string `json:"node"`
+}
+
+// NewClient is a Client constructor. Endpoint is a management API base URL,
+// like http://localhost:15672
+func NewClient(endpoint string, opts ...Option) *Client {
+	c := &Client{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		user:     "guest",
+		pass:     "guest",
+		http:     &http.Client{},
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Credentials is a functional option, used to set management API user
+func Credentials(user, pass string) Option {
+	return func(c *Client) {
+		c.user = user
+		c.pass = pass
+	}
+}
+
+// AMQPURL is a functional option, used to take credentials from AMQP URL, the
+// one passed to cony.URL. Invalid URLs are ignored
+func AMQPURL(addr string) Option {
+	return func(c *Client) {
+		if uri, err := amqp.ParseURI(addr); err == nil {
+			c.user = uri.Username
+			c.pass = uri.Password
+		}
+	}
+}
+
+// TLSConfig is a functional option, used to share TLS configuration with
+// amqp.Config
+func TLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.http = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+		}
+	}
+}
+
+// HTTPClient is a functional option, used to replace default http.Client
+func HTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.http = h
+	}
+}
+
+// Queue returns state of queue in vhost
+func (c *Client) Queue(ctx context.Context, vhost, name string) (Queue, error) {
+	var q Queue
+	err := c.get(ctx, &q, "queues", vhost, name)
+	return q, err
+}
+
+// Queues returns state of all queues in vhost
+func (c *Client) Queues(ctx context.Context, vhost string) ([]Queue, error) {
+	var qs []Queue
+	err := c.get(ctx, &qs, "queues", vhost)
+	return qs, err
+}
+
+// Exchange returns definition of exchange in vhost
+func (c *Client) Exchange(ctx context.Context, vhost, name string) (Exchange, error) {
+	var e Exchange
+	err := c.get(ctx, &e, "exchanges", vhost, name)
+	return e, err
+}
+
+// Inspector returns cony.Inspector of queues and exchanges in vhost, for
+// cony.Inspect option of SyncTopology
+func (c *Client) Inspector(ctx context.Context, vhost string) cony.Inspector {
+	return inspector{c: c, ctx: ctx, vhost: vhost}
+}
+
+type inspector struct {
+	c     *Client
+	ctx   context.Context
+	vhost string
+}
+
+func (i inspector) Inspect(kind, name string) (cony.Properties, bool, error) {
+	var (
+		props cony.Properties
+		err   error
+	)
+	if kind == "queue" {
+		var q Queue
+		q, err = i.c.Queue(i.ctx, i.vhost, name)
+		props = cony.Properties{Durable: q.Durable, AutoDelete: q.AutoDelete, Exclusive: q.Exclusive, Args: q.Arguments}
+	} else {
+		var e Exchange
+		e, err = i.c.Exchange(i.ctx, i.vhost, name)
+		props = cony.Properties{Kind: e.Type, Durable: e.Durable, AutoDelete: e.AutoDelete, Args: e.Arguments}
+	}
+
+	if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusNotFound {
+		return props, false, nil
+	}
+	return props, err == nil, err
+}
+
+// Node returns state of cluster node
+func (c *Client) Node(ctx context.Context, name string) (Node, error) {
+	var n Node
+	err := c.get(ctx, &n, "nodes", name)
+	return n, err
+}
+
+// Nodes returns state of all cluster nodes
+func (c *Client) Nodes(ctx context.Context) ([]Node, error) {
+	var ns []Node
+	err := c.get(ctx, &ns, "nodes")
+	return ns, err
+}
+
+// Policies returns policies defined in vhost
+func (c *Client) Policies(ctx context.Context, vhost string) ([]Policy, error) {
+	var ps []Policy
+	err := c.get(ctx, &ps, "policies", vhost)
+	return ps, err
+}
+
+// Shovels returns status of shovels in vhost
+func (c *Client) Shovels(ctx context.Context, vhost string) ([]Shovel, error) {
+	var ss []Shovel
+	err := c.get(ctx, &ss, "shovels", vhost)
+	return ss, err
+}
+
+func (c *Client) get(ctx context.Context, v interface{}, path ...string) error {
+	segments := make([]string, len(path))
+	for i, p := range path {
+		segments[i] = url.PathEscape(p)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+"/api/"+strings.Join(segments, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(c.user, c.pass)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Reason: resp.Status}
+		var reply struct {
+			Reason string `json:"reason"`
+		}
+		if json.Unmarshal(body, &reply) == nil && reply.Reason != "" {
+			apiErr.Reason = reply.Reason
+		}
+		return apiErr
+	}
+
+	return json.Unmarshal(body, v)
+}
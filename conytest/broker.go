@@ -0,0 +1,454 @@
+// Package conytest provides in-memory AMQP broker for unit testing code built
+// on cony, without running real RabbitMQ.
+//
+//	broker := conytest.NewBroker()
+//	client := cony.NewClient(cony.Dial(broker.Dial))
+//
+// Broker keeps declared topology, routes published messages to bound queues,
+// delivers them to consumers, sends confirms and returns, and allows to inject
+// connection failures.
+package conytest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/integration-system/cony"
+	"github.com/streadway/amqp"
+)
+
+// Broker is an in-memory AMQP broker. Zero value is not usable, use NewBroker
+type Broker struct {
+	m         sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	conns     map[*connection]struct{}
+	dialErr   error
+	changed   chan struct{}
+	seq       int
+}
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	args       amqp.Table
+	bindings   []binding
+}
+
+type binding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	owner      *connection
+	msgs       []message
+	consumers  map[string]*consumer
+}
+
+// enqueue message, messages of priority queue are kept ordered by priority
+func (q *queue) enqueue(msg message) {
+	max, ok := q.args["x-max-priority"]
+	if !ok {
+		q.msgs = append(q.msgs, msg)
+		return
+	}
+
+	priority := clampPriority(msg.pub.Priority, max)
+	i := len(q.msgs)
+	for i > 0 && clampPriority(q.msgs[i-1].pub.Priority, max) < priority {
+		i--
+	}
+	q.msgs = append(q.msgs, message{})
+	copy(q.msgs[i+1:], q.msgs[i:])
+	q.msgs[i] = msg
+}
+
+func clampPriority(priority uint8, max interface{}) uint8 {
+	if n, err := strconv.Atoi(fmt.Sprint(max)); err == nil && int(priority) > n {
+		return uint8(n)
+	}
+	return priority
+}
+
+type message struct {
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+}
+
+// NewBroker initializes Broker with default exchanges, like "" and amq.topic
+func NewBroker() *Broker {
+	b := &Broker{
+		exchanges: make(map[string]*exchange),
+		queues:    make(map[string]*queue),
+		conns:     make(map[*connection]struct{}),
+		changed:   make(chan struct{}),
+	}
+
+	for name, kind := range map[string]string{
+		"":            amqp.ExchangeDirect,
+		"amq.direct":  amqp.ExchangeDirect,
+		"amq.fanout":  amqp.ExchangeFanout,
+		"amq.topic":   amqp.ExchangeTopic,
+		"amq.headers": amqp.ExchangeHeaders,
+		"amq.match":   amqp.ExchangeHeaders,
+	} {
+		b.exchanges[name] = &exchange{name: name, kind: kind, durable: true}
+	}
+
+	return b
+}
+
+// Dial implements cony.DialFunc, use it with cony.Dial option
+func (b *Broker) Dial(url string, config amqp.Config) (cony.Connection, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.dialErr != nil {
+		return nil, b.dialErr
+	}
+
+	c := &connection{
+		b:     b,
+		chans: make(map[*channel]struct{}),
+		d:     newDispatcher(),
+	}
+	b.conns[c] = struct{}{}
+	return c, nil
+}
+
+// FailDial makes subsequent dials fail with err, nil error restores dialing
+func (b *Broker) FailDial(err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.dialErr = err
+}
+
+// DropConnections closes all connections with err, imitating network failure
+// or broker restart. Unacknowledged messages are requeued.
+func (b *Broker) DropConnections(err *amqp.Error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for c := range b.conns {
+		c.shutdown(err)
+	}
+}
+
+// Block sends connection.blocked notification with reason to all connections
+func (b *Broker) Block(reason string) {
+	b.notifyBlocked(amqp.Blocking{Active: true, Reason: reason})
+}
+
+// Unblock sends connection.unblocked notification to all connections
+func (b *Broker) Unblock() {
+	b.notifyBlocked(amqp.Blocking{})
+}
+
+func (b *Broker) notifyBlocked(blocking amqp.Blocking) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for c := range b.conns {
+		for _, l := range c.blocks {
+			l := l
+			c.d.do(func() { l <- blocking })
+		}
+	}
+}
+
+// Flow sends channel.flow request with active to all channels
+func (b *Broker) Flow(active bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for c := range b.conns {
+		for ch := range c.chans {
+			for _, l := range ch.flows {
+				l := l
+				c.d.do(func() { l <- active })
+			}
+		}
+	}
+}
+
+// Publish routes message, like it was published by a client. Returns false if
+// message was not routed to any queue
+func (b *Broker) Publish(exchange, key string, pub amqp.Publishing) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	routed, _ := b.route(exchange, key, pub)
+	return routed
+}
+
+// Messages returns copy of messages ready for delivery in queue
+func (b *Broker) Messages(name string) []amqp.Delivery {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return nil
+	}
+
+	ds := make([]amqp.Delivery, 0, len(q.msgs))
+	for _, msg := range q.msgs {
+		ds = append(ds, msg.delivery(nil, 0, ""))
+	}
+	return ds
+}
+
+// HasQueue reports whether queue is declared
+func (b *Broker) HasQueue(name string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	_, ok := b.queues[name]
+	return ok
+}
+
+// HasExchange reports whether exchange is declared
+func (b *Broker) HasExchange(name string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	_, ok := b.exchanges[name]
+	return ok
+}
+
+// Inspect implements cony.Inspector, so SyncTopology could compare topology
+// with the one of broker
+func (b *Broker) Inspect(kind, name string) (cony.Properties, bool, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if kind == "queue" {
+		q, ok := b.queues[name]
+		if !ok {
+			return cony.Properties{}, false, nil
+		}
+		return cony.Properties{Durable: q.durable, AutoDelete: q.autoDelete, Exclusive: q.exclusive, Args: q.args}, true, nil
+	}
+
+	ex, ok := b.exchanges[name]
+	if !ok {
+		return cony.Properties{}, false, nil
+	}
+	return cony.Properties{Kind: ex.kind, Durable: ex.durable, AutoDelete: ex.autoDelete, Args: ex.args}, true, nil
+}
+
+// HasBinding reports whether queue is bound to exchange with key
+func (b *Broker) HasBinding(queue, exchange, key string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return false
+	}
+	for _, bind := range ex.bindings {
+		if bind.queue == queue && bind.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Connections returns number of open connections
+func (b *Broker) Connections() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.conns)
+}
+
+// Channels returns number of open channels of all connections
+func (b *Broker) Channels() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	n := 0
+	for c := range b.conns {
+		n += len(c.chans)
+	}
+	return n
+}
+
+// Consumers returns number of consumers of queue
+func (b *Broker) Consumers(name string) int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if q, ok := b.queues[name]; ok {
+		return len(q.consumers)
+	}
+	return 0
+}
+
+// DeleteQueue deletes queue like it was deleted by operator, consumers of the
+// queue receive cancel notification
+func (b *Broker) DeleteQueue(name string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.deleteQueue(name)
+}
+
+func (b *Broker) deleteQueue(name string) int {
+	q, ok := b.queues[name]
+	if !ok {
+		return 0
+	}
+
+	for _, cons := range q.consumers {
+		cons.cancel(true)
+	}
+	delete(b.queues, name)
+
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, bind := range ex.bindings {
+			if bind.queue != name {
+				bindings = append(bindings, bind)
+			}
+		}
+		ex.bindings = bindings
+	}
+
+	b.signal()
+	return len(q.msgs)
+}
+
+// route message to queues, should be called with lock held
+func (b *Broker) route(exchangeName, key string, pub amqp.Publishing) (bool, error) {
+	ex, ok := b.exchanges[exchangeName]
+	if !ok {
+		return false, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchangeName),
+		}
+	}
+
+	var names []string
+	if exchangeName == "" {
+		names = []string{key}
+	} else {
+		for _, bind := range ex.bindings {
+			if matches(ex.kind, bind, key, pub.Headers) {
+				names = append(names, bind.queue)
+			}
+		}
+	}
+
+	routed := false
+	seen := make(map[string]bool)
+	for _, name := range names {
+		q, ok := b.queues[name]
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		q.enqueue(message{exchange: exchangeName, key: key, pub: pub})
+		routed = true
+	}
+
+	if routed {
+		b.signal()
+	}
+	return routed, nil
+}
+
+// signal wakes up consumers waiting for state change, should be called with
+// lock held
+func (b *Broker) signal() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func matches(kind string, bind binding, key string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return matchTopic(strings.Split(bind.key, "."), strings.Split(key, "."))
+	case amqp.ExchangeHeaders:
+		return matchHeaders(bind.args, headers)
+	default:
+		return bind.key == key
+	}
+}
+
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+	}
+}
+
+func matchHeaders(args, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+	matched, total := 0, 0
+
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		total++
+		if hv, ok := headers[k]; ok && fmt.Sprint(hv) == fmt.Sprint(v) {
+			matched++
+		}
+	}
+
+	if matchAny {
+		return matched > 0
+	}
+	return matched == total
+}
+
+func (msg message) delivery(ack amqp.Acknowledger, tag uint64, consumerTag string) amqp.Delivery {
+	pub := msg.pub
+	return amqp.Delivery{
+		Acknowledger:    ack,
+		Headers:         pub.Headers,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          pub.UserId,
+		AppId:           pub.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.key,
+		Body:            pub.Body,
+	}
+}
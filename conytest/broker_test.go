@@ -0,0 +1,258 @@
+package conytest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/integration-system/cony"
+	"github.com/streadway/amqp"
+)
+
+var (
+	_ cony.Connection   = (*connection)(nil)
+	_ cony.Channel      = (*channel)(nil)
+	_ amqp.Acknowledger = (*channel)(nil)
+)
+
+func TestMatchTopic(t *testing.T) {
+	tab := []struct {
+		pattern, key string
+		ok           bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#.c", "a.b.c", true},
+		{"*.b.#", "a.b", true},
+		{"a.b", "a.c", false},
+	}
+
+	for _, spec := range tab {
+		b := binding{key: spec.pattern}
+		if matches(amqp.ExchangeTopic, b, spec.key, nil) != spec.ok {
+			t.Errorf("pattern %s and key %s match should be %t", spec.pattern, spec.key, spec.ok)
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	all := amqp.Table{"a": "1", "b": "2"}
+	any := amqp.Table{"x-match": "any", "a": "1", "b": "2"}
+
+	if !matchHeaders(all, amqp.Table{"a": "1", "b": "2", "c": "3"}) {
+		t.Error("all headers should match")
+	}
+
+	if matchHeaders(all, amqp.Table{"a": "1"}) {
+		t.Error("should require all headers")
+	}
+
+	if !matchHeaders(any, amqp.Table{"b": "2"}) {
+		t.Error("any header should match")
+	}
+}
+
+func TestBroker_client(t *testing.T) {
+	b := NewBroker()
+	client := cony.NewClient(cony.Dial(b.Dial))
+	defer client.Close()
+
+	q := &cony.Queue{Name: "q1"}
+	ex := cony.Exchange{Name: "ex1", Kind: amqp.ExchangeTopic}
+	client.Declare([]cony.Declaration{
+		cony.DeclareQueue(q),
+		cony.DeclareExchange(ex),
+		cony.DeclareBinding(cony.Binding{Queue: q, Exchange: ex, Key: "a.#"}),
+	})
+
+	cons := cony.NewConsumer(q)
+	pub := cony.NewPublisher(ex.Name, "a.b")
+	client.Consume(cons)
+	client.Publish(pub)
+	loop(t, client)
+
+	waitFor(t, func() bool { return b.Consumers("q1") == 1 })
+
+	if !b.HasBinding("q1", "ex1", "a.#") {
+		t.Error("should declare binding")
+	}
+
+	publish(t, pub, "hello")
+
+	d := receive(t, cons)
+	if string(d.Body) != "hello" || d.RoutingKey != "a.b" {
+		t.Error("should deliver published message")
+	}
+
+	// connection failure requeues unacknowledged message
+	b.DropConnections(&amqp.Error{Code: amqp.ConnectionForced, Reason: "test"})
+
+	d = receive(t, cons)
+	if string(d.Body) != "hello" || !d.Redelivered {
+		t.Error("should redeliver message after reconnect")
+	}
+
+	if err := d.Ack(false); err != nil {
+		t.Error("should ack delivery", err)
+	}
+
+	if len(b.Messages("q1")) != 0 {
+		t.Error("queue should be empty")
+	}
+}
+
+func TestBroker_confirms(t *testing.T) {
+	b := NewBroker()
+	client := cony.NewClient(cony.Dial(b.Dial))
+	defer client.Close()
+
+	q := &cony.Queue{Name: "q1"}
+	client.Declare([]cony.Declaration{cony.DeclareQueue(q)})
+
+	confirms := make(chan amqp.Confirmation, 10)
+	pub := cony.NewPublisher("", "q1", cony.WithConfirmation(confirms))
+	client.Publish(pub)
+	loop(t, client)
+
+	publish(t, pub, "hello")
+
+	select {
+	case c := <-confirms:
+		if !c.Ack || c.DeliveryTag != 1 {
+			t.Error("should confirm publishing")
+		}
+	case <-time.After(time.Second):
+		t.Error("should receive confirmation")
+	}
+
+	if len(b.Messages("q1")) != 1 {
+		t.Error("should route message to queue")
+	}
+}
+
+func TestBroker_mandatory(t *testing.T) {
+	b := NewBroker()
+	conn, _ := b.Dial("", amqp.Config{})
+	ch, _ := conn.Channel()
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	if err := ch.Publish("", "nowhere", true, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+		t.Fatal("publish should succeed", err)
+	}
+
+	select {
+	case ret := <-returns:
+		if ret.ReplyCode != amqp.NoRoute {
+			t.Error("should return unroutable message")
+		}
+	case <-time.After(time.Second):
+		t.Error("should receive return")
+	}
+}
+
+func TestBroker_channelErrors(t *testing.T) {
+	b := NewBroker()
+	conn, _ := b.Dial("", amqp.Config{})
+	ch, _ := conn.Channel()
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	if _, err := ch.QueueDeclare("q1", true, false, false, false, nil); err != nil {
+		t.Fatal("should declare queue", err)
+	}
+
+	if _, err := ch.QueueDeclare("q1", false, false, false, false, nil); err == nil {
+		t.Error("should fail on inequivalent declaration")
+	}
+
+	if err := <-closes; err == nil || err.Code != amqp.PreconditionFailed {
+		t.Error("should close channel with precondition failed")
+	}
+
+	if _, err := ch.QueueDeclare("q2", false, false, false, false, nil); err != amqp.ErrClosed {
+		t.Error("channel should be closed")
+	}
+}
+
+func TestBroker_inequivalentArgs(t *testing.T) {
+	b := NewBroker()
+	conn, _ := b.Dial("", amqp.Config{})
+	ch, _ := conn.Channel()
+
+	ch.QueueDeclare("q1", true, false, false, false, amqp.Table{"x-max-priority": int32(10)})
+	if _, err := ch.QueueDeclare("q1", true, false, false, false, amqp.Table{"x-max-priority": int64(10)}); err != nil {
+		t.Error("integer arguments should be equivalent", err)
+	}
+
+	_, err := ch.QueueDeclare("q1", true, false, false, false, nil)
+	if err == nil || !strings.Contains(err.Error(), "inequivalent arg 'x-max-priority' for queue 'q1' in vhost '/': received none but current is '10'") {
+		t.Error("should fail on inequivalent arguments", err)
+	}
+
+	ch, _ = conn.Channel()
+	ch.ExchangeDeclare("ex1", amqp.ExchangeTopic, true, false, false, false, nil)
+	err = ch.ExchangeDeclare("ex1", amqp.ExchangeTopic, true, false, false, false, amqp.Table{"alternate-exchange": "ae"})
+	if err == nil || !strings.Contains(err.Error(), "'alternate-exchange'") {
+		t.Error("should compare exchange arguments", err)
+	}
+
+	props, found, _ := b.Inspect("queue", "q1")
+	if !found || !props.Durable || props.Args["x-max-priority"] != int32(10) {
+		t.Error("should inspect queue", props)
+	}
+}
+
+func TestBroker_FailDial(t *testing.T) {
+	b := NewBroker()
+	b.FailDial(amqp.ErrCredentials)
+
+	if _, err := b.Dial("", amqp.Config{}); err != amqp.ErrCredentials {
+		t.Error("should fail dial")
+	}
+
+	b.FailDial(nil)
+	if _, err := b.Dial("", amqp.Config{}); err != nil {
+		t.Error("should restore dial")
+	}
+}
+
+func loop(t *testing.T, client *cony.Client) {
+	go func() {
+		for client.Loop() {
+			select {
+			case err := <-client.Errors():
+				t.Log("client error: ", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+}
+
+// publish retries until publisher gets channel
+func publish(t *testing.T, pub *cony.Publisher, body string) {
+	waitFor(t, func() bool {
+		return pub.Publish(amqp.Publishing{Body: []byte(body)}) == nil
+	})
+}
+
+func receive(t *testing.T, cons *cony.Consumer) amqp.Delivery {
+	select {
+	case d := <-cons.Deliveries():
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("delivery timeout")
+	}
+	return amqp.Delivery{}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition timeout")
+}
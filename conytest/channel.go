@@ -0,0 +1,850 @@
+package conytest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// channel implements cony.Channel and amqp.Acknowledger for its deliveries.
+// All state is guarded by broker lock
+type channel struct {
+	conn       *connection
+	closed     bool
+	confirm    bool
+	tx         bool
+	txPending  []publishing
+	prefetch   int
+	publishSeq uint64
+	tag        uint64
+	unacked    map[uint64]unacked
+	consumers  map[string]*consumer
+	closes     []chan *amqp.Error
+	cancels    []chan string
+	returns    []chan amqp.Return
+	confirms   []chan amqp.Confirmation
+	flows      []chan bool
+}
+
+// publishing waiting for commit of transaction
+type publishing struct {
+	exchange  string
+	key       string
+	mandatory bool
+	msg       amqp.Publishing
+}
+
+type unacked struct {
+	q    *queue
+	msg  message
+	cons *consumer
+}
+
+func (ch *channel) b() *Broker {
+	return ch.conn.b
+}
+
+func (ch *channel) Close() error {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdown(nil)
+	return nil
+}
+
+func (ch *channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	if name == "" {
+		b.seq++
+		name = "amq.gen-" + strconv.Itoa(b.seq)
+	}
+
+	if q, ok := b.queues[name]; ok {
+		if diff, ok := inequivalent("queue '"+name+"'",
+			amqp.Table{"durable": q.durable, "auto_delete": q.autoDelete, "exclusive": q.exclusive}, q.args,
+			amqp.Table{"durable": durable, "auto_delete": autoDelete, "exclusive": exclusive}, args,
+		); ok {
+			return amqp.Queue{}, ch.fail(amqp.PreconditionFailed,
+				"PRECONDITION_FAILED - inequivalent arg %s", diff)
+		}
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(amqp.ResourceLocked,
+				"RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		return amqp.Queue{Name: name, Messages: len(q.msgs), Consumers: len(q.consumers)}, nil
+	}
+
+	q := &queue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+		consumers:  make(map[string]*consumer),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+
+	return amqp.Queue{Name: name}, nil
+}
+
+// QueueDeclarePassive checks that queue exists and isn't exclusive to other
+// connection, like amqp.Channel does. Channel is closed otherwise
+func (ch *channel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Queue{}, ch.fail(amqp.ResourceLocked,
+			"RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	return amqp.Queue{Name: name, Messages: len(q.msgs), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		return ch.fail(amqp.CommandInvalid,
+			"COMMAND_INVALID - invalid exchange type '%s'", kind)
+	}
+
+	if ex, ok := b.exchanges[name]; ok {
+		if diff, ok := inequivalent("exchange '"+name+"'",
+			amqp.Table{"type": ex.kind, "durable": ex.durable, "auto_delete": ex.autoDelete}, ex.args,
+			amqp.Table{"type": kind, "durable": durable, "auto_delete": autoDelete}, args,
+		); ok {
+			return ch.fail(amqp.PreconditionFailed,
+				"PRECONDITION_FAILED - inequivalent arg %s", diff)
+		}
+		return nil
+	}
+
+	b.exchanges[name] = &exchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		args:       args,
+	}
+	return nil
+}
+
+// inequivalent compares properties, then arguments of existing entity with
+// redeclared ones like RabbitMQ does. Returns explanation of the first
+// difference
+func inequivalent(entity string, props, args, declaredProps, declaredArgs amqp.Table) (string, bool) {
+	for _, k := range []string{"type", "durable", "auto_delete", "exclusive"} {
+		current, ok := props[k]
+		if !ok {
+			continue
+		}
+		if declared := declaredProps[k]; declared != current {
+			return fmt.Sprintf("'%s' for %s in vhost '/': received '%v' but current is '%v'", k, entity, declared, current), true
+		}
+	}
+
+	keys := make([]string, 0, len(args)+len(declaredArgs))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	for k := range declaredArgs {
+		if _, ok := args[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		current, declared := argValue(args, k), argValue(declaredArgs, k)
+		if current != declared {
+			return fmt.Sprintf("'%s' for %s in vhost '/': received %s but current is %s", k, entity, declared, current), true
+		}
+	}
+	return "", false
+}
+
+// argValue formats argument like RabbitMQ explanations do, integer types are
+// equivalent
+func argValue(args amqp.Table, key string) string {
+	v, ok := args[key]
+	if !ok {
+		return "none"
+	}
+	return fmt.Sprintf("'%v'", v)
+}
+
+func (ch *channel) QueueBind(name, key, exchangeName string, noWait bool, args amqp.Table) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if _, ok := b.queues[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+
+	ex, ok := b.exchanges[exchangeName]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchangeName)
+	}
+
+	for _, bind := range ex.bindings {
+		if bind.queue == name && bind.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, binding{queue: name, key: key, args: args})
+	return nil
+}
+
+func (ch *channel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+
+	n := len(q.msgs)
+	q.msgs = nil
+	return n, nil
+}
+
+func (ch *channel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in use", name)
+	}
+
+	if ifEmpty && len(q.msgs) > 0 {
+		return 0, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' not empty", name)
+	}
+
+	return b.deleteQueue(name), nil
+}
+
+func (ch *channel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ex, ok := b.exchanges[name]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", name)
+	}
+
+	if ifUnused && len(ex.bindings) > 0 {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - exchange '%s' in use", name)
+	}
+
+	delete(b.exchanges, name)
+	return nil
+}
+
+func (ch *channel) Consume(queueName, tag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", queueName)
+	}
+
+	if tag == "" {
+		b.seq++
+		tag = "ctag-" + strconv.Itoa(b.seq)
+	}
+	if _, ok := ch.consumers[tag]; ok {
+		return nil, ch.fail(amqp.NotAllowed,
+			"NOT_ALLOWED - attempt to reuse consumer tag '%s'", tag)
+	}
+
+	cons := &consumer{
+		tag:        tag,
+		ch:         ch,
+		q:          q,
+		autoAck:    autoAck,
+		prefetch:   ch.prefetch,
+		deliveries: make(chan amqp.Delivery),
+		stop:       make(chan struct{}),
+	}
+	ch.consumers[tag] = cons
+	q.consumers[tag] = cons
+	go cons.run()
+
+	return cons.deliveries, nil
+}
+
+func (ch *channel) Cancel(tag string, noWait bool) error {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if cons, ok := ch.consumers[tag]; ok {
+		cons.cancel(false)
+	}
+	return nil
+}
+
+func (ch *channel) Get(queueName string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return amqp.Delivery{}, false, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", queueName)
+	}
+
+	if len(q.msgs) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	ch.tag++
+	if !autoAck {
+		ch.unacked[ch.tag] = unacked{q: q, msg: msg}
+	}
+
+	d := msg.delivery(ch, ch.tag, "")
+	d.MessageCount = uint32(len(q.msgs))
+	return d, true, nil
+}
+
+func (ch *channel) Publish(exchangeName, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if ch.tx {
+		if _, ok := b.exchanges[exchangeName]; !ok {
+			// broker closes channel asynchronously, publish itself succeeds
+			ch.shutdown(&amqp.Error{
+				Code:   amqp.NotFound,
+				Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchangeName),
+			})
+			return nil
+		}
+		ch.txPending = append(ch.txPending, publishing{exchangeName, key, mandatory, msg})
+		return nil
+	}
+
+	ch.publish(exchangeName, key, mandatory, msg)
+	return nil
+}
+
+// publish routes message, should be called with broker lock held
+func (ch *channel) publish(exchangeName, key string, mandatory bool, msg amqp.Publishing) {
+	b := ch.b()
+	routed, err := b.route(exchangeName, key, msg)
+	if amqpErr, ok := err.(*amqp.Error); ok {
+		// broker closes channel asynchronously, publish itself succeeds
+		ch.shutdown(amqpErr)
+		return
+	}
+
+	if !routed && mandatory {
+		ret := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchangeName,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		for _, l := range ch.returns {
+			l := l
+			ch.conn.d.do(func() { l <- ret })
+		}
+	}
+
+	if ch.confirm {
+		ch.publishSeq++
+		confirmation := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true}
+		for _, l := range ch.confirms {
+			l := l
+			ch.conn.d.do(func() { l <- confirmation })
+		}
+	}
+}
+
+func (ch *channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *channel) Confirm(noWait bool) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if ch.tx {
+		return ch.fail(amqp.PreconditionFailed,
+			"PRECONDITION_FAILED - cannot switch from tx to confirm mode")
+	}
+	ch.confirm = true
+	return nil
+}
+
+func (ch *channel) Tx() error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if ch.confirm {
+		return ch.fail(amqp.PreconditionFailed,
+			"PRECONDITION_FAILED - cannot switch from confirm to tx mode")
+	}
+	ch.tx = true
+	return nil
+}
+
+func (ch *channel) TxCommit() error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if !ch.tx {
+		return ch.fail(amqp.PreconditionFailed,
+			"PRECONDITION_FAILED - channel is not transactional")
+	}
+
+	pending := ch.txPending
+	ch.txPending = nil
+	for _, p := range pending {
+		ch.publish(p.exchange, p.key, p.mandatory, p.msg)
+		if ch.closed {
+			return amqp.ErrClosed
+		}
+	}
+	return nil
+}
+
+func (ch *channel) TxRollback() error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if !ch.tx {
+		return ch.fail(amqp.PreconditionFailed,
+			"PRECONDITION_FAILED - channel is not transactional")
+	}
+	ch.txPending = nil
+	return nil
+}
+
+func (ch *channel) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		close(l)
+	} else {
+		ch.closes = append(ch.closes, l)
+	}
+	return l
+}
+
+func (ch *channel) NotifyCancel(l chan string) chan string {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		close(l)
+	} else {
+		ch.cancels = append(ch.cancels, l)
+	}
+	return l
+}
+
+func (ch *channel) NotifyReturn(l chan amqp.Return) chan amqp.Return {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		close(l)
+	} else {
+		ch.returns = append(ch.returns, l)
+	}
+	return l
+}
+
+func (ch *channel) NotifyFlow(l chan bool) chan bool {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		close(l)
+	} else {
+		ch.flows = append(ch.flows, l)
+	}
+	return l
+}
+
+func (ch *channel) NotifyPublish(l chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.b().m.Lock()
+	defer ch.b().m.Unlock()
+
+	if ch.closed {
+		close(l)
+	} else {
+		ch.confirms = append(ch.confirms, l)
+	}
+	return l
+}
+
+// Ack implements amqp.Acknowledger
+func (ch *channel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, false)
+}
+
+// Nack implements amqp.Acknowledger
+func (ch *channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, requeue)
+}
+
+// Reject implements amqp.Acknowledger
+func (ch *channel) Reject(tag uint64, requeue bool) error {
+	return ch.settle(tag, false, requeue)
+}
+
+func (ch *channel) settle(tag uint64, multiple bool, requeue bool) error {
+	b := ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	tags := []uint64{}
+	if multiple {
+		// zero tag with multiple flag settles all outstanding messages
+		for t := range ch.unacked {
+			if t <= tag || tag == 0 {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	} else {
+		return ch.fail(amqp.PreconditionFailed,
+			"PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+
+	ch.release(tags, requeue)
+	return nil
+}
+
+// release unacknowledged messages, optionally putting them back to their
+// queues, should be called with broker lock held
+func (ch *channel) release(tags []uint64, requeue bool) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	requeued := make(map[*queue][]message)
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		if u.cons != nil {
+			u.cons.inflight--
+		}
+		if requeue {
+			u.msg.redelivered = true
+			requeued[u.q] = append(requeued[u.q], u.msg)
+		}
+	}
+
+	for q, msgs := range requeued {
+		if ch.b().queues[q.name] == q {
+			q.msgs = append(msgs, q.msgs...)
+		}
+	}
+	ch.b().signal()
+}
+
+// fail closes channel with error, like broker does on channel exceptions.
+// Should be called with broker lock held
+func (ch *channel) fail(code int, format string, args ...interface{}) error {
+	err := &amqp.Error{
+		Code:    code,
+		Reason:  fmt.Sprintf(format, args...),
+		Server:  true,
+		Recover: true,
+	}
+	ch.shutdown(err)
+	return err
+}
+
+// shutdown closes channel, cancels its consumers and requeues unacknowledged
+// messages. Should be called with broker lock held
+func (ch *channel) shutdown(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	delete(ch.conn.chans, ch)
+
+	// like amqp, buffered listeners get error before deliveries are closed
+	pending := make(map[chan *amqp.Error]bool)
+	for _, l := range ch.closes {
+		if err == nil {
+			continue
+		}
+		select {
+		case l <- err:
+		default:
+			pending[l] = true
+		}
+	}
+
+	for _, cons := range ch.consumers {
+		cons.cancel(false)
+	}
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for t := range ch.unacked {
+		tags = append(tags, t)
+	}
+	ch.release(tags, true)
+
+	closes, cancels, returns, confirms, flows := ch.closes, ch.cancels, ch.returns, ch.confirms, ch.flows
+	ch.closes, ch.cancels, ch.returns, ch.confirms, ch.flows = nil, nil, nil, nil, nil
+	ch.conn.d.do(func() {
+		for _, l := range closes {
+			if pending[l] {
+				l <- err
+			}
+			close(l)
+		}
+		for _, l := range cancels {
+			close(l)
+		}
+		for _, l := range returns {
+			close(l)
+		}
+		for _, l := range confirms {
+			close(l)
+		}
+		for _, l := range flows {
+			close(l)
+		}
+	})
+}
+
+// consumer ships messages from queue to deliveries channel
+type consumer struct {
+	tag        string
+	ch         *channel
+	q          *queue
+	autoAck    bool
+	prefetch   int
+	inflight   int
+	deliveries chan amqp.Delivery
+	stop       chan struct{}
+}
+
+// cancel consumer, optionally sending cancel notification, like on queue
+// deletion. Should be called with broker lock held
+func (c *consumer) cancel(notify bool) {
+	delete(c.ch.consumers, c.tag)
+	delete(c.q.consumers, c.tag)
+
+	if notify {
+		cancels := c.ch.cancels
+		c.ch.conn.d.do(func() {
+			for _, l := range cancels {
+				l <- c.tag
+			}
+			close(c.stop)
+		})
+	} else {
+		close(c.stop)
+	}
+
+	if c.q.autoDelete && len(c.q.consumers) == 0 && c.ch.b().queues[c.q.name] == c.q {
+		c.ch.b().deleteQueue(c.q.name)
+	}
+}
+
+func (c *consumer) run() {
+	defer close(c.deliveries)
+
+	for {
+		msg, d, ok := c.next()
+		if !ok {
+			return
+		}
+
+		select {
+		case c.deliveries <- d:
+		case <-c.stop:
+			c.requeue(msg, d.DeliveryTag)
+			return
+		}
+	}
+}
+
+// next waits for message available for delivery
+func (c *consumer) next() (message, amqp.Delivery, bool) {
+	b := c.ch.b()
+
+	for {
+		b.m.Lock()
+		select {
+		case <-c.stop:
+			b.m.Unlock()
+			return message{}, amqp.Delivery{}, false
+		default:
+		}
+
+		if len(c.q.msgs) > 0 && (c.autoAck || c.prefetch == 0 || c.inflight < c.prefetch) {
+			msg := c.q.msgs[0]
+			c.q.msgs = c.q.msgs[1:]
+			c.ch.tag++
+			tag := c.ch.tag
+
+			var ack amqp.Acknowledger
+			if !c.autoAck {
+				ack = c.ch
+				c.inflight++
+				c.ch.unacked[tag] = unacked{q: c.q, msg: msg, cons: c}
+			}
+			d := msg.delivery(ack, tag, c.tag)
+			b.m.Unlock()
+			return msg, d, true
+		}
+
+		changed := b.changed
+		b.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-c.stop:
+			return message{}, amqp.Delivery{}, false
+		}
+	}
+}
+
+// requeue message which was taken from queue, but not delivered
+func (c *consumer) requeue(msg message, tag uint64) {
+	b := c.ch.b()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if !c.autoAck {
+		// unless channel shutdown already released it
+		if _, ok := c.ch.unacked[tag]; ok {
+			c.ch.release([]uint64{tag}, true)
+		}
+		return
+	}
+
+	if b.queues[c.q.name] == c.q {
+		c.q.msgs = append([]message{msg}, c.q.msgs...)
+		b.signal()
+	}
+}
@@ -0,0 +1,157 @@
+package conytest
+
+import (
+	"sync"
+
+	"github.com/integration-system/cony"
+	"github.com/streadway/amqp"
+)
+
+// connection implements cony.Connection
+type connection struct {
+	b      *Broker
+	closed bool
+	chans  map[*channel]struct{}
+	closes []chan *amqp.Error
+	blocks []chan amqp.Blocking
+	d      *dispatcher
+}
+
+func (c *connection) Channel() (cony.Channel, error) {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &channel{
+		conn:      c,
+		unacked:   make(map[uint64]unacked),
+		consumers: make(map[string]*consumer),
+	}
+	c.chans[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *connection) Close() error {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *connection) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		close(l)
+	} else {
+		c.closes = append(c.closes, l)
+	}
+	return l
+}
+
+func (c *connection) NotifyBlocked(l chan amqp.Blocking) chan amqp.Blocking {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		close(l)
+	} else {
+		c.blocks = append(c.blocks, l)
+	}
+	return l
+}
+
+// shutdown closes connection along with its channels and exclusive queues,
+// should be called with broker lock held
+func (c *connection) shutdown(err *amqp.Error) {
+	c.closed = true
+	delete(c.b.conns, c)
+
+	for ch := range c.chans {
+		ch.shutdown(err)
+	}
+
+	for name, q := range c.b.queues {
+		if q.owner == c {
+			c.b.deleteQueue(name)
+		}
+	}
+
+	closes, blocks := c.closes, c.blocks
+	c.closes, c.blocks = nil, nil
+	c.d.do(func() {
+		for _, l := range closes {
+			if err != nil {
+				l <- err
+			}
+			close(l)
+		}
+		for _, l := range blocks {
+			close(l)
+		}
+	})
+	c.d.close()
+}
+
+// dispatcher delivers notifications in order from separate goroutine, like
+// frame reader of real AMQP connection does
+type dispatcher struct {
+	m      sync.Mutex
+	queue  []func()
+	wake   chan struct{}
+	closed bool
+}
+
+func newDispatcher() *dispatcher {
+	d := &dispatcher{wake: make(chan struct{}, 1)}
+	go d.run()
+	return d
+}
+
+func (d *dispatcher) do(f func()) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.queue = append(d.queue, f)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) close() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if !d.closed {
+		d.closed = true
+		close(d.wake)
+	}
+}
+
+func (d *dispatcher) run() {
+	for range d.wake {
+		for {
+			d.m.Lock()
+			if len(d.queue) == 0 {
+				d.m.Unlock()
+				break
+			}
+			f := d.queue[0]
+			d.queue = d.queue[1:]
+			d.m.Unlock()
+			f()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package cony
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ConsumerTimeoutArg is a queue argument overriding broker consumer_timeout
+// for queue, in milliseconds
+const ConsumerTimeoutArg = "x-consumer-timeout"
+
+// DefaultConsumerTimeout is a default consumer_timeout of RabbitMQ
+const DefaultConsumerTimeout = 30 * time.Minute
+
+// ErrDeliveryRequeued is returned by Ack, Nack and Reject of delivery
+// requeued by ConsumerTimeout, it's redelivered by broker
+var ErrDeliveryRequeued = errors.New("Delivery was requeued before consumer timeout")
+
+// DeliveryOverdue is reported to Consumer.Errors() when delivery stays
+// unacknowledged close to consumer timeout, see ConsumerTimeout
+type DeliveryOverdue struct {
+	DeliveryTag uint64
+	MessageId   string
+	Timeout     time.Duration
+	Requeued    bool
+}
+
+func (e DeliveryOverdue) Error() string {
+	action := "about to close channel"
+	if e.Requeued {
+		action = "requeued"
+	}
+	return fmt.Sprintf("delivery %s unacked close to consumer timeout %s, %s", e.MessageId, e.Timeout, action)
+}
+
+// ConsumerTimeout Consumer's functional option. timeout is consumer_timeout
+// of broker, ConsumerTimeoutArg of queue takes precedence over it. RabbitMQ
+// closes channel with PRECONDITION_FAILED once delivery stays unacknowledged
+// longer than that, so all other unacked deliveries are redelivered too.
+// Delivery unacked for 90% of timeout is reported as DeliveryOverdue and,
+// with requeue, nacked with requeue, its later settlement returns
+// ErrDeliveryRequeued. Overdue deliveries are counted in Stats
+func ConsumerTimeout(timeout time.Duration, requeue bool) ConsumerOpt {
+	return func(c *Consumer) {
+		c.ackTimeout = timeout
+		c.dueRequeue = requeue
+	}
+}
+
+// consumerTimeout returns consumer timeout of queue, zero if it isn't watched
+func (c *Consumer) consumerTimeout() time.Duration {
+	if c.ackTimeout <= 0 || c.autoAck {
+		return 0
+	}
+	c.q.l.Lock()
+	ms, ok := toInt64(c.q.Args[ConsumerTimeoutArg])
+	c.q.l.Unlock()
+	if ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return c.ackTimeout
+}
+
+// deadlines watches unacknowledged deliveries of channel for consumer
+// timeout, it's used by consume goroutine only
+type deadlines struct {
+	timeout time.Duration
+	due     time.Duration // age of reported delivery
+	entries map[uint64]deadlineEntry
+}
+
+type deadlineEntry struct {
+	messageID string
+	received  time.Time
+	ack       amqp.Acknowledger // one settling delivery on channel
+}
+
+func newDeadlines(timeout time.Duration) *deadlines {
+	return &deadlines{
+		timeout: timeout,
+		due:     timeout / 10 * 9,
+		entries: make(map[uint64]deadlineEntry),
+	}
+}
+
+// interval returns how often deliveries are checked
+func (t *deadlines) interval() time.Duration {
+	return t.timeout/20 + time.Millisecond
+}
+
+// watch starts watching delivery, its Acknowledger should settle it on
+// channel bypassing consumer stats
+func (t *deadlines) watch(d *amqp.Delivery, now time.Time) {
+	t.entries[d.DeliveryTag] = deadlineEntry{messageID: d.MessageId, received: now, ack: d.Acknowledger}
+}
+
+// overdue reports deliveries unacked for too long and requeues them if
+// configured, settled deliveries are forgotten
+func (c *Consumer) overdue(t *deadlines, unacked *unackedSet, now time.Time) {
+	for tag, e := range t.entries {
+		if !unacked.has(tag) {
+			delete(t.entries, tag)
+			continue
+		}
+		if now.Sub(e.received) < t.due {
+			continue
+		}
+		delete(t.entries, tag)
+
+		err := DeliveryOverdue{DeliveryTag: tag, MessageId: e.messageID, Timeout: t.timeout}
+		if c.dueRequeue && unacked.revoke(tag) && e.ack.Nack(tag, false, true) == nil {
+			err.Requeued = true
+			atomic.AddUint64(&c.stats.nacked, 1)
+			atomic.AddUint64(&c.stats.requeued, 1)
+			atomic.AddInt64(&c.stats.inFlight, -1)
+		}
+		atomic.AddUint64(&c.stats.overdue, 1)
+		c.reportErr(err)
+	}
+}
@@ -0,0 +1,91 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConsumer_consumerTimeout(t *testing.T) {
+	c := newTestConsumer(ConsumerTimeout(time.Minute, false))
+	if c.consumerTimeout() != time.Minute {
+		t.Error("should use configured timeout", c.consumerTimeout())
+	}
+
+	c.q.Args = amqp.Table{ConsumerTimeoutArg: int64(5000)}
+	if c.consumerTimeout() != 5*time.Second {
+		t.Error("queue argument should take precedence", c.consumerTimeout())
+	}
+
+	if newTestConsumer(ConsumerTimeout(time.Minute, false), AutoAck()).consumerTimeout() != 0 {
+		t.Error("auto ack consumer shouldn't be watched")
+	}
+	if newTestConsumer().consumerTimeout() != 0 {
+		t.Error("consumer shouldn't be watched without option")
+	}
+}
+
+func TestConsumer_overdue(t *testing.T) {
+	c := newTestConsumer(ConsumerTimeout(time.Minute, true))
+	due := newDeadlines(time.Minute)
+	unacked := newUnackedSet()
+	ack := &nackAcknowledger{}
+	now := time.Now()
+
+	var ds []amqp.Delivery
+	for tag := uint64(1); tag <= 3; tag++ {
+		d := amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, MessageId: "m"}
+		due.watch(&d, now)
+		c.track(&d, unacked)
+		ds = append(ds, d)
+	}
+	if err := ds[0].Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	c.overdue(due, unacked, now.Add(50*time.Second))
+	if len(ack.requeued) != 0 || len(c.Errors()) != 0 {
+		t.Error("deliveries shouldn't be overdue yet")
+	}
+
+	c.overdue(due, unacked, now.Add(55*time.Second))
+	if len(ack.requeued) != 2 {
+		t.Error("unacked deliveries should be requeued", ack.requeued)
+	}
+	if err, ok := (<-c.Errors()).(DeliveryOverdue); !ok || !err.Requeued {
+		t.Error("should report requeued delivery", err)
+	}
+	if stats := c.Stats(); stats.Overdue != 2 || stats.Requeued != 2 || stats.InFlight != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if err := ds[1].Ack(false); err != ErrDeliveryRequeued {
+		t.Error("ack of requeued delivery should be refused", err)
+	}
+	if len(due.entries) != 0 {
+		t.Error("overdue deliveries should be forgotten", due.entries)
+	}
+}
+
+func TestConsumer_overdueWarning(t *testing.T) {
+	c := newTestConsumer(ConsumerTimeout(time.Minute, false))
+	due := newDeadlines(time.Minute)
+	unacked := newUnackedSet()
+	ack := &nackAcknowledger{}
+	now := time.Now()
+
+	d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	due.watch(&d, now)
+	c.track(&d, unacked)
+
+	c.overdue(due, unacked, now.Add(time.Minute))
+	if len(ack.requeued) != 0 {
+		t.Error("delivery shouldn't be requeued", ack.requeued)
+	}
+	if err, ok := (<-c.Errors()).(DeliveryOverdue); !ok || err.Requeued {
+		t.Error("should report overdue delivery", err)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Error("delivery should still be acked", err)
+	}
+}
@@ -0,0 +1,124 @@
+package cony
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Death is a parsed entry of x-death header, broker adds one per queue and
+// reason message was dead lettered from
+type Death struct {
+	Count       int64
+	Reason      string // rejected, expired, maxlen or delivery_limit
+	Queue       string
+	Exchange    string
+	RoutingKeys []string
+	Time        time.Time
+}
+
+// DeathInfo parses x-death header of delivery, most recent death goes first.
+// Malformed entries are skipped, nil is returned if message was never dead
+// lettered
+func DeathInfo(d amqp.Delivery) []Death {
+	entries, ok := d.Headers["x-death"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	deaths := make([]Death, 0, len(entries))
+	for _, e := range entries {
+		t, ok := e.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		death := Death{}
+		death.Count, _ = toInt64(t["count"])
+		death.Reason, _ = t["reason"].(string)
+		death.Queue, _ = t["queue"].(string)
+		death.Exchange, _ = t["exchange"].(string)
+		death.Time, _ = t["time"].(time.Time)
+		if keys, ok := t["routing-keys"].([]interface{}); ok {
+			for _, k := range keys {
+				if s, ok := k.(string); ok {
+					death.RoutingKeys = append(death.RoutingKeys, s)
+				}
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// deliveryAttempts estimates how many times message was delivered, including
+// this delivery. It takes the largest of quorum queue x-delivery-count,
+// RetryCountHeader and number of times message was rejected from queue
+func deliveryAttempts(d amqp.Delivery, queue string) int64 {
+	attempts, _ := toInt64(d.Headers["x-delivery-count"])
+
+	if retries, ok := toInt64(d.Headers[RetryCountHeader]); ok && retries > attempts {
+		attempts = retries
+	}
+
+	for _, death := range DeathInfo(d) {
+		if death.Queue == queue && death.Reason == "rejected" && death.Count > attempts {
+			attempts = death.Count
+		}
+	}
+
+	return attempts + 1
+}
+
+// maxRequeueKeys bounds number of messages requeueCounter remembers
+const maxRequeueKeys = 10000
+
+// requeueCounter counts redeliveries of messages seen by consumer, for
+// classic queues which carry neither x-delivery-count nor x-death on requeue
+type requeueCounter struct {
+	m      sync.Mutex
+	counts map[string]int64
+}
+
+func newRequeueCounter() *requeueCounter {
+	return &requeueCounter{counts: make(map[string]int64)}
+}
+
+// attempts returns number of times this consumer received message, as far as
+// it can tell. Messages are identified by MessageId, or by hash of routing
+// key and body if it's not set
+func (r *requeueCounter) attempts(d amqp.Delivery) int64 {
+	if !d.Redelivered {
+		return 1
+	}
+	key := requeueKey(d)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.counts[key]; !ok && len(r.counts) >= maxRequeueKeys {
+		// forget everything rather than grow, counts restart from redelivered
+		r.counts = make(map[string]int64)
+	}
+	r.counts[key]++
+	return r.counts[key] + 1
+}
+
+// forget message once it left the queue
+func (r *requeueCounter) forget(d amqp.Delivery) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.counts, requeueKey(d))
+}
+
+func requeueKey(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(d.RoutingKey))
+	_, _ = h.Write(d.Body)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
@@ -0,0 +1,64 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDeathInfo(t *testing.T) {
+	now := time.Now()
+	d := amqp.Delivery{Headers: amqp.Table{
+		"x-death": []interface{}{
+			amqp.Table{
+				"count":        int64(3),
+				"reason":       "rejected",
+				"queue":        "q1",
+				"exchange":     "ex1",
+				"routing-keys": []interface{}{"k1"},
+				"time":         now,
+			},
+			"garbage",
+			amqp.Table{"count": int32(1), "reason": "expired"},
+		},
+	}}
+
+	deaths := DeathInfo(d)
+	if len(deaths) != 2 {
+		t.Fatal("should skip malformed entries", deaths)
+	}
+
+	first := deaths[0]
+	if first.Count != 3 || first.Reason != "rejected" || first.Queue != "q1" ||
+		first.Exchange != "ex1" || !first.Time.Equal(now) ||
+		len(first.RoutingKeys) != 1 || first.RoutingKeys[0] != "k1" {
+		t.Error("should parse death entry", first)
+	}
+
+	if deaths[1].Count != 1 || deaths[1].Reason != "expired" {
+		t.Error("should parse any integer type", deaths[1])
+	}
+
+	if DeathInfo(amqp.Delivery{}) != nil {
+		t.Error("should return nil without x-death")
+	}
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	d := amqp.Delivery{Headers: amqp.Table{
+		RetryCountHeader: int64(1),
+		"x-death": []interface{}{
+			amqp.Table{"count": int64(4), "reason": "expired", "queue": "delay"},
+			amqp.Table{"count": int64(2), "reason": "rejected", "queue": "q1"},
+		},
+	}}
+
+	if n := deliveryAttempts(d, "q1"); n != 3 {
+		t.Error("should count rejections from consumed queue", n)
+	}
+
+	if n := deliveryAttempts(amqp.Delivery{}, "q1"); n != 1 {
+		t.Error("first delivery is the first attempt", n)
+	}
+}
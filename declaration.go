@@ -1,6 +1,14 @@
 package cony
 
-import "github.com/streadway/amqp"
+import (
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrQueueNotDeclared is returned by binding of server-named queue, which has
+// no name yet, because its declaration didn't run or failed
+var ErrQueueNotDeclared = errors.New("Server-named queue is not declared")
 
 // Declaration is a callback type to declare AMQP queue/exchange/binding
 type Declaration func(Declarer) error
@@ -12,12 +20,37 @@ type Declarer interface {
 	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
 }
 
-// DeclareQueue is a way to declare AMQP queue
-func DeclareQueue(q *Queue) Declaration {
+// DeclareQueue is a way to declare AMQP queue, opts are applied to q right
+// away. Well known arguments are validated before declaration. Queue with
+// empty name is server-named, it gets new name on every declaration, see
+// (*Queue).CurrentName
+func DeclareQueue(q *Queue, opts ...QueueOpt) Declaration {
+	for _, o := range opts {
+		o(q)
+	}
+	q.l.Lock()
+	if q.Name == "" {
+		q.unnamed = true
+	}
 	name := q.Name
+	if q.unnamed {
+		name = ""
+	}
+	q.l.Unlock()
 	return func(c Declarer) error {
-		q.Name = name
-		realQ, err := c.QueueDeclare(q.Name,
+		q.l.Lock()
+		err := validateArgs(q.Args)
+		q.l.Unlock()
+		if err != nil {
+			return err
+		}
+		if dryRun(c) {
+			// only spec is recorded, queue and its callback are left alone
+			_, err = c.QueueDeclare(name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+			return err
+		}
+
+		realQ, err := c.QueueDeclare(name,
 			q.Durable,
 			q.AutoDelete,
 			q.Exclusive,
@@ -25,8 +58,16 @@ func DeclareQueue(q *Queue) Declaration {
 			q.Args,
 		)
 		q.l.Lock()
-		q.Name = realQ.Name
+		if err == nil {
+			q.Name = realQ.Name
+		} else if q.unnamed {
+			q.Name = ""
+		}
+		declared := q.declared
 		q.l.Unlock()
+		if err == nil && declared != nil {
+			declared(realQ.Name)
+		}
 		return err
 	}
 }
@@ -45,10 +86,16 @@ func DeclareExchange(e Exchange) Declaration {
 	}
 }
 
-// DeclareBinding is a way to declare AMQP binding between AMQP queue and exchange
+// DeclareBinding is a way to declare AMQP binding between AMQP queue and
+// exchange. Server-named queue is bound by name of its last declaration, so
+// it should be declared first, otherwise ErrQueueNotDeclared is returned
 func DeclareBinding(b Binding) Declaration {
 	return func(c Declarer) error {
-		return c.QueueBind(b.Queue.Name,
+		name := b.Queue.CurrentName()
+		if name == "" && !dryRun(c) {
+			return ErrQueueNotDeclared
+		}
+		return c.QueueBind(name,
 			b.Key,
 			b.Exchange.Name,
 			false,
@@ -1,6 +1,7 @@
 package cony
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/streadway/amqp"
@@ -105,3 +106,48 @@ func TestDeclareBinding(t *testing.T) {
 		t.Error("DeclareBinding() should call declarer.QueueBind()")
 	}
 }
+
+func TestDeclareQueue_serverNamed(t *testing.T) {
+	var names []string
+	n := 0
+	td := &testDeclarer{
+		_QueueDeclare: func(name string) (amqp.Queue, error) {
+			names = append(names, name)
+			n++
+			if n == 3 {
+				return amqp.Queue{}, amqp.ErrClosed
+			}
+			return amqp.Queue{Name: fmt.Sprintf("amq.gen-%d", n)}, nil
+		},
+		_QueueBind: func() error { return nil },
+	}
+
+	q := &Queue{Exclusive: true}
+	bind := DeclareBinding(Binding{Queue: q, Exchange: Exchange{Name: "ex"}})
+	if err := bind(td); err != ErrQueueNotDeclared {
+		t.Error("binding of undeclared server-named queue should fail", err)
+	}
+
+	DeclareQueue(q)(td)
+	if q.CurrentName() != "amq.gen-1" {
+		t.Error("queue should get server name", q.CurrentName())
+	}
+	// queue declared again elsewhere, e.g. by ConsumeQueue
+	DeclareQueue(q)(td)
+	if q.CurrentName() != "amq.gen-2" {
+		t.Error("queue should get new server name", q.CurrentName())
+	}
+	for i, name := range names {
+		if name != "" {
+			t.Errorf("declaration %d should be server-named, got %q", i, name)
+		}
+	}
+
+	DeclareQueue(q)(td)
+	if q.CurrentName() != "" {
+		t.Error("failed declaration should reset server name", q.CurrentName())
+	}
+	if err := bind(td); err != ErrQueueNotDeclared {
+		t.Error("binding after failed declaration should fail", err)
+	}
+}
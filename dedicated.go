@@ -0,0 +1,106 @@
+package cony
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// dedicatedStable is how long consumer should be served on dedicated
+// connection, without deliveries, for connection to count as a healthy one
+const dedicatedStable = 10 * time.Second
+
+// DedicatedConnection set this consumer to run on its own AMQP connection
+// managed by Client, so connection level flow control caused by other
+// consumers and publishers doesn't starve it. Dedicated connection is
+// re-established on its own, independently of Client's connection.
+func DedicatedConnection() ConsumerOpt {
+	return func(c *Consumer) {
+		c.dedicated = true
+	}
+}
+
+// serveDedicated serves consumer on dedicated connection till consumer is
+// cancelled or client is closed
+func (c *Client) serveDedicated(cons *Consumer) {
+	bo := c.bo
+	if bo == nil {
+		bo = DefaultBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		if atomic.LoadInt32(&c.run) == noRun {
+			return
+		}
+		select {
+		case <-cons.stop:
+			return
+		default:
+		}
+
+		served, err := c.consumeDedicated(cons)
+		if served {
+			attempt = -1
+			continue
+		}
+		delay, retry := backoffErr(bo, attempt, err)
+		if !retry {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-cons.stop:
+			return
+		}
+	}
+}
+
+// consumeDedicated dials dedicated connection and serves consumer on it, till
+// connection or channel is closed. Returns true if consumer was actually
+// served, it got deliveries or channel lived for dedicatedStable at least.
+// Channel closed right away, e.g. on missing queue, is backed off like
+// failure to connect. Error is the one of failure to connect, if any
+func (c *Client) consumeDedicated(cons *Consumer) (bool, error) {
+	config, err := c.dialConfig()
+	if c.reportErr(err) {
+		return false, err
+	}
+	conn, err := c.dial(c.addr, config)
+	if c.reportErr(err) {
+		return false, err
+	}
+	defer conn.Close()
+
+	c.l.Lock()
+	if atomic.LoadInt32(&c.run) == noRun {
+		c.l.Unlock()
+		return false, nil
+	}
+	c.dedicated[cons] = conn
+	c.l.Unlock()
+
+	defer func() {
+		c.l.Lock()
+		delete(c.dedicated, cons)
+		c.l.Unlock()
+	}()
+
+	ch, err := conn.Channel()
+	if c.reportErr(err) {
+		return false, err
+	}
+
+	started, delivered := time.Now(), atomic.LoadUint64(&cons.stats.delivered)
+	cons.serve(c, ch)
+	return atomic.LoadUint64(&cons.stats.delivered) > delivered ||
+		time.Since(started) >= dedicatedStable, nil
+}
+
+// closeDedicated closes dedicated connections of consumers
+func (c *Client) closeDedicated() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	for _, conn := range c.dedicated {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,257 @@
+package cony
+
+import (
+	"container/list"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DedupStore remembers ids of messages processed by consumer.
+// Implementations should be safe for concurrent use, e.g. Redis based store
+// could use EXISTS and SET EX.
+type DedupStore interface {
+	// Seen reports whether id was recorded and didn't expire yet
+	Seen(id string) (bool, error)
+	// Record records id for ttl
+	Record(id string, ttl time.Duration) error
+	// Forget removes id, so message could be processed again
+	Forget(id string) error
+}
+
+// lruStore is in-memory DedupStore, keeping at most size most recent ids
+type lruStore struct {
+	m     sync.Mutex
+	size  int
+	ids   map[string]*list.Element
+	order *list.List // front is the most recent
+	now   func() time.Time
+}
+
+type lruEntry struct {
+	id      string
+	expires time.Time
+}
+
+// NewLRUDedupStore is an in-memory DedupStore constructor, it keeps up to
+// size most recently recorded ids
+func NewLRUDedupStore(size int) DedupStore {
+	return &lruStore{
+		size:  size,
+		ids:   make(map[string]*list.Element),
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+func (s *lruStore) Seen(id string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	el, ok := s.ids[id]
+	return ok && s.now().Before(el.Value.(*lruEntry).expires), nil
+}
+
+func (s *lruStore) Record(id string, ttl time.Duration) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	expires := s.now().Add(ttl)
+	if el, ok := s.ids[id]; ok {
+		el.Value.(*lruEntry).expires = expires
+		s.order.MoveToFront(el)
+		return nil
+	}
+
+	s.ids[id] = s.order.PushFront(&lruEntry{id: id, expires: expires})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(*lruEntry).id)
+	}
+	return nil
+}
+
+func (s *lruStore) Forget(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if el, ok := s.ids[id]; ok {
+		s.order.Remove(el)
+		delete(s.ids, id)
+	}
+	return nil
+}
+
+// newUUID returns random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// dedupKey identifies message for Dedup. Copies republished by Republish or
+// RetryScheduler keep MessageId, so their retry count tells them apart
+func dedupKey(d *amqp.Delivery) string {
+	if retries, _ := toInt64(d.Headers[RetryCountHeader]); retries > 0 {
+		return fmt.Sprintf("%s#%d", d.MessageId, retries)
+	}
+	return d.MessageId
+}
+
+// duplicate reports whether message of delivery was already processed by
+// consumer, duplicates are acknowledged. Deliveries without MessageId are
+// never duplicates. Redelivered ones are checked too, as their previous
+// delivery could be acked by consumer while ack was lost with connection.
+// Message id is recorded once delivery is acked on its channel.
+func (c *Consumer) duplicate(d *amqp.Delivery, pending *pendingIDs) bool {
+	if d.MessageId == "" {
+		return false
+	}
+	key := dedupKey(d)
+
+	seen, err := c.dedup.Seen(key)
+	if err != nil {
+		// prefer redelivery to message loss
+		c.reportErr(fmt.Errorf("dedup %s: %v", d.MessageId, err))
+		return false
+	}
+
+	if seen {
+		if !c.autoAck {
+			_ = d.Ack(false)
+		}
+		return true
+	}
+
+	if c.autoAck || d.Acknowledger == nil {
+		c.recordIDs(key)
+		return false
+	}
+	pending.add(d.DeliveryTag, key)
+	d.Acknowledger = dedupAcknowledger{d.Acknowledger, c, pending}
+	return false
+}
+
+func (c *Consumer) recordIDs(keys ...string) {
+	for _, key := range keys {
+		if err := c.dedup.Record(key, c.dedupTTL); err != nil {
+			c.reportErr(fmt.Errorf("dedup %s: %v", key, err))
+		}
+	}
+}
+
+// pendingIDs holds message ids of deliveries not acked yet on a single
+// channel. They are dropped once channel is closed, as broker redelivers
+// unacked deliveries
+type pendingIDs struct {
+	m      sync.Mutex
+	ids    map[uint64]string
+	closed bool
+}
+
+func newPendingIDs() *pendingIDs {
+	return &pendingIDs{ids: make(map[uint64]string)}
+}
+
+func (s *pendingIDs) add(tag uint64, id string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.closed {
+		s.ids[tag] = id
+	}
+}
+
+// take removes ids of settled deliveries and returns them in delivery order
+func (s *pendingIDs) take(tag uint64, multiple bool) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !multiple {
+		id, ok := s.ids[tag]
+		if !ok {
+			return nil
+		}
+		delete(s.ids, tag)
+		return []string{id}
+	}
+
+	var tags []uint64
+	for t := range s.ids {
+		if t <= tag || tag == 0 {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	ids := make([]string, len(tags))
+	for i, t := range tags {
+		ids[i] = s.ids[t]
+		delete(s.ids, t)
+	}
+	return ids
+}
+
+// drain forgets all ids once channel is closed
+func (s *pendingIDs) drain() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ids = nil
+	s.closed = true
+}
+
+// dedupAcknowledger records message ids once deliveries are acked. Nacked
+// and rejected ones are forgotten, so they're not dropped if delivered again
+type dedupAcknowledger struct {
+	amqp.Acknowledger
+	c       *Consumer
+	pending *pendingIDs
+}
+
+func (a dedupAcknowledger) Ack(tag uint64, multiple bool) error {
+	err := a.Acknowledger.Ack(tag, multiple)
+	if err == nil {
+		a.c.recordIDs(a.pending.take(tag, multiple)...)
+	}
+	return err
+}
+
+func (a dedupAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	err := a.Acknowledger.Nack(tag, multiple, requeue)
+	if err == nil {
+		a.pending.take(tag, multiple)
+	}
+	return err
+}
+
+func (a dedupAcknowledger) Reject(tag uint64, requeue bool) error {
+	err := a.Acknowledger.Reject(tag, requeue)
+	if err == nil {
+		a.pending.take(tag, false)
+	}
+	return err
+}
+
+// Dedup set this consumer to drop deliveries with MessageId processed within
+// ttl, duplicates are acknowledged. Message counts as processed once its
+// delivery is acked, so nacked, rejected and redelivered messages are
+// delivered again. Use MessageIDs option on publishers.
+func Dedup(store DedupStore, ttl time.Duration) ConsumerOpt {
+	return func(c *Consumer) {
+		c.dedup = store
+		c.dedupTTL = ttl
+	}
+}
+
+// MessageIDs Publisher's functional option. Publishings without MessageId
+// get random UUID, so consumers could drop duplicates with Dedup option.
+func MessageIDs() PublisherOpt {
+	return func(p *Publisher) {
+		p.stampIDs = true
+	}
+}
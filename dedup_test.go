@@ -0,0 +1,172 @@
+package cony
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestLRUDedupStore(t *testing.T) {
+	now := time.Now()
+	s := NewLRUDedupStore(2).(*lruStore)
+	s.now = func() time.Time { return now }
+
+	if seen, _ := s.Seen("a"); seen {
+		t.Error("id should not be seen before it's recorded")
+	}
+
+	s.Record("a", time.Minute)
+	if seen, _ := s.Seen("a"); !seen {
+		t.Error("id should be seen within ttl")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if seen, _ := s.Seen("a"); seen {
+		t.Error("id should expire after ttl")
+	}
+
+	s.Record("b", time.Minute)
+	s.Record("c", time.Minute)
+	s.Record("d", time.Minute)
+	if seen, _ := s.Seen("b"); seen {
+		t.Error("least recently recorded id should be evicted")
+	}
+
+	s.Forget("c")
+	if seen, _ := s.Seen("c"); seen {
+		t.Error("forgotten id should not be seen")
+	}
+}
+
+func TestConsumer_duplicate(t *testing.T) {
+	c := newTestConsumer(Dedup(NewLRUDedupStore(10), time.Minute))
+	pending := newPendingIDs()
+	ack := &testAcknowledger{}
+
+	d := amqp.Delivery{MessageId: "m1", DeliveryTag: 1, Acknowledger: ack}
+	if c.duplicate(&d, pending) {
+		t.Error("first delivery is not a duplicate")
+	}
+
+	d2 := amqp.Delivery{MessageId: "m1", DeliveryTag: 2, Acknowledger: ack}
+	if c.duplicate(&d2, pending) {
+		t.Error("delivery is not a duplicate until its message is acked")
+	}
+
+	d.Reject(true)
+	d2.Ack(false)
+	d = amqp.Delivery{MessageId: "m1", DeliveryTag: 3, Acknowledger: ack}
+	if !c.duplicate(&d, pending) {
+		t.Error("should detect duplicate of acked message")
+	}
+
+	if len(ack.acked) != 2 || ack.acked[1] != 3 {
+		t.Error("duplicate should be acked", ack.acked)
+	}
+
+	d = amqp.Delivery{MessageId: "m1", DeliveryTag: 4, Redelivered: true, Acknowledger: ack}
+	if !c.duplicate(&d, pending) {
+		t.Error("should detect redelivered duplicate of acked message")
+	}
+	if len(ack.acked) != 3 || ack.acked[2] != 4 {
+		t.Error("redelivered duplicate should be acked", ack.acked)
+	}
+
+	d = amqp.Delivery{MessageId: "m1", DeliveryTag: 5, Acknowledger: ack,
+		Headers: amqp.Table{RetryCountHeader: int32(1)}}
+	if c.duplicate(&d, pending) {
+		t.Error("retried message is not a duplicate")
+	}
+
+	if c.duplicate(&amqp.Delivery{Acknowledger: ack}, pending) {
+		t.Error("delivery without MessageId is not a duplicate")
+	}
+}
+
+func TestConsumer_serve_redeliveredDuplicate(t *testing.T) {
+	deliveries := make(chan amqp.Delivery)
+	done := make(chan bool)
+	c := newTestConsumer(Dedup(NewLRUDedupStore(10), time.Minute))
+	cli := &mqDeleterTest{_deleteConsumer: func(*Consumer) {}}
+	ch := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries, nil
+		},
+		_Close: func() error {
+			return nil
+		},
+	}
+	go func() {
+		c.serve(cli, ch)
+		done <- true
+	}()
+
+	ack := &testAcknowledger{}
+	deliveries <- amqp.Delivery{MessageId: "m1", DeliveryTag: 1, Acknowledger: ack}
+	d := <-c.Deliveries()
+	d.Ack(false)
+
+	// ack was lost with connection, so broker redelivers message
+	deliveries <- amqp.Delivery{MessageId: "m1", DeliveryTag: 2, Redelivered: true, Acknowledger: ack}
+	deliveries <- amqp.Delivery{MessageId: "m2", DeliveryTag: 3, Acknowledger: ack}
+	if d = <-c.Deliveries(); d.MessageId != "m2" {
+		t.Error("redelivered duplicate should not be delivered", d.MessageId)
+	}
+	if len(ack.acked) != 2 || ack.acked[1] != 2 {
+		t.Error("redelivered duplicate should be acked", ack.acked)
+	}
+
+	go c.Cancel()
+	<-done
+}
+
+func TestConsumer_duplicateMultiple(t *testing.T) {
+	store := NewLRUDedupStore(10)
+	c := newTestConsumer(Dedup(store, time.Minute))
+	pending := newPendingIDs()
+	ack := &testAcknowledger{}
+
+	ds := make([]amqp.Delivery, 3)
+	for i := range ds {
+		ds[i] = amqp.Delivery{MessageId: fmt.Sprint("m", i), DeliveryTag: uint64(i + 1), Acknowledger: ack}
+		c.duplicate(&ds[i], pending)
+	}
+
+	ds[0].Nack(true, true)
+	ds[2].Ack(true)
+	if seen, _ := store.Seen("m0"); seen {
+		t.Error("nacked message should not be recorded")
+	}
+	if seen, _ := store.Seen("m1"); !seen {
+		t.Error("should record messages acked with multiple")
+	}
+
+	d := amqp.Delivery{MessageId: "m3", DeliveryTag: 4, Acknowledger: ack}
+	c.duplicate(&d, pending)
+	pending.drain()
+	d.Ack(false)
+	if seen, _ := store.Seen("m3"); seen {
+		t.Error("should not record messages once channel is closed")
+	}
+}
+
+func TestMessageIDs(t *testing.T) {
+	var msg amqp.Publishing
+	p := newTestPublisher(MessageIDs())
+
+	go func() {
+		envelop := <-p.pubChan
+		msg = <-envelop.pub
+		envelop.err <- nil
+	}()
+
+	p.Publish(amqp.Publishing{})
+	if len(msg.MessageId) != 36 {
+		t.Error("should stamp MessageId with UUID", msg.MessageId)
+	}
+}
@@ -0,0 +1,72 @@
+package cony
+
+import (
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// ExchangeConsistentHash is a kind of exchange provided by
+// rabbitmq_consistent_hash_exchange plugin
+const ExchangeConsistentHash = "x-consistent-hash"
+
+// HeadersMatch defines whether all or any headers of headers exchange
+// binding should match
+type HeadersMatch string
+
+// Matching modes of headers exchange bindings
+const (
+	MatchAll HeadersMatch = "all"
+	MatchAny HeadersMatch = "any"
+)
+
+// HeadersExchange returns durable exchange of headers kind
+func HeadersExchange(name string) Exchange {
+	return Exchange{Name: name, Kind: amqp.ExchangeHeaders, Durable: true}
+}
+
+// HeadersBinding binds q to headers exchange e, routing messages which have
+// all or any of headers, depending on match
+func HeadersBinding(q *Queue, e Exchange, match HeadersMatch, headers amqp.Table) Binding {
+	args := amqp.Table{"x-match": string(match)}
+	for k, v := range headers {
+		args[k] = v
+	}
+	return Binding{Queue: q, Exchange: e, Args: args}
+}
+
+// ConsistentHashExchange returns durable exchange of x-consistent-hash kind,
+// distributing messages between bound queues by hash of routing key
+func ConsistentHashExchange(name string) Exchange {
+	return Exchange{Name: name, Kind: ExchangeConsistentHash, Durable: true}
+}
+
+// HashOnHeader makes consistent hash exchange e hash value of header instead
+// of routing key
+func HashOnHeader(e Exchange, header string) Exchange {
+	return withExchangeArg(e, "hash-header", header)
+}
+
+// HashOnProperty makes consistent hash exchange e hash message property, like
+// message_id, correlation_id or timestamp, instead of routing key
+func HashOnProperty(e Exchange, property string) Exchange {
+	return withExchangeArg(e, "hash-property", property)
+}
+
+// ConsistentHashBinding binds q to consistent hash exchange e. Binding key of
+// such exchange is a weight, share of hash space q gets relative to other
+// queues
+func ConsistentHashBinding(q *Queue, e Exchange, weight int) Binding {
+	return Binding{Queue: q, Exchange: e, Key: strconv.Itoa(weight)}
+}
+
+// withExchangeArg returns copy of exchange with argument set
+func withExchangeArg(e Exchange, key string, value interface{}) Exchange {
+	args := amqp.Table{}
+	for k, v := range e.Args {
+		args[k] = v
+	}
+	args[key] = value
+	e.Args = args
+	return e
+}
@@ -0,0 +1,33 @@
+package cony
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestHeadersBinding(t *testing.T) {
+	headers := amqp.Table{"format": "pdf"}
+	b := HeadersBinding(&Queue{Name: "q1"}, HeadersExchange("docs"), MatchAny, headers)
+
+	if b.Exchange.Kind != amqp.ExchangeHeaders || b.Args["x-match"] != "any" || b.Args["format"] != "pdf" {
+		t.Error("should bind with x-match and headers", b)
+	}
+
+	if len(headers) != 1 {
+		t.Error("should not modify headers", headers)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	e := HashOnHeader(ConsistentHashExchange("orders"), "customer")
+	b := ConsistentHashBinding(&Queue{Name: "q1"}, e, 10)
+
+	if e.Kind != ExchangeConsistentHash || e.Args["hash-header"] != "customer" {
+		t.Error("should hash on header", e)
+	}
+
+	if b.Key != "10" {
+		t.Error("weight should be binding key", b.Key)
+	}
+}
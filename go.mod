@@ -1,5 +1,8 @@
 module github.com/integration-system/cony
 
-go 1.13
+go 1.16
 
-require github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+require (
+	github.com/klauspost/compress v1.15.9
+	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+)
@@ -0,0 +1,197 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrDrop could be returned by HandlerFunc, directly or wrapped, to nack
+// delivery without requeue, so it's dead-lettered if queue has
+// dead-letter-exchange
+var ErrDrop = errors.New("Drop delivery")
+
+// HandlerFunc processes single delivery. Delivery is acked once it returns
+// nil, nacked with requeue on error other than ErrDrop
+type HandlerFunc func(ctx context.Context, d amqp.Delivery) error
+
+// HandlerTimedOut is reported to Consumer.Errors() when HandlerFunc runs
+// longer than allowed by HandlerTimeout
+type HandlerTimedOut struct {
+	DeliveryTag uint64
+	MessageId   string
+	Timeout     time.Duration
+}
+
+func (e HandlerTimedOut) Error() string {
+	return "handler of " + e.MessageId + " timed out after " + e.Timeout.String()
+}
+
+// Handle runs h for every delivery of consumer and acks or nacks delivery
+// according to its result. In AutoAck mode result is only reported.
+// Deliveries are handled one at a time, unless Workers option is set.
+// Returns once consumer is cancelled or ctx is done, in the latter case
+// consumer is cancelled too.
+func (c *Consumer) Handle(ctx context.Context, h HandlerFunc) error {
+	workers := c.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// single lane is shared by all workers, unless deliveries are ordered
+	lanes := make([]chan amqp.Delivery, 1)
+	if c.orderBy != nil {
+		lanes = make([]chan amqp.Delivery, workers)
+	}
+	for i := range lanes {
+		lanes[i] = make(chan amqp.Delivery)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(lane <-chan amqp.Delivery) {
+			defer wg.Done()
+			for d := range lane {
+				c.handle(ctx, h, d)
+			}
+		}(lanes[i%len(lanes)])
+	}
+	defer func() {
+		for _, lane := range lanes {
+			close(lane)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.Cancel()
+			return ctx.Err()
+		case d, ok := <-c.deliveries:
+			if !ok {
+				return nil
+			}
+			select {
+			case c.lane(lanes, d) <- d:
+			case <-ctx.Done():
+				// unhandled delivery is redelivered once consumer is cancelled
+			}
+		}
+	}
+}
+
+// lane picks lane of delivery, deliveries with the same OrderedBy key share
+// lane
+func (c *Consumer) lane(lanes []chan amqp.Delivery, d amqp.Delivery) chan amqp.Delivery {
+	if len(lanes) == 1 {
+		return lanes[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(c.orderBy(d)))
+	return lanes[h.Sum32()%uint32(len(lanes))]
+}
+
+// handle runs h for delivery within HandlerTimeout and settles delivery
+func (c *Consumer) handle(ctx context.Context, h HandlerFunc, d amqp.Delivery) {
+	stuck, err := c.runHandler(ctx, h, d)
+	if stuck != nil && c.orderBy != nil {
+		// next delivery of the lane could have the same key
+		defer func() { <-stuck }()
+	}
+
+	if c.autoAck {
+		c.reportErr(err)
+		return
+	}
+
+	switch {
+	case err == nil:
+		_ = d.Ack(false)
+	case errors.Is(err, ErrDrop):
+		_ = d.Nack(false, false)
+	default:
+		if _, ok := err.(HandlerTimedOut); ok {
+			_ = d.Nack(false, c.tmoRequeue)
+		} else {
+			_ = d.Nack(false, true)
+		}
+		c.reportErr(err)
+	}
+}
+
+// runHandler runs h within HandlerTimeout. Returns result channel of handler
+// still running after timeout
+func (c *Consumer) runHandler(parent context.Context, h HandlerFunc, d amqp.Delivery) (<-chan error, error) {
+	if c.timeout <= 0 {
+		return nil, h(parent, d)
+	}
+
+	ctx, cancel := context.WithTimeout(parent, c.timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	res := make(chan error, 1)
+	go func() {
+		res <- h(ctx, d)
+	}()
+
+	select {
+	case err := <-res:
+		return nil, err
+	case <-ctx.Done():
+	}
+
+	if parent.Err() != nil {
+		// Handle is stopped, result of handler asked to stop settles
+		// delivery, unless it's still running once timeout is exceeded
+		select {
+		case err := <-res:
+			return nil, err
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+
+	// result of stuck handler is ignored, delivery is settled right away
+	atomic.AddUint64(&c.stats.timedOut, 1)
+	return res, HandlerTimedOut{DeliveryTag: d.DeliveryTag, MessageId: d.MessageId, Timeout: c.timeout}
+}
+
+// HandlerTimeout limits processing time of HandlerFunc run by Handle. Context
+// passed to handler gets deadline, once it's exceeded delivery is nacked with
+// requeue, or dead-lettered if requeue is false, and HandlerTimedOut is
+// reported to Errors(). Handlers cancelled because ctx of Handle is done are
+// not timed out, their results settle deliveries. With OrderedBy worker
+// waits for stuck handler to return, so deliveries of the same key never run
+// concurrently, otherwise it moves on to the next delivery right away.
+func HandlerTimeout(d time.Duration, requeue bool) ConsumerOpt {
+	return func(c *Consumer) {
+		c.timeout = d
+		c.tmoRequeue = requeue
+	}
+}
+
+// Workers set number of goroutines running HandlerFunc in Handle
+// concurrently. Qos should be at least n to keep all of them busy.
+func Workers(n int) ConsumerOpt {
+	return func(c *Consumer) {
+		c.workers = n
+	}
+}
+
+// OrderedBy set Handle to process deliveries with the same key sequentially,
+// on the same worker, while deliveries with different keys run in parallel
+// on Workers.
+//
+//	cony.OrderedBy(func(d amqp.Delivery) string { return d.RoutingKey })
+func OrderedBy(key func(amqp.Delivery) string) ConsumerOpt {
+	return func(c *Consumer) {
+		c.orderBy = key
+	}
+}
@@ -0,0 +1,260 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// nackAcknowledger records nacks by requeue flag
+type nackAcknowledger struct {
+	testAcknowledger
+	m        sync.Mutex
+	requeued []uint64
+	dropped  []uint64
+}
+
+func (a *nackAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.testAcknowledger.Ack(tag, multiple)
+}
+
+func (a *nackAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	} else {
+		a.dropped = append(a.dropped, tag)
+	}
+	return nil
+}
+
+func TestConsumer_Handle(t *testing.T) {
+	c := newTestConsumer()
+	ack := &nackAcknowledger{}
+
+	go func() {
+		for i := uint64(1); i <= 3; i++ {
+			c.deliveries <- amqp.Delivery{DeliveryTag: i, Acknowledger: ack}
+		}
+		c.Cancel()
+		c.m.Lock()
+		close(c.deliveries)
+		c.m.Unlock()
+	}()
+
+	err := c.Handle(context.Background(), func(ctx context.Context, d amqp.Delivery) error {
+		switch d.DeliveryTag {
+		case 2:
+			return errors.New("retry")
+		case 3:
+			return fmt.Errorf("poison: %w", ErrDrop)
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Error("should return nil once deliveries are closed", err)
+	}
+
+	if len(ack.acked) != 1 || len(ack.requeued) != 1 || len(ack.dropped) != 1 {
+		t.Error("should settle deliveries by handler result", ack.acked, ack.requeued, ack.dropped)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	c := newTestConsumer(HandlerTimeout(10*time.Millisecond, false))
+	ack := &nackAcknowledger{}
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	deadline := make(chan bool, 1)
+	c.handle(context.Background(), func(ctx context.Context, d amqp.Delivery) error {
+		_, ok := ctx.Deadline()
+		deadline <- ok
+		<-stuck
+		return nil
+	}, amqp.Delivery{DeliveryTag: 1, Acknowledger: ack})
+
+	if !<-deadline {
+		t.Error("handler context should have deadline")
+	}
+
+	if len(ack.dropped) != 1 {
+		t.Error("timed out delivery should be dead-lettered", ack.dropped)
+	}
+
+	if _, ok := (<-c.Errors()).(HandlerTimedOut); !ok {
+		t.Error("should report HandlerTimedOut")
+	}
+
+	if c.Stats().TimedOut != 1 {
+		t.Error("should count timeouts")
+	}
+}
+
+func TestHandlerTimeout_cancel(t *testing.T) {
+	c := newTestConsumer(HandlerTimeout(time.Minute, false))
+	ack := &nackAcknowledger{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	go func() {
+		<-started
+		cancel()
+	}()
+	c.handle(ctx, func(ctx context.Context, d amqp.Delivery) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, amqp.Delivery{DeliveryTag: 1, Acknowledger: ack})
+
+	if c.Stats().TimedOut != 0 || len(ack.requeued) != 1 {
+		t.Error("cancelled handler should not time out", ack.requeued, ack.dropped)
+	}
+}
+
+func TestHandlerTimeout_ordered(t *testing.T) {
+	c := newTestConsumer(HandlerTimeout(time.Millisecond, false), OrderedBy(func(d amqp.Delivery) string {
+		return d.RoutingKey
+	}))
+	ack := &nackAcknowledger{}
+	stuck := make(chan struct{})
+
+	handled := make(chan struct{})
+	go func() {
+		c.handle(context.Background(), func(ctx context.Context, d amqp.Delivery) error {
+			<-stuck
+			return nil
+		}, amqp.Delivery{DeliveryTag: 1, Acknowledger: ack})
+		close(handled)
+	}()
+
+	timeout := time.After(time.Second)
+	for len(c.Errors()) == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("should time out")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	select {
+	case <-handled:
+		t.Error("worker should wait for stuck handler of ordered deliveries")
+	default:
+	}
+
+	ack.m.Lock()
+	if len(ack.dropped) != 1 {
+		t.Error("timed out delivery should be settled right away", ack.dropped)
+	}
+	ack.m.Unlock()
+
+	close(stuck)
+	<-handled
+}
+
+func TestConsumer_Handle_ctx(t *testing.T) {
+	c := newTestConsumer()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := c.Handle(ctx, nil); err != context.Canceled {
+		t.Error("should return ctx error", err)
+	}
+
+	select {
+	case <-c.stop:
+	default:
+		t.Error("consumer should be cancelled")
+	}
+}
+
+func TestOrderedBy(t *testing.T) {
+	c := newTestConsumer(AutoAck(), Workers(4), OrderedBy(func(d amqp.Delivery) string {
+		return d.RoutingKey
+	}))
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.deliveries <- amqp.Delivery{RoutingKey: fmt.Sprint(i % 5), MessageId: fmt.Sprint(i)}
+		}
+		c.m.Lock()
+		close(c.deliveries)
+		c.m.Unlock()
+	}()
+
+	var (
+		m       sync.Mutex
+		running = map[string]bool{}
+		last    = map[string]int{}
+	)
+	c.Handle(context.Background(), func(ctx context.Context, d amqp.Delivery) error {
+		m.Lock()
+		if running[d.RoutingKey] {
+			t.Error("deliveries with the same key should not run concurrently")
+		}
+		running[d.RoutingKey] = true
+		var n int
+		fmt.Sscan(d.MessageId, &n)
+		if prev, ok := last[d.RoutingKey]; ok && prev > n {
+			t.Error("deliveries with the same key should be ordered")
+		}
+		last[d.RoutingKey] = n
+		m.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		m.Lock()
+		running[d.RoutingKey] = false
+		m.Unlock()
+		return nil
+	})
+
+	if len(last) != 5 {
+		t.Error("all keys should be handled", last)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	c := newTestConsumer(AutoAck(), Workers(3))
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			c.deliveries <- amqp.Delivery{}
+		}
+		for i := 0; i < 3; i++ {
+			<-started
+		}
+		close(release)
+		c.m.Lock()
+		close(c.deliveries)
+		c.m.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		c.Handle(context.Background(), func(ctx context.Context, d amqp.Delivery) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliveries should be handled concurrently")
+	}
+}
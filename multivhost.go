@@ -0,0 +1,165 @@
+package cony
+
+import (
+	"fmt"
+	"sync"
+)
+
+// VHostError is an error of MultiVHostClient client connected to VHost
+type VHostError struct {
+	VHost string
+	Err   error
+}
+
+func (e VHostError) Error() string {
+	return fmt.Sprintf("vhost %s: %v", e.VHost, e.Err)
+}
+
+// Unwrap returns error of vhost client
+func (e VHostError) Unwrap() error {
+	return e.Err
+}
+
+// MultiVHostClient manages one Client per virtual host, e.g. for tenants
+// isolated by vhost. Clients are created with the same options on first use
+// of vhost and run their own Loop, errors of all of them are merged into
+// Errors. Options shouldn't include URL, ErrorsChan, OnError and BlockingChan
+type MultiVHostClient struct {
+	uri     URI
+	opts    []ClientOpt
+	clients map[string]*vhostClient
+	errs    chan error
+	dead    bool
+	wg      sync.WaitGroup
+	m       sync.Mutex
+}
+
+type vhostClient struct {
+	client *Client
+	done   chan struct{}
+}
+
+// NewMultiVHostClient is a MultiVHostClient constructor, vhost of addr is
+// replaced by the one clients connect to
+func NewMultiVHostClient(addr string, opts ...ClientOpt) (*MultiVHostClient, error) {
+	uri, err := ParseURI(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiVHostClient{
+		uri:     uri,
+		opts:    opts,
+		clients: make(map[string]*vhostClient),
+		errs:    make(chan error, 100),
+	}, nil
+}
+
+// Client returns Client connected to vhost, starting it if needed. Returns
+// nil once MultiVHostClient is closed
+func (m *MultiVHostClient) Client(vhost string) *Client {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.dead {
+		return nil
+	}
+	if vc, ok := m.clients[vhost]; ok {
+		return vc.client
+	}
+
+	uri := m.uri
+	uri.Vhost = vhost
+	opts := append(append([]ClientOpt{}, m.opts...), URL(BuildURI(uri)))
+	vc := &vhostClient{client: NewClient(opts...), done: make(chan struct{})}
+	m.clients[vhost] = vc
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.loop(vhost, vc)
+	}()
+	return vc.client
+}
+
+// loop runs Loop of vhost client until it's closed
+func (m *MultiVHostClient) loop(vhost string, vc *vhostClient) {
+	for vc.client.Loop() {
+		select {
+		case err := <-vc.client.Errors():
+			select {
+			case m.errs <- VHostError{VHost: vhost, Err: err}:
+			default:
+			}
+		case <-vc.done:
+		}
+	}
+}
+
+// Declare runs declarations on vhost, see (*Client).Declare
+func (m *MultiVHostClient) Declare(vhost string, d []Declaration) {
+	if c := m.Client(vhost); c != nil {
+		c.Declare(d)
+	}
+}
+
+// Consume starts consumer on vhost, see (*Client).Consume
+func (m *MultiVHostClient) Consume(vhost string, cons *Consumer) {
+	if c := m.Client(vhost); c != nil {
+		c.Consume(cons)
+	}
+}
+
+// Publish starts publisher on vhost, see (*Client).Publish
+func (m *MultiVHostClient) Publish(vhost string, pub *Publisher) {
+	if c := m.Client(vhost); c != nil {
+		c.Publish(pub)
+	}
+}
+
+// VHosts returns vhosts of running clients, in no particular order
+func (m *MultiVHostClient) VHosts() []string {
+	m.m.Lock()
+	defer m.m.Unlock()
+	vhosts := make([]string, 0, len(m.clients))
+	for vhost := range m.clients {
+		vhosts = append(vhosts, vhost)
+	}
+	return vhosts
+}
+
+// Errors returns errors of all clients, wrapped into VHostError. Errors are
+// dropped in case if receiver can't keep up
+func (m *MultiVHostClient) Errors() <-chan error {
+	return m.errs
+}
+
+// RemoveVHost closes client of vhost, its consumers and publishers aren't
+// served anymore
+func (m *MultiVHostClient) RemoveVHost(vhost string) {
+	m.m.Lock()
+	vc, ok := m.clients[vhost]
+	delete(m.clients, vhost)
+	m.m.Unlock()
+
+	if ok {
+		vc.close()
+	}
+}
+
+// Close closes all clients and waits for their loops to exit
+func (m *MultiVHostClient) Close() {
+	m.m.Lock()
+	m.dead = true
+	clients := m.clients
+	m.clients = make(map[string]*vhostClient)
+	m.m.Unlock()
+
+	for _, vc := range clients {
+		vc.close()
+	}
+	m.wg.Wait()
+}
+
+func (vc *vhostClient) close() {
+	vc.client.Close()
+	close(vc.done)
+}
@@ -0,0 +1,487 @@
+package cony
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// NewNullClient returns Client which doesn't need broker, for running
+// services locally without RabbitMQ. It's used like regular Client, Loop
+// should be run as usual. Declarations succeed and publishings are confirmed,
+// but discarded. With loopback, publishings to default exchange are delivered
+// in-process to consumers of queue named by routing key, or discarded if
+// queue has no consumers. Publishing waits once 10000 deliveries or
+// confirmations are queued for slow consumer or publisher.
+func NewNullClient(loopback bool, opts ...ClientOpt) *Client {
+	b := &nullBroker{
+		loopback:  loopback,
+		consumers: make(map[string][]*nullConsumer),
+	}
+	return NewClient(append(opts, Dial(b.dial))...)
+}
+
+// nullBroker routes publishings of loopback mode
+type nullBroker struct {
+	m         sync.Mutex
+	loopback  bool
+	consumers map[string][]*nullConsumer
+	next      int // round robin counter
+}
+
+type nullConsumer struct {
+	ch         *nullChannel
+	tag        string
+	deliveries chan amqp.Delivery
+	once       sync.Once // closes deliveries on cancel or channel close
+}
+
+func (c *nullConsumer) close() {
+	c.once.Do(func() { close(c.deliveries) })
+}
+
+func (b *nullBroker) dial(string, amqp.Config) (Connection, error) {
+	return &nullConnection{b: b, chans: make(map[*nullChannel]struct{})}, nil
+}
+
+// route picks consumer of queue, should be called with lock held
+func (b *nullBroker) route(queue string) *nullConsumer {
+	consumers := b.consumers[queue]
+	if !b.loopback || len(consumers) == 0 {
+		return nil
+	}
+	b.next++
+	return consumers[b.next%len(consumers)]
+}
+
+// remove consumers of channel, should be called with lock held
+func (b *nullBroker) remove(ch *nullChannel) {
+	for queue, consumers := range b.consumers {
+		kept := consumers[:0]
+		for _, cons := range consumers {
+			if cons.ch != ch {
+				kept = append(kept, cons)
+			}
+		}
+		if len(kept) == 0 {
+			delete(b.consumers, queue)
+		} else {
+			b.consumers[queue] = kept
+		}
+	}
+}
+
+type nullConnection struct {
+	b       *nullBroker
+	closed  bool
+	chans   map[*nullChannel]struct{}
+	closers []func()
+}
+
+func (c *nullConnection) Channel() (Channel, error) {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &nullChannel{
+		conn: c,
+		done: make(chan struct{}),
+		d:    newNullDispatcher(),
+	}
+	c.chans[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *nullConnection) Close() error {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	for ch := range c.chans {
+		ch.shutdown()
+	}
+	for _, f := range c.closers {
+		f()
+	}
+	return nil
+}
+
+func (c *nullConnection) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	c.notify(func() { close(l) })
+	return l
+}
+
+func (c *nullConnection) NotifyBlocked(l chan amqp.Blocking) chan amqp.Blocking {
+	c.notify(func() { close(l) })
+	return l
+}
+
+// notify registers closer of notification channel, it's closed right away if
+// connection is closed
+func (c *nullConnection) notify(closer func()) {
+	c.b.m.Lock()
+	defer c.b.m.Unlock()
+
+	if c.closed {
+		closer()
+	} else {
+		c.closers = append(c.closers, closer)
+	}
+}
+
+type nullChannel struct {
+	conn     *nullConnection
+	closed   bool
+	confirm  bool
+	seq      uint64
+	tag      uint64
+	done     chan struct{}
+	d        *nullDispatcher
+	confirms []chan amqp.Confirmation
+	closers  []func()
+}
+
+func (ch *nullChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if name == "" {
+		name = "amq.gen-" + newUUID()
+	}
+	return amqp.Queue{Name: name}, ch.err()
+}
+
+func (ch *nullChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.err()
+}
+
+func (ch *nullChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return ch.err()
+}
+
+func (ch *nullChannel) Close() error {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdown()
+	return nil
+}
+
+// shutdown closes channel, should be called with lock held
+func (ch *nullChannel) shutdown() {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	delete(ch.conn.chans, ch)
+	ch.conn.b.remove(ch)
+
+	close(ch.done)
+	closers, confirms := ch.closers, ch.confirms
+	ch.d.do(func() {
+		for _, f := range closers {
+			f()
+		}
+		for _, l := range confirms {
+			close(l)
+		}
+	})
+	ch.d.close()
+}
+
+func (ch *nullChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	cons := &nullConsumer{ch: ch, tag: consumer, deliveries: make(chan amqp.Delivery)}
+	ch.conn.b.consumers[queue] = append(ch.conn.b.consumers[queue], cons)
+	ch.closers = append(ch.closers, cons.close)
+	return cons.deliveries, nil
+}
+
+func (ch *nullChannel) Cancel(consumer string, noWait bool) error {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	for queue, consumers := range ch.conn.b.consumers {
+		kept := consumers[:0]
+		for _, cons := range consumers {
+			if cons.ch == ch && cons.tag == consumer {
+				cons := cons
+				ch.d.do(cons.close)
+			} else {
+				kept = append(kept, cons)
+			}
+		}
+		ch.conn.b.consumers[queue] = kept
+	}
+	return nil
+}
+
+func (ch *nullChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	dispatchers, err := ch.publish(exchange, key, msg)
+	// like on memory alarm of broker, publisher waits for slow listeners to
+	// catch up, outside of broker lock
+	for _, d := range dispatchers {
+		d.wait()
+	}
+	return err
+}
+
+// publish queues confirmation and delivery of msg, returns their dispatchers
+func (ch *nullChannel) publish(exchange, key string, msg amqp.Publishing) ([]*nullDispatcher, error) {
+	b := ch.conn.b
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	var dispatchers []*nullDispatcher
+	if ch.confirm {
+		ch.seq++
+		confirm := amqp.Confirmation{DeliveryTag: ch.seq, Ack: true}
+		for _, l := range ch.confirms {
+			l := l
+			ch.send(func(done <-chan struct{}) {
+				select {
+				case l <- confirm:
+				case <-done:
+				}
+			})
+		}
+		dispatchers = append(dispatchers, ch.d)
+	}
+
+	if exchange != "" {
+		return dispatchers, nil
+	}
+	if cons := b.route(key); cons != nil {
+		cons.ch.tag++
+		d := delivery(msg)
+		d.Acknowledger = nullAcknowledger{}
+		d.ConsumerTag = cons.tag
+		d.DeliveryTag = cons.ch.tag
+		d.RoutingKey = key
+		cons.ch.send(func(done <-chan struct{}) {
+			select {
+			case cons.deliveries <- d:
+			case <-done:
+			}
+		})
+		dispatchers = append(dispatchers, cons.ch.d)
+	}
+	return dispatchers, nil
+}
+
+// send runs f on dispatcher of channel, f should give up once done is closed
+func (ch *nullChannel) send(f func(done <-chan struct{})) {
+	done := ch.done
+	ch.d.do(func() { f(done) })
+}
+
+func (ch *nullChannel) NotifyClose(l chan *amqp.Error) chan *amqp.Error {
+	ch.notify(func() { close(l) })
+	return l
+}
+
+func (ch *nullChannel) NotifyCancel(l chan string) chan string {
+	ch.notify(func() { close(l) })
+	return l
+}
+
+func (ch *nullChannel) NotifyReturn(l chan amqp.Return) chan amqp.Return {
+	ch.notify(func() { close(l) })
+	return l
+}
+
+func (ch *nullChannel) NotifyFlow(l chan bool) chan bool {
+	ch.notify(func() { close(l) })
+	return l
+}
+
+func (ch *nullChannel) NotifyPublish(l chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+
+	if ch.closed {
+		close(l)
+	} else {
+		ch.confirms = append(ch.confirms, l)
+	}
+	return l
+}
+
+// notify registers closer of notification channel, it's closed right away if
+// channel is closed
+func (ch *nullChannel) notify(closer func()) {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+
+	if ch.closed {
+		closer()
+	} else {
+		ch.closers = append(ch.closers, closer)
+	}
+}
+
+func (ch *nullChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return ch.err()
+}
+
+func (ch *nullChannel) Confirm(noWait bool) error {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+	ch.confirm = true
+	return nil
+}
+
+func (ch *nullChannel) QueuePurge(name string, noWait bool) (int, error) {
+	return 0, ch.err()
+}
+
+func (ch *nullChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	return 0, ch.err()
+}
+
+func (ch *nullChannel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	return ch.err()
+}
+
+func (ch *nullChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	return amqp.Delivery{}, false, ch.err()
+}
+
+func (ch *nullChannel) Tx() error {
+	return ch.err()
+}
+
+func (ch *nullChannel) TxCommit() error {
+	return ch.err()
+}
+
+func (ch *nullChannel) TxRollback() error {
+	return ch.err()
+}
+
+func (ch *nullChannel) err() error {
+	ch.conn.b.m.Lock()
+	defer ch.conn.b.m.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+// delivery converts publishing into delivery, reverse of publishing
+func delivery(pub amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         pub.Headers,
+		ContentType:     pub.ContentType,
+		ContentEncoding: pub.ContentEncoding,
+		DeliveryMode:    pub.DeliveryMode,
+		Priority:        pub.Priority,
+		CorrelationId:   pub.CorrelationId,
+		ReplyTo:         pub.ReplyTo,
+		Expiration:      pub.Expiration,
+		MessageId:       pub.MessageId,
+		Timestamp:       pub.Timestamp,
+		Type:            pub.Type,
+		UserId:          pub.UserId,
+		AppId:           pub.AppId,
+		Body:            pub.Body,
+	}
+}
+
+// nullAcknowledger settles nothing, loopback deliveries are not redelivered
+type nullAcknowledger struct{}
+
+func (nullAcknowledger) Ack(uint64, bool) error        { return nil }
+func (nullAcknowledger) Nack(uint64, bool, bool) error { return nil }
+func (nullAcknowledger) Reject(uint64, bool) error     { return nil }
+
+// maxNullBacklog is a number of callbacks queued by nullDispatcher, once it's
+// exceeded publishers wait for listeners to catch up
+const maxNullBacklog = 10000
+
+// nullDispatcher runs callbacks one by one in order, so notifications are
+// delivered without blocking caller
+type nullDispatcher struct {
+	m      sync.Mutex
+	queue  []func()
+	wake   chan struct{}
+	space  *sync.Cond // signalled once queue gets shorter
+	closed bool
+}
+
+func newNullDispatcher() *nullDispatcher {
+	d := &nullDispatcher{wake: make(chan struct{}, 1)}
+	d.space = sync.NewCond(&d.m)
+	go d.run()
+	return d
+}
+
+func (d *nullDispatcher) do(f func()) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.queue = append(d.queue, f)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks while backlog of dispatcher exceeds maxNullBacklog
+func (d *nullDispatcher) wait() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for len(d.queue) > maxNullBacklog && !d.closed {
+		d.space.Wait()
+	}
+}
+
+// close stops dispatcher once queued callbacks are run
+func (d *nullDispatcher) close() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if !d.closed {
+		d.closed = true
+		close(d.wake)
+		d.space.Broadcast()
+	}
+}
+
+func (d *nullDispatcher) run() {
+	for range d.wake {
+		for {
+			d.m.Lock()
+			if len(d.queue) == 0 {
+				d.m.Unlock()
+				break
+			}
+			f := d.queue[0]
+			d.queue = d.queue[1:]
+			d.space.Broadcast()
+			d.m.Unlock()
+			f()
+		}
+	}
+}
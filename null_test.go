@@ -0,0 +1,114 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func runNullClient(loopback bool) *Client {
+	client := NewNullClient(loopback)
+	go func() {
+		for client.Loop() {
+			select {
+			case <-client.Errors():
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	return client
+}
+
+func TestNullClient_loopback(t *testing.T) {
+	client := runNullClient(true)
+	defer client.Close()
+
+	q := &Queue{}
+	client.Declare([]Declaration{DeclareQueue(q)})
+	cons := NewConsumer(q)
+	client.Consume(cons)
+
+	confirms := make(chan amqp.Confirmation, 1)
+	pub := NewPublisher("", "", WithConfirmation(confirms))
+	client.Publish(pub)
+
+	// consumer may not be served yet
+	deadline := time.After(time.Second)
+	for {
+		q.l.Lock()
+		name := q.Name
+		q.l.Unlock()
+		if err := pub.PublishWithRoutingKey(amqp.Publishing{Body: []byte("hello")}, name); err == nil {
+			<-confirms
+		}
+
+		select {
+		case d := <-cons.Deliveries():
+			if string(d.Body) != "hello" || d.Ack(false) != nil {
+				t.Error("should loop publishing back", d)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("delivery timeout")
+		}
+	}
+}
+
+func TestNullClient_discard(t *testing.T) {
+	client := runNullClient(false)
+	defer client.Close()
+
+	cons := NewConsumer(&Queue{Name: "q1"})
+	client.Consume(cons)
+	pub := NewPublisher("", "q1")
+	client.Publish(pub)
+
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = pub.Publish(amqp.Publishing{}); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Error("publishing should be accepted", err)
+	}
+
+	select {
+	case <-cons.Deliveries():
+		t.Error("publishing should be discarded")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestNullDispatcher_backlog(t *testing.T) {
+	d := newNullDispatcher()
+	defer d.close()
+
+	release := make(chan struct{})
+	d.do(func() { <-release })
+	for i := 0; i <= maxNullBacklog; i++ {
+		d.do(func() {})
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		d.wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Error("should wait while backlog is exceeded")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Error("should stop waiting once backlog is run")
+	}
+}
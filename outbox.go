@@ -0,0 +1,142 @@
+package cony
+
+import (
+	"errors"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrUnconfirmedOutbox is returned by NewOutbox if its Publisher doesn't wait
+// for confirmations
+var ErrUnconfirmedOutbox = errors.New("Outbox requires Publisher with WithConfirmation and ConfirmTimeout options")
+
+// Outbox accepts publishings regardless of connection state, persisting them
+// in Store, and publishes them in order of acceptance with Publisher once it
+// is connected. Publishings are removed from Store once broker confirmed
+// them, so they are published at least once. Publishings left in Store by
+// previous process are flushed first.
+type Outbox struct {
+	pub   *Publisher
+	store Store
+	errs  chan error
+	wake  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewOutbox starts flushing store with pub, pub should be registered with
+// (*Client).Publish. pub should be created with WithConfirmation and
+// ConfirmTimeout options, so Publish returns once broker confirmed publishing
+func NewOutbox(pub *Publisher, store Store) (*Outbox, error) {
+	if pub.confirmChan == nil || pub.confirmTimeout <= 0 {
+		return nil, ErrUnconfirmedOutbox
+	}
+
+	o := &Outbox{
+		pub:   pub,
+		store: store,
+		errs:  make(chan error, 100),
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go o.flush()
+	return o, nil
+}
+
+// Publish persists publishing with default routing key of Publisher
+func (o *Outbox) Publish(pub amqp.Publishing) error {
+	return o.PublishWithRoutingKey(pub, o.pub.key)
+}
+
+// PublishWithRoutingKey persists publishing with routing key, it's published
+// later. Returns Store error only, doesn't wait for connection
+func (o *Outbox) PublishWithRoutingKey(pub amqp.Publishing, key string) error {
+	if _, err := o.store.Append(key, pub); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Errors returns Store and publishing errors. Default buffer size is 100.
+// Messages will be dropped in case if receiver can't keep up
+func (o *Outbox) Errors() <-chan error {
+	return o.errs
+}
+
+// Close stops flushing, waiting for publishing in progress. Publishing
+// blocked on missing connection is interrupted by (*Publisher).Cancel only
+func (o *Outbox) Close() {
+	select {
+	case <-o.stop:
+	default:
+		close(o.stop)
+	}
+	<-o.done
+}
+
+func (o *Outbox) flush() {
+	defer close(o.done)
+
+	for {
+		// publishings returned along with error are still published
+		pending, err := o.store.Pending()
+		o.reportErr(err)
+
+		for _, p := range pending {
+			if !o.publish(p) {
+				return
+			}
+		}
+
+		select {
+		case <-o.stop:
+			return
+		case <-o.wake:
+		}
+	}
+}
+
+// publish stored publishing, retrying till it's confirmed, publisher dies or
+// outbox is closed
+func (o *Outbox) publish(p StoredPublishing) bool {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-o.stop:
+			return false
+		default:
+		}
+
+		err := o.pub.PublishWithRoutingKey(p.Publishing, p.Key)
+		if err == nil {
+			o.reportErr(o.store.Remove(p.ID))
+			return true
+		}
+		if err == ErrPublisherDead {
+			return false
+		}
+		o.reportErr(err)
+
+		select {
+		case <-o.stop:
+			return false
+		case <-time.After(DefaultBackoff.Backoff(attempt)):
+		}
+	}
+}
+
+func (o *Outbox) reportErr(err error) bool {
+	if err != nil {
+		select {
+		case o.errs <- err:
+		default:
+		}
+		return true
+	}
+	return false
+}
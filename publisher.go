@@ -1,9 +1,12 @@
 package cony
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -15,27 +18,156 @@ var (
 	emptyErr         = atomErr{errors.New("noop")}
 )
 
+// PublisherError is reported to Publisher.Errors() for errors of publisher
+// channel, like PRECONDITION_FAILED closing it, and for returned mandatory
+// publishings, see PublishingReturned
+type PublisherError struct {
+	Exchange string
+	Key      string // routing key of returned publishing, publisher's one otherwise
+	Err      error
+}
+
+func (e PublisherError) Error() string {
+	return fmt.Sprintf("publisher %s/%s: %v", e.Exchange, e.Key, e.Err)
+}
+
+// Unwrap returns error of publisher channel
+func (e PublisherError) Unwrap() error {
+	return e.Err
+}
+
+// PublishingReturned is an error of publishing returned by broker, e.g.
+// unroutable mandatory publishing
+type PublishingReturned struct {
+	ReplyCode uint16
+	ReplyText string
+	MessageId string
+}
+
+func (e PublishingReturned) Error() string {
+	return fmt.Sprintf("publishing %s returned: %d %s", e.MessageId, e.ReplyCode, e.ReplyText)
+}
+
+// ConfirmationDropped is reported to Publisher.Errors() for confirmation
+// which didn't fit into confirmChan, see DropConfirmations
+type ConfirmationDropped struct {
+	DeliveryTag uint64
+	Ack         bool
+}
+
+func (e ConfirmationDropped) Error() string {
+	return fmt.Sprintf("confirmation %d dropped, confirmation channel is full", e.DeliveryTag)
+}
+
+// ErrPublisherNotRegistered is returned by publishing methods of nil
+// Publisher or one which wasn't passed to (*Client).Publish, see
+// AwaitRegistration
+var ErrPublisherNotRegistered = errors.New("Publisher is not registered with client")
+
+// ErrWouldBlock is returned from TryPublish if publishing can't be done right
+// away
+var ErrWouldBlock = errors.New("Publisher would block")
+
+// ErrNotTransactional is returned from TxPublish of Publisher created without
+// WithTransactions option
+var ErrNotTransactional = errors.New("Publisher is not transactional")
+
+// ErrTxConfirmConflict is returned by publishing methods of Publisher created
+// with both WithTransactions and WithConfirmation options, it's reported to
+// Errors() by NewPublisher as well
+var ErrTxConfirmConflict = errors.New("WithTransactions conflicts with WithConfirmation")
+
 // PublisherOpt is a functional option type for Publisher
 type PublisherOpt func(*Publisher)
 
 type publishMaybeErr struct {
-	pub chan amqp.Publishing
-	err chan error
-	key string
+	pub   chan amqp.Publishing
+	batch []amqp.Publishing // publishings of transaction, pub is not used
+	err   chan error
+	key   string
+	seq   chan uint64 // receives delivery tag of publishing, if not nil
 }
 
 type atomErr struct {
 	err error
 }
 
+// PublisherStats is a snapshot of Publisher counters
+type PublisherStats struct {
+	Published uint64 // messages written to channel
+	Confirmed uint64 // messages acked by broker, requires WithConfirmation
+	Nacked    uint64 // messages nacked by broker, requires WithConfirmation
+	Returned  uint64 // messages returned by broker, requires Mandatory
+	Failed    uint64 // messages failed to be written to channel
+	Blocked   int64  // publish calls currently waiting for channel
+	Dropped   uint64 // confirmations dropped, since confirmChan was full, requires DropConfirmations
+	Slow      uint64 // publish calls blocked longer than SlowPublishWarning threshold
+}
+
+// SlowPublish describes publish call blocked longer than threshold of
+// SlowPublishWarning
+type SlowPublish struct {
+	Exchange string
+	Key      string
+	Blocked  time.Duration
+}
+
+// publisherCounters are updated atomically, kept first in Publisher for
+// 64-bit alignment
+type publisherCounters struct {
+	published uint64
+	confirmed uint64
+	nacked    uint64
+	returned  uint64
+	failed    uint64
+	blocked   int64
+	sequence  uint64 // publishings tracked for confirmation across channels
+	dropped   uint64
+	slow      uint64
+}
+
 // Publisher hold definition for AMQP publishing
 type Publisher struct {
+	stats          publisherCounters
 	exchange       string
 	key            string
 	tmpl           amqp.Publishing
+	mergeTmpl      bool
 	pubChan        chan publishMaybeErr
 	stop           chan struct{}
 	confirmChan    chan amqp.Confirmation
+	dropConfirms   bool
+	flow           chan bool
+	errs           chan error
+	flowPaused     int32 // bool
+	up             readiness
+	reg            readiness // set by (*Client).Publish
+	awaitReg       bool
+	limiter        Limiter
+	codec          Codec
+	keyCodecs      map[string]Codec
+	compressSize   int
+	chunkSize      int
+	mandatory      bool
+	stampIDs       bool
+	priority       uint8
+	ttl            time.Duration
+	headers        []func() amqp.Table
+	slowAfter      time.Duration
+	slowWarn       func(SlowPublish)
+	tx             bool
+	optErr         error // conflict of options, fails every publishing
+	async          chan asyncPublishing
+	urgent         chan asyncPublishing // async publishings of PrioritizeAsync
+	urgentMin      uint8
+	republishing   bool
+	retry          []unconfirmed
+	retryTimer     *time.Timer
+	confirmTimeout time.Duration
+	tracker        *confirmTracker
+	opts           []PublisherOpt
+	ctx            context.Context
+	cancel         context.CancelFunc
 	dead           bool
 	m              sync.Mutex
 	lastChannelErr atomic.Value
@@ -49,9 +181,13 @@ type Publisher struct {
 // WARNING: this is blocking call, it will not return until connection is
 // available. The only way to stop it is to use Cancel() method.
 func (p *Publisher) Write(b []byte) (int, error) {
+	if p == nil {
+		return 0, ErrPublisherNotRegistered
+	}
 	pub := p.tmpl
+	pub.Headers = nil
 	pub.Body = b
-	return len(b), p.Publish(pub)
+	return len(b), p.publish(pub, p.key, p.tmpl.Headers)
 }
 
 // PublishWithRoutingKey used to publish custom amqp.Publishing and routing key
@@ -59,13 +195,314 @@ func (p *Publisher) Write(b []byte) (int, error) {
 // WARNING: this is blocking call, it will not return until connection is
 // available. The only way to stop it is to use Cancel() method.
 func (p *Publisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error {
+	return p.publish(pub, key, nil)
+}
+
+// publish prepares publishing on top of template headers and sends it
+func (p *Publisher) publish(pub amqp.Publishing, key string, tmpl amqp.Table) error {
+	if err := p.ready(); err != nil {
+		return err
+	}
+
+	pubs, err := p.prepare(pub, key, tmpl)
+	if err != nil {
+		return err
+	}
+
+	for _, pub := range pubs {
+		if err := p.send(pub, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TryPublish is like Publish, but returns ErrWouldBlock instead of waiting
+// for channel, for another publish in progress or for rate limiter to allow
+// it. Limiters with Allow() bool method are only asked once publisher is
+// ready to write, so no token is taken if TryPublish would block otherwise.
+// Limiters without it are waited for. Once first chunk of chunked publishing
+// is written, the rest are published blocking.
+func (p *Publisher) TryPublish(pub amqp.Publishing) error {
+	if p == nil || !p.registered() {
+		return ErrPublisherNotRegistered
+	}
 	if err := p.lastChannelErr.Load(); err != emptyErr {
-		if err == nil {
-			return errors.New("publisher is not initialized")
+		return ErrWouldBlock
+	}
+
+	a, allows := p.limiter.(allower)
+	if !allows {
+		if err := p.waitLimiter(); err != nil {
+			return err
+		}
+	}
+
+	pubs, err := p.prepare(pub, p.key, nil)
+	if err != nil {
+		return err
+	}
+
+	reqRepl := publishMaybeErr{
+		pub: make(chan amqp.Publishing, 2),
+		err: make(chan error, 2),
+		key: p.key,
+	}
+
+	select {
+	case <-p.stop:
+		return ErrPublisherDead
+	case p.pubChan <- reqRepl:
+	default:
+		return ErrWouldBlock
+	}
+
+	if allows && !a.Allow() {
+		close(reqRepl.pub) // serve loop gives up on envelope
+		return ErrWouldBlock
+	}
+	reqRepl.pub <- pubs[0]
+
+	if err := p.reply(reqRepl); err != nil {
+		return err
+	}
+
+	for _, pub := range pubs[1:] {
+		if err := p.send(pub, p.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TxPublish publishes pubs atomically in single AMQP transaction, either all
+// of them are published or none. Publisher should be created with
+// WithTransactions option.
+//
+// WARNING: this is blocking call, it will not return until connection is
+// available. The only way to stop it is to use Cancel() method.
+func (p *Publisher) TxPublish(pubs []amqp.Publishing) error {
+	if p == nil {
+		return ErrPublisherNotRegistered
+	}
+	if !p.tx {
+		return ErrNotTransactional
+	}
+
+	if err := p.ready(); err != nil {
+		return err
+	}
+
+	batch := make([]amqp.Publishing, 0, len(pubs))
+	for _, pub := range pubs {
+		prepared, err := p.prepare(pub, p.key, nil)
+		if err != nil {
+			return err
 		}
+		batch = append(batch, prepared...)
+	}
+
+	return p.deliver(publishMaybeErr{
+		batch: batch,
+		err:   make(chan error, 2),
+		key:   p.key,
+	})
+}
+
+// ready checks registration and channel state and waits for rate limiter.
+// Registered publisher which isn't served yet waits for channel in send
+func (p *Publisher) ready() error {
+	if p == nil {
+		return ErrPublisherNotRegistered
+	}
+	if p.optErr != nil {
+		return p.optErr
+	}
+	if err := p.waitRegistration(); err != nil {
+		return err
+	}
+	if err := p.lastChannelErr.Load(); err != nil && err != emptyErr {
 		return err.(atomErr).err
 	}
 
+	return p.waitLimiter()
+}
+
+// registered reports whether publisher was passed to (*Client).Publish
+func (p *Publisher) registered() bool {
+	select {
+	case <-p.reg.wait():
+		return true
+	default:
+		return false
+	}
+}
+
+// waitRegistration returns ErrPublisherNotRegistered if publisher isn't
+// registered, unless AwaitRegistration option is set, then it waits for
+// registration. Returns ErrPublisherDead if publisher is cancelled while
+// waiting
+func (p *Publisher) waitRegistration() error {
+	if p.registered() {
+		return nil
+	}
+	if !p.awaitReg {
+		return ErrPublisherNotRegistered
+	}
+	select {
+	case <-p.reg.wait():
+		return nil
+	case <-p.stop:
+		return ErrPublisherDead
+	}
+}
+
+// waitLimiter waits for rate limiter, if any. Returns ErrPublisherDead if
+// publisher is cancelled while waiting, error of limiter otherwise
+func (p *Publisher) waitLimiter() error {
+	if p.limiter == nil {
+		return nil
+	}
+	if err := p.limiter.Wait(p.ctx); err != nil {
+		if p.ctx.Err() != nil {
+			return ErrPublisherDead
+		}
+		return err
+	}
+	return nil
+}
+
+// prepare stamps, compresses and splits publishing to routing key into chunks
+// according to publisher options. tmpl are template headers, overridden by
+// dynamic ones
+func (p *Publisher) prepare(pub amqp.Publishing, key string, tmpl amqp.Table) ([]amqp.Publishing, error) {
+	if p.mergeTmpl {
+		pub = mergeTemplate(p.tmpl, pub)
+		tmpl = p.tmpl.Headers
+	}
+
+	if p.stampIDs && pub.MessageId == "" {
+		pub.MessageId = newUUID()
+	}
+
+	if pub.Priority == 0 {
+		pub.Priority = p.priority
+	}
+
+	if len(p.headers) > 0 || len(tmpl) > 0 {
+		pub.Headers = p.stampHeaders(tmpl, pub.Headers)
+	}
+
+	if p.ttl > 0 {
+		pub = stampTTL(pub, p.ttl, time.Now())
+	}
+
+	pub, err := p.encode(pub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.chunkSize > 0 && len(pub.Body) > p.chunkSize {
+		return split(pub, p.chunkSize), nil
+	}
+	return []amqp.Publishing{pub}, nil
+}
+
+// mergeTemplate sets properties unset in publishing to the ones of template,
+// headers are merged later by stampHeaders
+func mergeTemplate(tmpl, pub amqp.Publishing) amqp.Publishing {
+	str := func(v *string, t string) {
+		if *v == "" {
+			*v = t
+		}
+	}
+	str(&pub.ContentType, tmpl.ContentType)
+	str(&pub.ContentEncoding, tmpl.ContentEncoding)
+	str(&pub.CorrelationId, tmpl.CorrelationId)
+	str(&pub.ReplyTo, tmpl.ReplyTo)
+	str(&pub.Expiration, tmpl.Expiration)
+	str(&pub.MessageId, tmpl.MessageId)
+	str(&pub.Type, tmpl.Type)
+	str(&pub.UserId, tmpl.UserId)
+	str(&pub.AppId, tmpl.AppId)
+	if pub.DeliveryMode == 0 {
+		pub.DeliveryMode = tmpl.DeliveryMode
+	}
+	if pub.Priority == 0 {
+		pub.Priority = tmpl.Priority
+	}
+	if pub.Timestamp.IsZero() {
+		pub.Timestamp = tmpl.Timestamp
+	}
+	return pub
+}
+
+// stampHeaders merges template headers, headers computed by PublishHeaders
+// options and headers set on publishing into new table, in that order of
+// precedence from lowest
+func (p *Publisher) stampHeaders(tmpl, headers amqp.Table) amqp.Table {
+	merged := amqp.Table{}
+	for k, v := range tmpl {
+		merged[k] = v
+	}
+	for _, f := range p.headers {
+		for k, v := range f() {
+			merged[k] = v
+		}
+	}
+	for k, v := range headers {
+		merged[k] = v
+	}
+	return merged
+}
+
+// PublishTracked is like Publish, but returns delivery tag of publishing,
+// matching the one of its confirmation passed to WithConfirmation channel.
+// It's the tag of the last chunk for chunked publishings, 0 if publisher
+// doesn't track confirmations or publishing wasn't written to channel.
+//
+// WARNING: this is blocking call, it will not return until connection is
+// available. The only way to stop it is to use Cancel() method.
+func (p *Publisher) PublishTracked(pub amqp.Publishing) (uint64, error) {
+	if err := p.ready(); err != nil {
+		return 0, err
+	}
+
+	pubs, err := p.prepare(pub, p.key, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var tag uint64
+	for _, pub := range pubs {
+		reqRepl := publishMaybeErr{
+			pub: make(chan amqp.Publishing, 2),
+			err: make(chan error, 2),
+			key: p.key,
+			seq: make(chan uint64, 1),
+		}
+		reqRepl.pub <- pub
+		err := p.deliver(reqRepl)
+		select {
+		case tag = <-reqRepl.seq:
+		default:
+		}
+		if err != nil {
+			return tag, err
+		}
+	}
+	return tag, nil
+}
+
+// NextPublishSeqNo returns delivery tag the next publishing written to
+// channel gets, if publisher tracks confirmations. It's only exact if
+// publisher isn't used concurrently, see PublishTracked otherwise.
+// Republished publishings get new tags as well.
+func (p *Publisher) NextPublishSeqNo() uint64 {
+	return atomic.LoadUint64(&p.stats.sequence) + 1
+}
+
+func (p *Publisher) send(pub amqp.Publishing, key string) error {
 	reqRepl := publishMaybeErr{
 		pub: make(chan amqp.Publishing, 2),
 		err: make(chan error, 2),
@@ -73,6 +510,16 @@ func (p *Publisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error
 	}
 
 	reqRepl.pub <- pub
+	return p.deliver(reqRepl)
+}
+
+// deliver passes request to serve loop and waits for reply
+func (p *Publisher) deliver(reqRepl publishMaybeErr) error {
+	atomic.AddInt64(&p.stats.blocked, 1)
+	defer atomic.AddInt64(&p.stats.blocked, -1)
+	if p.slowWarn != nil {
+		defer p.watchSlow(reqRepl.key).Stop()
+	}
 
 	select {
 	case <-p.stop:
@@ -80,9 +527,50 @@ func (p *Publisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error
 		return ErrPublisherDead
 	case p.pubChan <- reqRepl:
 	}
+	return p.reply(reqRepl)
+}
+
+// watchSlow starts timer warning about publish call blocked longer than
+// threshold, stopped once call returns
+func (p *Publisher) watchSlow(key string) *time.Timer {
+	return time.AfterFunc(p.slowAfter, func() {
+		atomic.AddUint64(&p.stats.slow, 1)
+		p.slowWarn(SlowPublish{Exchange: p.exchange, Key: key, Blocked: p.slowAfter})
+	})
+}
 
-	err := <-reqRepl.err
-	return err
+// reply waits for result of request passed to serve loop. Publish waiting for
+// confirmation returns ErrPublisherDead once publisher is cancelled
+func (p *Publisher) reply(reqRepl publishMaybeErr) error {
+	select {
+	case err := <-reqRepl.err:
+		return err
+	case <-p.stop:
+		select {
+		case err := <-reqRepl.err:
+			return err
+		default:
+			return ErrPublisherDead
+		}
+	}
+}
+
+func (p *Publisher) encode(pub amqp.Publishing, key string) (amqp.Publishing, error) {
+	codec := p.codec
+	if keyCodec, ok := p.keyCodecs[key]; ok {
+		codec = keyCodec
+	}
+	if codec == nil || pub.ContentEncoding != "" || len(pub.Body) < p.compressSize {
+		return pub, nil
+	}
+
+	body, err := codec.Encode(pub.Body)
+	if err != nil {
+		return pub, err
+	}
+	pub.Body = body
+	pub.ContentEncoding = codec.Encoding()
+	return pub, nil
 }
 
 // Publish used to publish custom amqp.Publishing
@@ -90,32 +578,164 @@ func (p *Publisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error
 // WARNING: this is blocking call, it will not return until connection is
 // available. The only way to stop it is to use Cancel() method.
 func (p *Publisher) Publish(pub amqp.Publishing) error {
+	if p == nil {
+		return ErrPublisherNotRegistered
+	}
 	return p.PublishWithRoutingKey(pub, p.key)
 }
 
+// forwardConfirm passes confirmation to confirmChan, waiting for receiver
+// unless DropConfirmations is set. Called by serve loop only
+func (p *Publisher) forwardConfirm(c amqp.Confirmation) {
+	if !p.dropConfirms {
+		select {
+		case p.confirmChan <- c:
+		case <-p.stop:
+		}
+		return
+	}
+	select {
+	case p.confirmChan <- c:
+	default:
+		atomic.AddUint64(&p.stats.dropped, 1)
+		p.reportErr(p.key, ConfirmationDropped{DeliveryTag: c.DeliveryTag, Ack: c.Ack})
+	}
+}
+
+// Errors returns errors of publisher channels and returned publishings,
+// wrapped into PublisherError. Default buffer size is 100, errors are dropped
+// in case if receiver can't keep up
+func (p *Publisher) Errors() <-chan error {
+	return p.errs
+}
+
+func (p *Publisher) reportErr(key string, err error) {
+	select {
+	case p.errs <- PublisherError{Exchange: p.exchange, Key: key, Err: err}:
+	default:
+	}
+}
+
+// Flow notifies channel.flow requests of broker, false means broker asked to
+// pause publishing, true to resume. Default buffer size is 10. The oldest
+// notifications are dropped in case if receiver can't keep up, so the latest
+// one is always delivered. See also FlowActive
+func (p *Publisher) Flow() <-chan bool {
+	return p.flow
+}
+
+// FlowActive reports current flow state of publisher channel, false if broker
+// asked to pause publishing
+func (p *Publisher) FlowActive() bool {
+	return atomic.LoadInt32(&p.flowPaused) == 0
+}
+
+// notifyFlow records flow state and passes it to Flow channel, dropping the
+// oldest notification if it's full. Called by serve loop only
+func (p *Publisher) notifyFlow(active bool) {
+	paused := int32(1)
+	if active {
+		paused = 0
+	}
+	atomic.StoreInt32(&p.flowPaused, paused)
+
+	for {
+		select {
+		case p.flow <- active:
+			return
+		default:
+		}
+		select {
+		case <-p.flow:
+		default:
+		}
+	}
+}
+
+// Stats returns snapshot of publisher counters
+func (p *Publisher) Stats() PublisherStats {
+	return PublisherStats{
+		Published: atomic.LoadUint64(&p.stats.published),
+		Confirmed: atomic.LoadUint64(&p.stats.confirmed),
+		Nacked:    atomic.LoadUint64(&p.stats.nacked),
+		Returned:  atomic.LoadUint64(&p.stats.returned),
+		Failed:    atomic.LoadUint64(&p.stats.failed),
+		Blocked:   atomic.LoadInt64(&p.stats.blocked),
+		Dropped:   atomic.LoadUint64(&p.stats.dropped),
+		Slow:      atomic.LoadUint64(&p.stats.slow),
+	}
+}
+
 // Cancel this publisher
 func (p *Publisher) Cancel() {
 	p.m.Lock()
-	defer p.m.Unlock()
+	if p.dead {
+		p.m.Unlock()
+		return
+	}
+	close(p.stop)
+	p.dead = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+	retry := p.retry
+	p.retry = nil
+	p.m.Unlock()
 
-	if !p.dead {
-		close(p.stop)
-		p.dead = true
+	// callbacks are called without lock, they could use publisher
+	p.drainAsync()
+	for _, u := range retry {
+		u.res.settle(ErrPublisherDead)
 	}
 }
 
 func (p *Publisher) serve(client owner, ch mqChannel) {
 	p.lastChannelErr.Store(emptyErr)
+	p.up.set(true)
+	defer p.up.set(false)
 	chanErrs := make(chan *amqp.Error)
 	ch.NotifyClose(chanErrs)
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	flows := ch.NotifyFlow(make(chan bool, 1))
+	if !p.FlowActive() {
+		// flow of previous channel doesn't apply to new one
+		p.notifyFlow(true)
+	}
 
-	if p.confirmChan != nil {
+	if p.tx {
+		if err := ch.Tx(); err != nil {
+			p.reportErr(p.key, err)
+		}
+	}
+
+	var (
+		confirms chan amqp.Confirmation
+		tracker  *confirmTracker
+	)
+	if p.confirmChan != nil && p.optErr == nil {
 		if err := ch.Confirm(false); err != nil {
-			client.reportErr(err)
+			p.reportErr(p.key, err)
 		} else {
-			p.confirmChan = ch.NotifyPublish(p.confirmChan)
+			confirms = ch.NotifyPublish(make(chan amqp.Confirmation, cap(p.confirmChan)))
+			tracker = newConfirmTracker(p.republishing, p.confirmTimeout, &p.stats.sequence)
 		}
+	}
+	p.m.Lock()
+	p.tracker = tracker
+	p.m.Unlock()
 
+	var expiry <-chan time.Time
+	if tracker != nil && p.confirmTimeout > 0 {
+		// publishing expires in [timeout, 1.5*timeout)
+		ticker := time.NewTicker(p.confirmTimeout/2 + 1)
+		defer ticker.Stop()
+		expiry = ticker.C
+	}
+
+	if tracker != nil {
+		for _, u := range p.takeRetry() {
+			p.republish(ch, u, tracker)
+		}
 	}
 
 	for {
@@ -123,29 +743,135 @@ func (p *Publisher) serve(client owner, ch mqChannel) {
 		case <-p.stop:
 			client.deletePublisher(p)
 			ch.Close()
+			tracker.fail(ErrPublisherDead)
 			return
 		case err := <-chanErrs:
+			if p.republishing {
+				p.retryLater(tracker.detach())
+			}
 			if err != nil {
 				p.lastChannelErr.Store(atomErr{err})
+				p.reportErr(p.key, err)
+				tracker.fail(err)
+			} else {
+				tracker.fail(amqp.ErrClosed)
 			}
 			return
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			if u, nacked := tracker.confirm(c); nacked {
+				p.republish(ch, u, tracker)
+			}
+			if c.Ack {
+				atomic.AddUint64(&p.stats.confirmed, 1)
+			} else {
+				atomic.AddUint64(&p.stats.nacked, 1)
+			}
+			// delivery tags of channel continue sequence of previous ones
+			c.DeliveryTag += tracker.base
+			p.forwardConfirm(c)
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			atomic.AddUint64(&p.stats.returned, 1)
+			p.reportErr(r.RoutingKey, PublishingReturned{
+				ReplyCode: r.ReplyCode,
+				ReplyText: r.ReplyText,
+				MessageId: r.MessageId,
+			})
+		case active, ok := <-flows:
+			if !ok {
+				flows = nil
+				continue
+			}
+			p.notifyFlow(active)
+		case now := <-expiry:
+			tracker.expire(now)
+		case a := <-p.urgent:
+			p.publishAsync(ch, a, tracker)
+		case a := <-p.async:
+			p.publishUrgent(ch, tracker)
+			p.publishAsync(ch, a, tracker)
 		case envelop := <-p.pubChan:
-			msg := <-envelop.pub
+			if p.tx {
+				p.publishTx(ch, envelop)
+				continue
+			}
+			msg, ok := <-envelop.pub
+			if !ok {
+				close(envelop.err)
+				continue
+			}
 			close(envelop.pub)
 			if err := ch.Publish(
 				p.exchange,  // exchange
 				envelop.key, // key
-				false,       // mandatory
+				p.mandatory, // mandatory
 				false,       // immediate
 				msg,         // msg amqp.Publishing
 			); err != nil {
+				atomic.AddUint64(&p.stats.failed, 1)
 				envelop.err <- err
+			} else {
+				atomic.AddUint64(&p.stats.published, 1)
+				u := unconfirmed{msg: msg, key: envelop.key}
+				wait := p.confirmTimeout > 0 && tracker != nil
+				if wait {
+					// publish call waits for confirmation
+					u.res = &asyncResult{remaining: 1, done: func(err error) {
+						envelop.err <- err
+						close(envelop.err)
+					}}
+				}
+				if tag := tracker.published(u); envelop.seq != nil {
+					envelop.seq <- tag
+				}
+				if wait {
+					continue
+				}
 			}
 			close(envelop.err)
 		}
 	}
 }
 
+// publishTx publishes envelope in transaction, single publishings of
+// transactional publisher are committed one by one
+func (p *Publisher) publishTx(ch mqChannel, envelop publishMaybeErr) {
+	defer close(envelop.err)
+
+	msgs := envelop.batch
+	if msgs == nil {
+		msg, ok := <-envelop.pub
+		if !ok {
+			return
+		}
+		msgs = []amqp.Publishing{msg}
+		close(envelop.pub)
+	}
+
+	for _, msg := range msgs {
+		if err := ch.Publish(p.exchange, envelop.key, p.mandatory, false, msg); err != nil {
+			_ = ch.TxRollback()
+			atomic.AddUint64(&p.stats.failed, uint64(len(msgs)))
+			envelop.err <- err
+			return
+		}
+	}
+
+	if err := ch.TxCommit(); err != nil {
+		atomic.AddUint64(&p.stats.failed, uint64(len(msgs)))
+		envelop.err <- err
+		return
+	}
+	atomic.AddUint64(&p.stats.published, uint64(len(msgs)))
+}
+
 // NewPublisher is a Publisher constructor
 func NewPublisher(exchange string, key string, opts ...PublisherOpt) *Publisher {
 	p := &Publisher{
@@ -153,23 +879,175 @@ func NewPublisher(exchange string, key string, opts ...PublisherOpt) *Publisher
 		key:      key,
 		pubChan:  make(chan publishMaybeErr),
 		stop:     make(chan struct{}),
+		async:    make(chan asyncPublishing, asyncBuffer),
+		flow:     make(chan bool, 10),
+		errs:     make(chan error, 100),
+		opts:     opts,
 	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	for _, o := range opts {
 		o(p)
 	}
+	if p.tx && p.confirmChan != nil {
+		p.optErr = ErrTxConfirmConflict
+		p.reportErr(p.key, p.optErr)
+	}
 	return p
 }
 
+// Clone returns fresh Publisher with the same exchange, key and options.
+// Cancelled publisher can't be used again, clone it and pass to
+// (*Client).Publish to resume publishing.
+func (p *Publisher) Clone() *Publisher {
+	return NewPublisher(p.exchange, p.key, p.opts...)
+}
+
 // PublishingTemplate Publisher's functional option. Provide template
-// amqp.Publishing and save typing.
+// amqp.Publishing and save typing. It's used by Write, see MergeTemplate for
+// other publish methods.
 func PublishingTemplate(t amqp.Publishing) PublisherOpt {
 	return func(p *Publisher) {
 		p.tmpl = t
 	}
 }
 
+// MergeTemplate Publisher's functional option. Properties left unset in
+// publishings passed to Publish, PublishAsync and alike are taken from
+// PublishingTemplate, headers of template are merged with the ones of
+// publishing, which take precedence. Without it template is only used by
+// Write.
+func MergeTemplate() PublisherOpt {
+	return func(p *Publisher) {
+		p.mergeTmpl = true
+	}
+}
+
+// PublishHeaders Publisher's functional option. headers is called for every
+// publishing and its result is merged into publishing headers, e.g. to stamp
+// request ID or publish time. Dynamic headers override the ones of
+// PublishingTemplate, headers set on publishing itself take precedence.
+func PublishHeaders(headers func() amqp.Table) PublisherOpt {
+	return func(p *Publisher) {
+		p.headers = append(p.headers, headers)
+	}
+}
+
+// SlowPublishWarning Publisher's functional option. warn is called once for
+// every publish call blocked for longer than threshold waiting for channel
+// or confirmation, e.g. to log it or update metrics. It's called in its own
+// goroutine while publish call is still blocked, such calls are counted in
+// Stats.
+func SlowPublishWarning(threshold time.Duration, warn func(SlowPublish)) PublisherOpt {
+	return func(p *Publisher) {
+		p.slowAfter = threshold
+		p.slowWarn = warn
+	}
+}
+
+// AwaitRegistration Publisher's functional option. Publishing methods of
+// publisher not passed to (*Client).Publish yet wait for it, instead of
+// returning ErrPublisherNotRegistered, e.g. when publisher is handed out
+// before client is set up
+func AwaitRegistration() PublisherOpt {
+	return func(p *Publisher) {
+		p.awaitReg = true
+	}
+}
+
+// Mandatory Publisher's functional option. Messages are published with
+// mandatory flag, unroutable ones are returned by broker and counted in Stats
+func Mandatory() PublisherOpt {
+	return func(p *Publisher) {
+		p.mandatory = true
+	}
+}
+
+// WithConfirmation Publisher's functional option. Puts channel into confirm
+// mode, broker confirmations are delivered to confirmChan. Delivery tags keep
+// growing across reconnects, tags of publishings not confirmed before channel
+// was closed are skipped. Since the same confirmChan is used across channels,
+// it's not closed when channel closes. confirmChan should be drained, as
+// publisher channel waits for receiver, unless DropConfirmations is set.
 func WithConfirmation(confirmChan chan amqp.Confirmation) PublisherOpt {
 	return func(p *Publisher) {
 		p.confirmChan = confirmChan
 	}
 }
+
+// DropConfirmations Publisher's functional option. Confirmations which don't
+// fit into buffer of WithConfirmation channel are dropped instead of waiting
+// for receiver, they're counted in Stats and reported to Errors() as
+// ConfirmationDropped
+func DropConfirmations() PublisherOpt {
+	return func(p *Publisher) {
+		p.dropConfirms = true
+	}
+}
+
+// PublishRateLimit Publisher's functional option. Limits publishing to rate
+// messages per second, allowing bursts of up to burst messages. Publish calls
+// above the limit are blocked until allowed.
+func PublishRateLimit(rate float64, burst int) PublisherOpt {
+	return PublishLimiter(newTokenBucket(rate, burst))
+}
+
+// PublishLimiter Publisher's functional option. Same as PublishRateLimit, but
+// accepts custom Limiter, e.g. *rate.Limiter
+func PublishLimiter(l Limiter) PublisherOpt {
+	return func(p *Publisher) {
+		p.limiter = l
+	}
+}
+
+// Compression Publisher's functional option. Bodies of minSize bytes and
+// bigger are compressed with codec, e.g. Gzip, Zstd or Snappy,
+// ContentEncoding is set accordingly. Publishings with ContentEncoding
+// already set are not touched.
+func Compression(codec Codec, minSize int) PublisherOpt {
+	return func(p *Publisher) {
+		p.codec = codec
+		p.compressSize = minSize
+	}
+}
+
+// CompressionFor Publisher's functional option. Publishings to routing key
+// are compressed with codec instead of the one of Compression option, e.g.
+// one consumers of destination queue could decode. nil codec disables
+// compression for key. minSize of Compression applies.
+func CompressionFor(key string, codec Codec) PublisherOpt {
+	return func(p *Publisher) {
+		if p.keyCodecs == nil {
+			p.keyCodecs = make(map[string]Codec)
+		}
+		p.keyCodecs[key] = codec
+	}
+}
+
+// Chunking Publisher's functional option. Bodies bigger than size bytes are
+// split into chunks published one by one, consumer should use Reassemble
+// option to receive them as single delivery.
+func Chunking(size int) PublisherOpt {
+	return func(p *Publisher) {
+		p.chunkSize = size
+	}
+}
+
+// WithTransactions Publisher's functional option. Channel of publisher is put
+// into transactional mode, every publishing is committed by broker before
+// Publish returns, TxPublish could be used to publish several messages
+// atomically. It's much slower than WithConfirmation and can't be combined
+// with it, publishings of such publisher fail with ErrTxConfirmConflict.
+func WithTransactions() PublisherOpt {
+	return func(p *Publisher) {
+		p.tx = true
+	}
+}
+
+// WithPriority Publisher's functional option. Publishings without Priority
+// set get priority, queue should be declared with MaxPriority for it to
+// take effect.
+func WithPriority(priority uint8) PublisherOpt {
+	return func(p *Publisher) {
+		p.priority = priority
+	}
+}
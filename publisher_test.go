@@ -2,9 +2,13 @@ package cony
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -254,6 +258,152 @@ func TestPublisher_serve_errors(t *testing.T) {
 	}
 }
 
+func TestPublisher_Stats(t *testing.T) {
+	var (
+		runSync   = make(chan bool)
+		confirmed = make(chan amqp.Confirmation, 1)
+		confirms  chan amqp.Confirmation
+		returns   chan amqp.Return
+		fail      bool
+	)
+
+	p := newTestPublisher(WithConfirmation(confirmed), DropConfirmations(), Mandatory())
+	cli := &mqDeleterTest{
+		_deletePublisher: func(*Publisher) {},
+	}
+
+	ch1 := &mqChannelTest{
+		_Close: func() error {
+			return nil
+		},
+		_NotifyClose: func(errChan chan *amqp.Error) chan *amqp.Error {
+			return errChan
+		},
+		_Confirm: func(bool) error {
+			return nil
+		},
+		_NotifyPublish: func(c chan amqp.Confirmation) chan amqp.Confirmation {
+			confirms = c
+			return c
+		},
+		_NotifyReturn: func(c chan amqp.Return) chan amqp.Return {
+			returns = c
+			return c
+		},
+		_Publish: func(ex string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
+			if !mandatory {
+				t.Error("should publish with mandatory flag")
+			}
+			if fail {
+				return errors.New("pub err")
+			}
+			return nil
+		},
+	}
+
+	go func() {
+		<-runSync
+		p.serve(cli, ch1)
+		runSync <- true
+	}()
+
+	runSync <- true
+	p.Write([]byte("test1"))
+	fail = true
+	p.Write([]byte("test2"))
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	<-confirmed
+	returns <- amqp.Return{}
+	for i := 0; i < 100 && p.Stats().Returned == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	// nobody receives confirmations, second one doesn't fit into buffer
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	for i := 0; i < 100 && p.Stats().Dropped == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	p.Cancel()
+	<-runSync
+
+	stats := p.Stats()
+	if stats.Published != 1 || stats.Failed != 1 {
+		t.Error("should count published and failed messages", stats)
+	}
+
+	if stats.Confirmed != 3 || stats.Nacked != 0 || stats.Dropped != 1 {
+		t.Error("should count confirmations", stats)
+	}
+
+	var dropped bool
+	for len(p.errs) > 0 {
+		err := (<-p.errs).(PublisherError)
+		if e, ok := err.Err.(ConfirmationDropped); ok && e.DeliveryTag == 3 {
+			dropped = true
+		}
+	}
+	if !dropped {
+		t.Error("should report dropped confirmation")
+	}
+
+	if stats.Returned != 1 {
+		t.Error("should count returns", stats)
+	}
+
+	if stats.Blocked != 0 {
+		t.Error("should not have blocked calls", stats)
+	}
+}
+
+func TestPublisher_confirmationsWait(t *testing.T) {
+	var (
+		runSync   = make(chan bool)
+		confirmed = make(chan amqp.Confirmation)
+		confirms  = make(chan chan amqp.Confirmation, 1)
+	)
+
+	p := newTestPublisher(WithConfirmation(confirmed))
+	cli := &mqDeleterTest{
+		_deletePublisher: func(*Publisher) {},
+	}
+	ch1 := &mqChannelTest{
+		_Close: func() error {
+			return nil
+		},
+		_Confirm: func(bool) error {
+			return nil
+		},
+		_NotifyPublish: func(c chan amqp.Confirmation) chan amqp.Confirmation {
+			confirms <- c
+			return c
+		},
+	}
+
+	go func() {
+		p.serve(cli, ch1)
+		runSync <- true
+	}()
+
+	c := <-confirms
+	go func() {
+		// confirmChan isn't drained yet, publisher channel waits
+		c <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+		c <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	for tag := uint64(1); tag <= 2; tag++ {
+		if got := <-confirmed; got.DeliveryTag != tag {
+			t.Error("should deliver every confirmation", got)
+		}
+	}
+	if p.Stats().Dropped != 0 {
+		t.Error("should not drop confirmations by default")
+	}
+
+	p.Cancel()
+	<-runSync
+}
+
 func TestNewPublisher(t *testing.T) {
 	var called bool
 
@@ -309,6 +459,59 @@ func TestPublisher_PublishWithStop(t *testing.T) {
 	}
 }
 
+func TestPublisher_notRegistered(t *testing.T) {
+	p := NewPublisher("", "q1")
+	if err := p.Publish(amqp.Publishing{}); err != ErrPublisherNotRegistered {
+		t.Error("Publish should return", ErrPublisherNotRegistered, err)
+	}
+	if err := p.TryPublish(amqp.Publishing{}); err != ErrPublisherNotRegistered {
+		t.Error("TryPublish should return", ErrPublisherNotRegistered, err)
+	}
+
+	var nilPub *Publisher
+	if _, err := nilPub.Write([]byte("test")); err != ErrPublisherNotRegistered {
+		t.Error("Write of nil publisher should return", ErrPublisherNotRegistered, err)
+	}
+	if err := nilPub.Publish(amqp.Publishing{}); err != ErrPublisherNotRegistered {
+		t.Error("Publish of nil publisher should return", ErrPublisherNotRegistered, err)
+	}
+
+	var got []error
+	p.PublishAsync(amqp.Publishing{}, func(err error) { got = append(got, err) })
+	nilPub.PublishAsync(amqp.Publishing{}, func(err error) { got = append(got, err) })
+	if len(got) != 2 || got[0] != ErrPublisherNotRegistered || got[1] != ErrPublisherNotRegistered {
+		t.Error("PublishAsync should fail right away", got)
+	}
+	if len(p.async) != 0 {
+		t.Error("should not queue publishings of unregistered publisher")
+	}
+}
+
+func TestAwaitRegistration(t *testing.T) {
+	p := NewPublisher("", "q1", AwaitRegistration())
+	go p.Cancel()
+	if err := p.Publish(amqp.Publishing{}); err != ErrPublisherDead {
+		t.Error("should wait for registration until cancelled", err)
+	}
+
+	p = NewPublisher("", "q1", AwaitRegistration())
+	queued := make(chan struct{})
+	go func() {
+		p.PublishAsync(amqp.Publishing{}, nil)
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Error("PublishAsync should wait for registration")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.reg.set(true)
+	<-queued
+	if len(p.async) != 1 {
+		t.Error("should queue publishing once registered")
+	}
+}
+
 func TestPublisher_Write(t *testing.T) {
 	var ok bool
 	testBuf := []byte("test1")
@@ -341,6 +544,80 @@ func TestPublisher_Write(t *testing.T) {
 	}
 }
 
+func TestPublisher_PublishWithLimiterStop(t *testing.T) {
+	p := newTestPublisher(PublishRateLimit(0.001, 1))
+	p.limiter.Wait(p.ctx) // drain burst
+	p.Cancel()
+
+	if err := p.Publish(amqp.Publishing{}); err != ErrPublisherDead {
+		t.Error("Publish should receive", ErrPublisherDead)
+	}
+}
+
+type failingLimiter struct{ err error }
+
+func (l failingLimiter) Wait(context.Context) error { return l.err }
+
+func TestPublisher_PublishWithLimiterError(t *testing.T) {
+	burstErr := errors.New("rate: Wait(n=1) exceeds limiter's burst 0")
+	p := newTestPublisher(PublishLimiter(failingLimiter{burstErr}))
+	p.lastChannelErr.Store(emptyErr)
+
+	if err := p.Publish(amqp.Publishing{}); err != burstErr {
+		t.Error("Publish should receive limiter error", err)
+	}
+}
+
+func TestPublisher_TryPublishKeepsToken(t *testing.T) {
+	p := newTestPublisher(PublishRateLimit(0.001, 1))
+	p.lastChannelErr.Store(emptyErr)
+
+	if err := p.TryPublish(amqp.Publishing{}); err != ErrWouldBlock {
+		t.Error("should not wait for serve loop", err)
+	}
+
+	if !p.limiter.(allower).Allow() {
+		t.Error("token should not be taken by blocked TryPublish")
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	p := newTestPublisher(PublishRateLimit(10, 1))
+
+	if p.limiter == nil {
+		t.Error("PublishRateLimit() should set limiter")
+	}
+}
+
+func TestPublisher_encode(t *testing.T) {
+	p := newTestPublisher(Compression(Gzip, 10), CompressionFor("snappy.key", Snappy), CompressionFor("plain.key", nil))
+
+	small, _ := p.encode(amqp.Publishing{Body: []byte("small")}, p.key)
+	if small.ContentEncoding != "" {
+		t.Error("should not compress small bodies")
+	}
+
+	big, err := p.encode(amqp.Publishing{Body: bytes.Repeat([]byte("big"), 10)}, p.key)
+	if err != nil || big.ContentEncoding != "gzip" {
+		t.Error("should compress big bodies")
+	}
+
+	encoded, _ := p.encode(amqp.Publishing{ContentEncoding: "br", Body: bytes.Repeat([]byte("big"), 10)}, p.key)
+	if encoded.ContentEncoding != "br" {
+		t.Error("should not compress already encoded bodies")
+	}
+
+	snappy, err := p.encode(amqp.Publishing{Body: bytes.Repeat([]byte("big"), 10)}, "snappy.key")
+	if err != nil || snappy.ContentEncoding != "snappy" {
+		t.Error("should compress with codec of routing key", snappy.ContentEncoding)
+	}
+
+	plain, _ := p.encode(amqp.Publishing{Body: bytes.Repeat([]byte("big"), 10)}, "plain.key")
+	if plain.ContentEncoding != "" {
+		t.Error("should not compress for routing key without codec")
+	}
+}
+
 func TestPublishingTemplate(t *testing.T) {
 	p := newTestPublisher()
 	pub := amqp.Publishing{AppId: "ololoapp"}
@@ -352,6 +629,360 @@ func TestPublishingTemplate(t *testing.T) {
 	}
 }
 
+func TestMergeTemplate(t *testing.T) {
+	tmpl := amqp.Publishing{
+		AppId:        "app",
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Headers:      amqp.Table{"a": "tmpl", "b": "tmpl"},
+	}
+	pub := amqp.Publishing{ContentType: "text/plain", Headers: amqp.Table{"b": "pub"}, Body: []byte("x")}
+
+	p := newTestPublisher(PublishingTemplate(tmpl), MergeTemplate())
+	pubs, err := p.prepare(pub, p.key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := pubs[0]
+	if merged.AppId != "app" || merged.DeliveryMode != amqp.Persistent {
+		t.Error("unset properties should be taken from template", merged)
+	}
+	if merged.ContentType != "text/plain" || string(merged.Body) != "x" {
+		t.Error("properties of publishing should take precedence", merged)
+	}
+	if merged.Headers["a"] != "tmpl" || merged.Headers["b"] != "pub" {
+		t.Error("headers should be merged", merged.Headers)
+	}
+
+	p = newTestPublisher(PublishingTemplate(tmpl))
+	pubs, _ = p.prepare(pub, p.key, nil)
+	if pubs[0].AppId != "" || pubs[0].Headers["a"] != nil {
+		t.Error("template shouldn't be merged without option", pubs[0])
+	}
+}
+
 func newTestPublisher(opts ...PublisherOpt) *Publisher {
-	return NewPublisher("exchange.name", "routing.key", opts...)
+	p := NewPublisher("exchange.name", "routing.key", opts...)
+	p.lastChannelErr.Store(emptyErr) // immitate healthy channel
+	p.reg.set(true)                  // and registration with client
+	return p
+}
+
+func TestWithTransactions_confirmConflict(t *testing.T) {
+	p := newTestPublisher(WithTransactions(), WithConfirmation(make(chan amqp.Confirmation, 1)))
+	if err := <-p.Errors(); !errors.Is(err, ErrTxConfirmConflict) {
+		t.Error("should report conflict of options", err)
+	}
+	if err := p.Publish(amqp.Publishing{}); err != ErrTxConfirmConflict {
+		t.Error("Publish should fail", err)
+	}
+	if err := p.TxPublish([]amqp.Publishing{{}}); err != ErrTxConfirmConflict {
+		t.Error("TxPublish should fail", err)
+	}
+	var got error
+	p.PublishAsync(amqp.Publishing{}, func(err error) { got = err })
+	if got != ErrTxConfirmConflict {
+		t.Error("PublishAsync should fail", got)
+	}
+}
+
+func TestPublisher_TxPublish_rollback(t *testing.T) {
+	var (
+		published, rolledBack, committed bool
+		runSync                          = make(chan bool)
+		testErr                          = errors.New("publish error")
+	)
+
+	p := newTestPublisher(WithTransactions())
+	ch1 := &mqChannelTest{
+		_NotifyClose: func(c chan *amqp.Error) chan *amqp.Error { return c },
+		_Close:       func() error { return nil },
+		_Publish: func(string, string, bool, bool, amqp.Publishing) error {
+			if published {
+				return testErr
+			}
+			published = true
+			return nil
+		},
+		_TxRollback: func() error {
+			rolledBack = true
+			return nil
+		},
+		_TxCommit: func() error {
+			committed = true
+			return nil
+		},
+	}
+
+	go func() {
+		p.serve(&mqDeleterTest{_deletePublisher: func(*Publisher) {}}, ch1)
+		runSync <- true
+	}()
+
+	err := p.TxPublish([]amqp.Publishing{{}, {}})
+	p.Cancel()
+	<-runSync
+
+	if err != testErr {
+		t.Error("should return publish error", err)
+	}
+
+	if !rolledBack || committed {
+		t.Error("should rollback transaction")
+	}
+
+	if stats := p.Stats(); stats.Failed != 2 || stats.Published != 0 {
+		t.Error("should count whole batch as failed", stats)
+	}
+}
+
+func TestPublisher_TryPublish(t *testing.T) {
+	p := newTestPublisher()
+
+	if err := p.TryPublish(amqp.Publishing{}); err != ErrWouldBlock {
+		t.Error("should not wait for serve loop", err)
+	}
+
+	go func() {
+		envelop := <-p.pubChan
+		<-envelop.pub
+		close(envelop.err)
+	}()
+
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = p.TryPublish(amqp.Publishing{}); err != ErrWouldBlock {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Error("should publish once serve loop is ready", err)
+	}
+
+	p.lastChannelErr.Store(atomErr{amqp.ErrClosed})
+	if err := p.TryPublish(amqp.Publishing{}); err != ErrWouldBlock {
+		t.Error("should not wait for channel", err)
+	}
+}
+
+func TestPublishHeaders(t *testing.T) {
+	var n int
+	p := newTestPublisher(PublishHeaders(func() amqp.Table {
+		n++
+		return amqp.Table{"seq": n, "service": "test"}
+	}))
+
+	own := amqp.Table{"service": "own"}
+	pubs, _ := p.prepare(amqp.Publishing{Headers: own}, p.key, nil)
+	if h := pubs[0].Headers; h["seq"] != 1 || h["service"] != "own" {
+		t.Error("should merge dynamic headers under own ones", h)
+	}
+
+	if len(own) != 1 {
+		t.Error("should not modify publishing headers", own)
+	}
+
+	pubs, _ = p.prepare(amqp.Publishing{}, p.key, nil)
+	if h := pubs[0].Headers; h["seq"] != 2 {
+		t.Error("should compute headers for every publishing", h)
+	}
+
+	tmpl := amqp.Table{"service": "template", "env": "test"}
+	pubs, _ = p.prepare(amqp.Publishing{}, p.key, tmpl)
+	if h := pubs[0].Headers; h["service"] != "test" || h["env"] != "test" {
+		t.Error("should merge dynamic headers over template ones", h)
+	}
+
+	pubs, _ = p.prepare(amqp.Publishing{Headers: own}, p.key, tmpl)
+	if h := pubs[0].Headers; h["service"] != "own" || h["env"] != "test" {
+		t.Error("should keep own headers over template and dynamic ones", h)
+	}
+}
+
+func TestPublisher_CancelSettlesRetry(t *testing.T) {
+	p := newTestPublisher(WithConfirmation(make(chan amqp.Confirmation, 1)), RepublishUnconfirmed())
+
+	var got error
+	p.retryLater([]unconfirmed{{res: &asyncResult{remaining: 1, done: func(err error) { got = err }}}})
+	p.Cancel()
+	if got != ErrPublisherDead {
+		t.Error("should fail publishings waiting for channel", got)
+	}
+
+	got = nil
+	p.retryLater([]unconfirmed{{res: &asyncResult{remaining: 1, done: func(err error) { got = err }}}})
+	if got != ErrPublisherDead || len(p.retry) != 0 {
+		t.Error("should not keep publishings of cancelled publisher", got)
+	}
+}
+
+func TestConfirmTracker_nackLimit(t *testing.T) {
+	var total uint64
+	tracker := newConfirmTracker(true, 0, &total)
+
+	var got error
+	u := unconfirmed{res: &asyncResult{remaining: 1, done: func(err error) { got = err }}}
+	for i := 0; i < maxRepublishNacks; i++ {
+		tracker.published(u)
+		var again bool
+		if u, again = tracker.confirm(amqp.Confirmation{DeliveryTag: tracker.seq}); !again {
+			t.Fatal("should republish nacked publishing", i)
+		}
+	}
+
+	tracker.published(u)
+	if _, again := tracker.confirm(amqp.Confirmation{DeliveryTag: tracker.seq}); again || got != ErrNacked {
+		t.Error("should give up on publishing nacked too many times", got)
+	}
+}
+
+func TestPublisher_PublishConfirmCancel(t *testing.T) {
+	p := newTestPublisher(WithConfirmation(make(chan amqp.Confirmation, 1)), ConfirmTimeout(time.Hour))
+
+	go func() {
+		<-p.pubChan // confirmation never arrives
+		p.Cancel()
+	}()
+
+	if err := p.Publish(amqp.Publishing{}); err != ErrPublisherDead {
+		t.Error("Cancel should interrupt publish waiting for confirmation", err)
+	}
+}
+
+func TestPublisher_expireRetry(t *testing.T) {
+	p := newTestPublisher(WithConfirmation(make(chan amqp.Confirmation, 1)), RepublishUnconfirmed(), ConfirmTimeout(time.Minute))
+
+	var got error
+	p.retryLater([]unconfirmed{
+		{sent: time.Now().Add(-time.Hour), res: &asyncResult{remaining: 1, done: func(err error) { got = err }}},
+		{sent: time.Now()},
+	})
+	p.expireRetry()
+	if got != ErrConfirmTimeout || len(p.takeRetry()) != 1 {
+		t.Error("should expire publishings waiting for channel", got)
+	}
+	p.Cancel()
+}
+
+func TestAsyncResult_confirmExpiry(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		p := newTestPublisher(WithConfirmation(make(chan amqp.Confirmation, 1)), RepublishUnconfirmed(), ConfirmTimeout(time.Minute))
+		var total uint64
+		tracker := newConfirmTracker(true, 0, &total)
+
+		// chunks of publishing, one waits for channel, another one for confirmation
+		var calls int32
+		res := &asyncResult{remaining: 2, done: func(error) { atomic.AddInt32(&calls, 1) }}
+		p.retryLater([]unconfirmed{{sent: time.Now().Add(-time.Hour), res: res}})
+		tag := tracker.published(unconfirmed{res: res})
+
+		expired := make(chan struct{})
+		go func() {
+			p.expireRetry()
+			close(expired)
+		}()
+		tracker.confirm(amqp.Confirmation{DeliveryTag: tag, Ack: true})
+		<-expired
+		res.settle(nil)
+
+		if atomic.LoadInt32(&calls) != 1 || res.err != ErrConfirmTimeout {
+			t.Fatal("done should be called once", calls, res.err)
+		}
+		p.Cancel()
+	}
+}
+
+func TestPublisher_CancelCallbacks(t *testing.T) {
+	p := newTestPublisher()
+
+	done := make(chan struct{})
+	p.PublishAsync(amqp.Publishing{}, func(error) {
+		p.Unconfirmed() // callback could use publisher
+		close(done)
+	})
+	p.Cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("callback should run without publisher lock")
+	}
+}
+
+func TestPublisher_notifyFlow(t *testing.T) {
+	p := newTestPublisher()
+
+	for i := 0; i < cap(p.flow); i++ {
+		p.notifyFlow(false)
+	}
+	p.notifyFlow(true)
+
+	if !p.FlowActive() {
+		t.Error("should report current flow state")
+	}
+
+	var last bool
+	for len(p.flow) > 0 {
+		last = <-p.flow
+	}
+	if !last {
+		t.Error("should drop the oldest notification, not the latest")
+	}
+}
+
+func TestPublisher_SlowPublishWarning(t *testing.T) {
+	warnings := make(chan SlowPublish, 1)
+	p := newTestPublisher(SlowPublishWarning(10*time.Millisecond, func(w SlowPublish) { warnings <- w }))
+
+	go func() {
+		w := <-warnings // nobody serves publisher
+		if w.Exchange != "exchange.name" || w.Key != "other.key" || w.Blocked != 10*time.Millisecond {
+			t.Error("unexpected warning", w)
+		}
+		p.Cancel()
+	}()
+
+	if err := p.PublishWithRoutingKey(amqp.Publishing{}, "other.key"); err != ErrPublisherDead {
+		t.Error("unexpected error", err)
+	}
+	if s := p.Stats(); s.Slow != 1 {
+		t.Error("should count slow publish", s.Slow)
+	}
+}
+
+func TestPrioritizeAsync(t *testing.T) {
+	p := newTestPublisher(PrioritizeAsync(5))
+
+	var (
+		m     sync.Mutex
+		order []string
+	)
+	ch1 := &mqChannelTest{
+		_Close:       func() error { return nil },
+		_NotifyClose: func(errChan chan *amqp.Error) chan *amqp.Error { return errChan },
+		_Publish: func(ex string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
+			m.Lock()
+			order = append(order, string(msg.Body))
+			m.Unlock()
+			return nil
+		},
+	}
+
+	done := make(chan error, 3)
+	p.PublishAsync(amqp.Publishing{Body: []byte("bulk1")}, func(err error) { done <- err })
+	p.PublishAsync(amqp.Publishing{Body: []byte("bulk2")}, func(err error) { done <- err })
+	p.PublishAsync(amqp.Publishing{Body: []byte("ping"), Priority: 9}, func(err error) { done <- err })
+
+	go p.serve(&mqDeleterTest{_deletePublisher: func(*Publisher) {}}, ch1)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	p.Cancel()
+
+	m.Lock()
+	defer m.Unlock()
+	if len(order) != 3 || order[0] != "ping" || order[1] != "bulk1" || order[2] != "bulk2" {
+		t.Error("urgent publishing should jump ahead of queued ones", order)
+	}
 }
@@ -0,0 +1,160 @@
+package cony
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// QueueOpt is a functional option type for Queue, applied by DeclareQueue
+type QueueOpt func(*Queue)
+
+// Overflow defines behaviour of queue reached MaxLength or MaxLengthBytes
+type Overflow string
+
+// Overflow behaviours supported by RabbitMQ
+const (
+	// OverflowDropHead drops or dead letters oldest messages. The default
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish rejects new publishings
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX rejects and dead letters new publishings
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// TemporaryQueue returns server-named, exclusive, auto-delete queue, e.g. to
+// receive replies. It's deleted once connection is lost and gets new name
+// when declared again on reconnect, onName is called with the name after
+// every declaration, before consumers are served:
+//
+//	q := cony.TemporaryQueue(func(name string) { replyTo.Store(name) })
+//	client.Declare([]cony.Declaration{cony.DeclareQueue(q)})
+//	client.Consume(cony.NewConsumer(q, cony.AutoAck()))
+func TemporaryQueue(onName func(name string)) *Queue {
+	return &Queue{
+		AutoDelete: true,
+		Exclusive:  true,
+		declared:   onName,
+	}
+}
+
+// setArg sets queue argument, initializing Args if needed
+func (q *Queue) setArg(key string, value interface{}) {
+	q.l.Lock()
+	defer q.l.Unlock()
+	if q.Args == nil {
+		q.Args = amqp.Table{}
+	}
+	q.Args[key] = value
+}
+
+// MaxPriority makes queue a priority queue, by setting `x-max-priority`
+// argument. Messages are delivered in order of their Priority, capped by
+// max. RabbitMQ recommends max up to 10.
+func MaxPriority(max uint8) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-max-priority", int32(max))
+	}
+}
+
+// SingleActiveConsumer set `x-single-active-consumer` argument, so only one
+// consumer at a time receives deliveries while others stay on standby.
+func SingleActiveConsumer() QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-single-active-consumer", true)
+	}
+}
+
+// MessageTTL set `x-message-ttl` argument, messages are discarded or dead
+// lettered after staying in queue for ttl. Precision is milliseconds.
+func MessageTTL(ttl time.Duration) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-message-ttl", int64(ttl/time.Millisecond))
+	}
+}
+
+// DeadLetter set `x-dead-letter-exchange` argument, rejected and expired
+// messages are republished to exchange with their original routing key
+func DeadLetter(exchange string) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-dead-letter-exchange", exchange)
+	}
+}
+
+// Expires set `x-expires` argument, queue is deleted after being unused for d.
+// Precision is milliseconds.
+func Expires(d time.Duration) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-expires", int64(d/time.Millisecond))
+	}
+}
+
+// MaxLength set `x-max-length` argument, limiting number of ready messages
+func MaxLength(n int) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-max-length", int64(n))
+	}
+}
+
+// MaxLengthBytes set `x-max-length-bytes` argument, limiting total size of
+// ready messages bodies
+func MaxLengthBytes(n int64) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-max-length-bytes", n)
+	}
+}
+
+// WithOverflow set `x-overflow` argument, see Overflow
+func WithOverflow(o Overflow) QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-overflow", string(o))
+	}
+}
+
+// LazyQueue set `x-queue-mode: lazy` argument, classic queue keeps messages
+// on disk and loads them to memory only when needed. Quorum and stream queues
+// don't support it, their declaration fails validation.
+func LazyQueue() QueueOpt {
+	return func(q *Queue) {
+		q.setArg("x-queue-mode", "lazy")
+	}
+}
+
+// validateArgs checks well known queue arguments, so misconfigured queue is
+// reported before broker closes channel with PRECONDITION_FAILED
+func validateArgs(args amqp.Table) error {
+	for key, min := range map[string]int64{
+		"x-message-ttl":      0,
+		"x-expires":          1,
+		"x-max-length":       0,
+		"x-max-length-bytes": 0,
+	} {
+		v, ok := args[key]
+		if !ok {
+			continue
+		}
+		if n, ok := toInt64(v); !ok || n < min {
+			return fmt.Errorf("invalid queue argument %s: %v (%T)", key, v, v)
+		}
+	}
+
+	if v, ok := args["x-overflow"]; ok {
+		switch Overflow(fmt.Sprint(v)) {
+		case OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+		default:
+			return fmt.Errorf("invalid queue argument x-overflow: %v", v)
+		}
+	}
+
+	if mode, ok := args["x-queue-mode"]; ok {
+		if kind := args["x-queue-type"]; kind == "quorum" || kind == "stream" {
+			return fmt.Errorf("invalid queue argument x-queue-mode: not supported by %v queues", kind)
+		}
+		if mode != "lazy" && mode != "default" {
+			return fmt.Errorf("invalid queue argument x-queue-mode: %v", mode)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package cony
+
+import "github.com/streadway/amqp"
+
+// QueueSpec describes queue along with its bindings, for ConsumeQueue
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       amqp.Table
+	Options    []QueueOpt
+	Bindings   []BindingSpec
+}
+
+// BindingSpec describes binding of QueueSpec queue to existing exchange
+type BindingSpec struct {
+	Exchange string
+	Key      string
+	Args     amqp.Table
+}
+
+// Declarations returns declarations of queue and its bindings, along with
+// Queue they declare. Options are applied to copy of Args
+func (s QueueSpec) Declarations() (*Queue, []Declaration) {
+	q := &Queue{
+		Name:       s.Name,
+		Durable:    s.Durable,
+		AutoDelete: s.AutoDelete,
+		Exclusive:  s.Exclusive,
+	}
+	if s.Args != nil {
+		q.Args = amqp.Table{}
+		for k, v := range s.Args {
+			q.Args[k] = v
+		}
+	}
+	d := []Declaration{DeclareQueue(q, s.Options...)}
+	for _, b := range s.Bindings {
+		d = append(d, DeclareBinding(Binding{
+			Queue:    q,
+			Exchange: Exchange{Name: b.Exchange},
+			Key:      b.Key,
+			Args:     b.Args,
+		}))
+	}
+	return q, d
+}
+
+// ConsumeQueue declares queue of spec with its bindings and starts consuming
+// it. Declarations are saved like ones of Declare and re-run on reconnect,
+// RemoveConsumer doesn't forget them
+func (c *Client) ConsumeQueue(spec QueueSpec, opts ...ConsumerOpt) *Consumer {
+	q, d := spec.Declarations()
+	c.Declare(d)
+	cons := NewConsumer(q, opts...)
+	c.Consume(cons)
+	return cons
+}
@@ -0,0 +1,100 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestMaxPriority(t *testing.T) {
+	q := &Queue{}
+	DeclareQueue(q, MaxPriority(10))
+
+	if q.Args["x-max-priority"] != int32(10) {
+		t.Error("queue should be declared with x-max-priority")
+	}
+}
+
+func TestSingleActiveConsumer(t *testing.T) {
+	q := &Queue{}
+	DeclareQueue(q, SingleActiveConsumer())
+
+	if q.Args["x-single-active-consumer"] != true {
+		t.Error("queue should be declared with x-single-active-consumer")
+	}
+}
+
+func TestQueueArgs(t *testing.T) {
+	q := &Queue{}
+	DeclareQueue(q,
+		MessageTTL(time.Minute),
+		Expires(time.Hour),
+		MaxLength(100),
+		MaxLengthBytes(1<<20),
+		WithOverflow(OverflowRejectPublish),
+	)
+
+	if q.Args["x-message-ttl"] != int64(60000) || q.Args["x-expires"] != int64(3600000) {
+		t.Error("durations should be set in milliseconds", q.Args)
+	}
+
+	if q.Args["x-max-length"] != int64(100) || q.Args["x-max-length-bytes"] != int64(1<<20) {
+		t.Error("max length should be set", q.Args)
+	}
+
+	if q.Args["x-overflow"] != "reject-publish" {
+		t.Error("overflow should be set", q.Args)
+	}
+
+	if err := validateArgs(q.Args); err != nil {
+		t.Error("args should be valid", err)
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	for _, args := range []amqp.Table{
+		{"x-message-ttl": "60000"},
+		{"x-message-ttl": int64(-1)},
+		{"x-expires": int32(0)},
+		{"x-max-length": -1},
+		{"x-overflow": "drop-tail"},
+	} {
+		if validateArgs(args) == nil {
+			t.Error("args should be invalid", args)
+		}
+	}
+
+	called := false
+	td := &testDeclarer{_QueueDeclare: func(string) (amqp.Queue, error) {
+		called = true
+		return amqp.Queue{}, nil
+	}}
+	err := DeclareQueue(&Queue{}, Expires(0))(td)
+	if err == nil || called {
+		t.Error("invalid queue should not be declared")
+	}
+}
+
+func TestLazyQueue(t *testing.T) {
+	q := &Queue{}
+	DeclareQueue(q, LazyQueue())
+
+	if q.Args["x-queue-mode"] != "lazy" || validateArgs(q.Args) != nil {
+		t.Error("queue should be declared lazy", q.Args)
+	}
+
+	q.Args["x-queue-type"] = "quorum"
+	if validateArgs(q.Args) == nil {
+		t.Error("lazy mode should be invalid for quorum queue")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	q := &Queue{}
+	DeadLetter("work")(q)
+
+	if q.Args["x-dead-letter-exchange"] != "work" {
+		t.Error("should set x-dead-letter-exchange", q.Args)
+	}
+}
@@ -0,0 +1,115 @@
+package cony
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is used to throttle publishing. It is implemented by
+// *rate.Limiter from golang.org/x/time/rate
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// allower is implemented by limiters which could be checked without waiting,
+// like *rate.Limiter. It's used by TryPublish
+type allower interface {
+	Allow() bool
+}
+
+// tokenBucket is a default Limiter implementation
+type tokenBucket struct {
+	m      sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait implements Limiter
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	d := b.reserve(time.Now())
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		b.refund()
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// refund returns token taken by cancelled Wait, so it isn't lost for other
+// callers
+func (b *tokenBucket) refund() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Allow takes a token if it's available right away
+func (b *tokenBucket) Allow() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	tokens := b.tokens + now.Sub(b.last).Seconds()*b.rate
+	if tokens > b.burst {
+		tokens = b.burst
+	}
+	if tokens < 1 {
+		return false
+	}
+	b.tokens, b.last = tokens-1, now
+	return true
+}
+
+// reserve takes a token and returns time to wait until it is available
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,54 @@
+package cony
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_reserve(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2)
+	b.last = now
+
+	if b.reserve(now) != 0 || b.reserve(now) != 0 {
+		t.Error("burst should pass without waiting")
+	}
+
+	if d := b.reserve(now); d != 100*time.Millisecond {
+		t.Errorf("should wait 100ms, instead got %s", d)
+	}
+
+	if d := b.reserve(now.Add(time.Second)); d != 0 {
+		t.Errorf("tokens should refill, instead got %s", d)
+	}
+}
+
+func TestTokenBucket_Wait(t *testing.T) {
+	b := newTokenBucket(0.001, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := b.Wait(ctx); err != nil {
+		t.Error("first token should be available")
+	}
+
+	cancel()
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Error("should return context error")
+	}
+	if b.tokens < -0.5 {
+		t.Error("cancelled wait should refund its token", b.tokens)
+	}
+}
+
+func TestTokenBucket_Allow(t *testing.T) {
+	b := newTokenBucket(1, 2)
+
+	if !b.Allow() || !b.Allow() {
+		t.Error("should allow burst")
+	}
+
+	if b.Allow() {
+		t.Error("should not allow over burst")
+	}
+}
@@ -0,0 +1,78 @@
+package cony
+
+import (
+	"context"
+	"sync"
+)
+
+// readiness tracks whether connection or channel is established, waking up
+// waiters once it is
+type readiness struct {
+	m     sync.Mutex
+	up    bool
+	ready chan struct{} // closed while up
+	down  chan struct{} // closed while down
+}
+
+func (r *readiness) set(up bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.init()
+	if up && !r.up {
+		close(r.ready)
+		r.down = make(chan struct{})
+	} else if !up && r.up {
+		r.ready = make(chan struct{})
+		close(r.down)
+	}
+	r.up = up
+}
+
+func (r *readiness) init() {
+	if r.ready == nil {
+		r.ready = make(chan struct{})
+		r.down = make(chan struct{})
+		close(r.down)
+	}
+}
+
+func (r *readiness) wait() <-chan struct{} {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.init()
+	return r.ready
+}
+
+// lost returns channel closed once connection or channel is lost
+func (r *readiness) lost() <-chan struct{} {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.init()
+	return r.down
+}
+
+// Ready blocks until client is connected and declarations are run, or ctx is
+// done. Returns ErrClientClosed once client is closed
+func (c *Client) Ready(ctx context.Context) error {
+	select {
+	case <-c.up.wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.context().Done():
+		return ErrClientClosed
+	}
+}
+
+// Ready blocks until publisher is served on open channel, or ctx is done.
+// Returns ErrPublisherDead once publisher is cancelled
+func (p *Publisher) Ready(ctx context.Context) error {
+	select {
+	case <-p.up.wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.stop:
+		return ErrPublisherDead
+	}
+}
@@ -0,0 +1,76 @@
+package cony
+
+import "github.com/streadway/amqp"
+
+// RetryCountHeader counts how many times message was republished by Republish
+const RetryCountHeader = "x-retry-count"
+
+// Republish publishes consumed delivery again with p, e.g. to shovel messages
+// from dead letter queue back to work queue. Headers and properties of
+// delivery are preserved, RetryCountHeader is incremented. mutate functions
+// are applied to publishing before it's published, see StripDeath.
+func Republish(d amqp.Delivery, p *Publisher, mutate ...func(*amqp.Publishing)) error {
+	pub := publishing(d)
+	retries, _ := toInt64(d.Headers[RetryCountHeader])
+	pub.Headers[RetryCountHeader] = retries + 1
+
+	for _, f := range mutate {
+		f(&pub)
+	}
+
+	return p.Publish(pub)
+}
+
+// publishing converts delivery back into publishing, headers are copied
+func publishing(d amqp.Delivery) amqp.Publishing {
+	pub := amqp.Publishing{
+		Headers:         amqp.Table{},
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+	for k, v := range d.Headers {
+		pub.Headers[k] = v
+	}
+	return pub
+}
+
+// StripDeath removes x-death header, so broker starts dead lettering history
+// of republished message from scratch. Use it with Republish
+func StripDeath(pub *amqp.Publishing) {
+	delete(pub.Headers, "x-death")
+}
+
+// toInt64 converts integer header value of any AMQP integer type
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	default:
+		return 0, false
+	}
+}
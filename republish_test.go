@@ -0,0 +1,51 @@
+package cony
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRepublish(t *testing.T) {
+	var msg amqp.Publishing
+	p := newTestPublisher()
+
+	go func() {
+		envelop := <-p.pubChan
+		msg = <-envelop.pub
+		envelop.err <- nil
+	}()
+
+	d := amqp.Delivery{
+		MessageId: "m1",
+		Headers: amqp.Table{
+			"h1":             "v1",
+			"x-death":        []interface{}{},
+			RetryCountHeader: int32(2),
+		},
+		Body: []byte("body"),
+	}
+
+	err := Republish(d, p, StripDeath, func(pub *amqp.Publishing) {
+		pub.AppId = "app1"
+	})
+	if err != nil {
+		t.Error("should republish", err)
+	}
+
+	if msg.MessageId != "m1" || string(msg.Body) != "body" || msg.Headers["h1"] != "v1" {
+		t.Error("should preserve properties and headers", msg)
+	}
+
+	if msg.Headers[RetryCountHeader] != int64(3) {
+		t.Error("should increment retry count", msg.Headers[RetryCountHeader])
+	}
+
+	if _, ok := msg.Headers["x-death"]; ok || msg.AppId != "app1" {
+		t.Error("should apply mutators", msg)
+	}
+
+	if _, ok := d.Headers["x-death"]; !ok {
+		t.Error("should not modify delivery headers")
+	}
+}
@@ -0,0 +1,99 @@
+package cony
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RetryScheduler delays redelivery of messages with TTL-retry pattern. For
+// every delay bucket it declares wait queue with `x-message-ttl`, dead
+// lettering expired messages back to work exchange with their original
+// routing key, and fanout exchange routing to wait queue.
+//
+//	retries := cony.NewRetryScheduler(client, "orders", "orders", time.Second, time.Minute)
+//	...
+//	if err := retries.Schedule(d, 30*time.Second); err == nil {
+//		d.Ack(false)
+//	}
+type RetryScheduler struct {
+	buckets []retryBucket
+}
+
+type retryBucket struct {
+	delay time.Duration
+	pub   *Publisher
+}
+
+// NewRetryScheduler declares wait queues named `<name>.retry.<delay>` with
+// client and registers their publishers. exchange is the work exchange
+// messages are dead lettered back to.
+func NewRetryScheduler(client *Client, name, exchange string, delays ...time.Duration) *RetryScheduler {
+	sorted := append([]time.Duration(nil), delays...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	s := &RetryScheduler{}
+	var decls []Declaration
+	for _, delay := range sorted {
+		bucket := fmt.Sprintf("%s.retry.%s", name, delay)
+		ex := Exchange{Name: bucket, Kind: amqp.ExchangeFanout, Durable: true}
+		q := &Queue{Name: bucket, Durable: true}
+		decls = append(decls,
+			DeclareExchange(ex),
+			DeclareQueue(q, MessageTTL(delay), DeadLetter(exchange)),
+			DeclareBinding(Binding{Queue: q, Exchange: ex}),
+		)
+
+		s.buckets = append(s.buckets, retryBucket{delay: delay, pub: NewPublisher(bucket, "")})
+	}
+
+	client.Declare(decls)
+	for _, b := range s.buckets {
+		client.Publish(b.pub)
+	}
+	return s
+}
+
+// Schedule publishes delivery to wait queue of the shortest delay not less
+// than after, or the longest one, so it's redelivered to work exchange once
+// delay passes. Headers and properties of delivery are preserved,
+// RetryCountHeader is incremented. Delivery should be acked by caller once
+// Schedule succeeds.
+//
+// WARNING: this is blocking call, see (*Publisher).Publish
+func (s *RetryScheduler) Schedule(d amqp.Delivery, after time.Duration) error {
+	bucket := s.bucket(after)
+	if bucket == nil {
+		return fmt.Errorf("no retry bucket for %s", after)
+	}
+
+	pub := publishing(d)
+	retries, _ := toInt64(d.Headers[RetryCountHeader])
+	pub.Headers[RetryCountHeader] = retries + 1
+	// per message expiration would hold back wait queue
+	pub.Expiration = ""
+
+	return bucket.pub.PublishWithRoutingKey(pub, d.RoutingKey)
+}
+
+// bucket picks wait queue for delay
+func (s *RetryScheduler) bucket(after time.Duration) *retryBucket {
+	if len(s.buckets) == 0 {
+		return nil
+	}
+	for i := range s.buckets {
+		if s.buckets[i].delay >= after {
+			return &s.buckets[i]
+		}
+	}
+	return &s.buckets[len(s.buckets)-1]
+}
+
+// Cancel all publishers of scheduler
+func (s *RetryScheduler) Cancel() {
+	for _, b := range s.buckets {
+		b.pub.Cancel()
+	}
+}
@@ -0,0 +1,153 @@
+package cony
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrNoShards is returned by ShardedPublisher constructors without publishers
+var ErrNoShards = errors.New("Sharded publisher needs at least one shard")
+
+// ShardFunc picks shard for the message. Result is taken modulo number of
+// shards, so any int is fine
+type ShardFunc func(amqp.Publishing) int
+
+// ShardedPublisher owns set of Publishers, each one with own AMQP channel, and
+// routes messages between them with ShardFunc. Messages routed to the same
+// shard keep their order, while different shards are published in parallel.
+type ShardedPublisher struct {
+	pubs   []*Publisher
+	shard  ShardFunc
+	client *Client // set if publishers are owned
+	suffix bool
+	opts   []PublisherOpt
+}
+
+// ShardOpt is a functional option of NewPublisherShards
+type ShardOpt func(*ShardedPublisher)
+
+// NewShardedPublisher is a ShardedPublisher constructor. Every publisher
+// should be registered with (*Client).Publish, see Publishers(). Nil shard
+// hashes MessageId of messages, see HashShard
+func NewShardedPublisher(shard ShardFunc, pubs ...*Publisher) (*ShardedPublisher, error) {
+	if len(pubs) == 0 {
+		return nil, ErrNoShards
+	}
+	return &ShardedPublisher{
+		pubs:  pubs,
+		shard: shardOrDefault(shard),
+	}, nil
+}
+
+// NewPublisherShards returns ShardedPublisher owning n publishers to exchange
+// with routing key, registered with client. Cancel removes them from client.
+// Nil shard hashes MessageId of messages, like with NewShardedPublisher
+func NewPublisherShards(client *Client, n int, exchange, key string, shard ShardFunc, opts ...ShardOpt) (*ShardedPublisher, error) {
+	if n <= 0 {
+		return nil, ErrNoShards
+	}
+	s := &ShardedPublisher{shard: shardOrDefault(shard), client: client}
+	for _, o := range opts {
+		o(s)
+	}
+	for i := 0; i < n; i++ {
+		p := NewPublisher(exchange, key, s.opts...)
+		s.pubs = append(s.pubs, p)
+		client.Publish(p)
+	}
+	return s, nil
+}
+
+// ShardKeySuffix is a functional option of NewPublisherShards, appending
+// shard number to routing key, e.g. `orders.3`, so every shard could be bound
+// to its own queue
+func ShardKeySuffix() ShardOpt {
+	return func(s *ShardedPublisher) {
+		s.suffix = true
+	}
+}
+
+// ShardPublisherOpts is a functional option of NewPublisherShards, setting
+// options of every owned publisher
+func ShardPublisherOpts(opts ...PublisherOpt) ShardOpt {
+	return func(s *ShardedPublisher) {
+		s.opts = append(s.opts, opts...)
+	}
+}
+
+// HashShard returns ShardFunc which hashes partition key extracted from the
+// message, e.g. aggregate ID
+func HashShard(key func(amqp.Publishing) string) ShardFunc {
+	return func(pub amqp.Publishing) int {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key(pub)))
+		return int(h.Sum32() & 0x7fffffff)
+	}
+}
+
+// messageIDShard is a default ShardFunc
+var messageIDShard = HashShard(func(pub amqp.Publishing) string { return pub.MessageId })
+
+func shardOrDefault(shard ShardFunc) ShardFunc {
+	if shard == nil {
+		return messageIDShard
+	}
+	return shard
+}
+
+// Publishers returns underlying publishers
+func (s *ShardedPublisher) Publishers() []*Publisher {
+	return s.pubs
+}
+
+// Publish used to publish custom amqp.Publishing with routing key of selected
+// shard
+//
+// WARNING: this is blocking call, see (*Publisher).Publish
+func (s *ShardedPublisher) Publish(pub amqp.Publishing) error {
+	p, n := s.pick(pub)
+	if s.suffix {
+		return p.PublishWithRoutingKey(pub, s.key(p.key, n))
+	}
+	return p.Publish(pub)
+}
+
+// PublishWithRoutingKey used to publish custom amqp.Publishing and routing key
+// on selected shard
+//
+// WARNING: this is blocking call, see (*Publisher).PublishWithRoutingKey
+func (s *ShardedPublisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error {
+	p, n := s.pick(pub)
+	return p.PublishWithRoutingKey(pub, s.key(key, n))
+}
+
+// Cancel all underlying publishers
+func (s *ShardedPublisher) Cancel() {
+	for _, p := range s.pubs {
+		if s.client != nil {
+			s.client.RemovePublisher(p)
+		} else {
+			p.Cancel()
+		}
+	}
+}
+
+// pick returns publisher of shard and its number
+func (s *ShardedPublisher) pick(pub amqp.Publishing) (*Publisher, int) {
+	n := s.shard(pub) % len(s.pubs)
+	if n < 0 {
+		n = -n
+	}
+	return s.pubs[n], n
+}
+
+// key returns routing key of shard n
+func (s *ShardedPublisher) key(key string, n int) string {
+	if !s.suffix {
+		return key
+	}
+	return key + "." + strconv.Itoa(n)
+}
@@ -0,0 +1,94 @@
+package cony
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestShardedPublisher_pick(t *testing.T) {
+	p1 := newTestPublisher()
+	p2 := newTestPublisher()
+
+	s, err := NewShardedPublisher(func(pub amqp.Publishing) int {
+		if pub.MessageId == "a" {
+			return 0
+		}
+		return -3
+	}, p1, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, _ := s.pick(amqp.Publishing{MessageId: "a"}); p != p1 {
+		t.Error("should pick first shard")
+	}
+
+	if p, n := s.pick(amqp.Publishing{MessageId: "b"}); p != p2 || n != 1 {
+		t.Error("should pick second shard for negative values")
+	}
+
+	if len(s.Publishers()) != 2 {
+		t.Error("should return all publishers")
+	}
+}
+
+func TestShardedPublisher_defaultShard(t *testing.T) {
+	s, err := NewShardedPublisher(nil, newTestPublisher(), newTestPublisher())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := amqp.Publishing{MessageId: "order-1"}
+	p, _ := s.pick(pub)
+	if again, _ := s.pick(pub); again != p {
+		t.Error("should pick shard by MessageId")
+	}
+}
+
+func TestHashShard(t *testing.T) {
+	shard := HashShard(func(pub amqp.Publishing) string {
+		return pub.CorrelationId
+	})
+
+	a := shard(amqp.Publishing{CorrelationId: "order-1"})
+	b := shard(amqp.Publishing{CorrelationId: "order-1"})
+
+	if a != b {
+		t.Error("same key should produce same shard")
+	}
+
+	if a < 0 {
+		t.Error("shard should not be negative")
+	}
+}
+
+func TestShardedPublisher_Cancel(t *testing.T) {
+	p1 := newTestPublisher()
+	p2 := newTestPublisher()
+
+	s, _ := NewShardedPublisher(nil, p1, p2)
+	s.Cancel()
+
+	if !p1.dead || !p2.dead {
+		t.Error("should cancel all publishers")
+	}
+}
+
+func TestShardedPublisher_noShards(t *testing.T) {
+	if _, err := NewShardedPublisher(nil); err != ErrNoShards {
+		t.Error("should require publishers", err)
+	}
+
+	if _, err := NewPublisherShards(NewClient(), 0, "", "", nil); err != ErrNoShards {
+		t.Error("should require shards", err)
+	}
+}
+
+func TestShardedPublisher_key(t *testing.T) {
+	s := &ShardedPublisher{suffix: true}
+
+	if s.key("orders", 3) != "orders.3" {
+		t.Error("should append shard number", s.key("orders", 3))
+	}
+}
@@ -0,0 +1,207 @@
+package cony
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// SharedChannel set this consumer to share single AMQP channel of Client with
+// other consumers having this option, instead of opening its own, to save
+// resources when consuming from many mostly idle queues. Qos applies to
+// every consumer separately. Acks with multiple flag would settle deliveries
+// of other consumers, so CoalesceAcks is ignored and AckBatch should not be
+// used with shared channel.
+//
+// Broker closes channel on any channel error, so it fails for all consumers
+// sharing it, which then resubscribe on a new one. To limit that, queue of
+// consumer is checked with passive declaration on separate channel before
+// consuming on shared one, so missing queue fails only its own consumer.
+// Other refused consumes, e.g. of exclusive consumer, still close channel of
+// all of them.
+func SharedChannel() ConsumerOpt {
+	return func(c *Consumer) {
+		c.shared = true
+	}
+}
+
+// consumerChannel returns channel for consumer, should be called with lock
+// held
+func (c *Client) consumerChannel(cons *Consumer) (mqChannel, error) {
+	if !cons.shared {
+		return c.channel()
+	}
+
+	if c.shared != nil {
+		if v, ok := c.shared.view(); ok {
+			return v, nil
+		}
+	}
+
+	ch, err := c.channel()
+	if err != nil {
+		return nil, err
+	}
+	c.shared = newSharedChannel(ch, c.channel)
+	v, _ := c.shared.view()
+	return v, nil
+}
+
+// passiveDeclarer is implemented by *amqp.Channel and conytest channels
+type passiveDeclarer interface {
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+}
+
+// sharedChannel multiplexes consumers on single channel and dispatches
+// cancel notifications by consumer tag
+type sharedChannel struct {
+	Channel
+	probe  func() (Channel, error) // opens channel to check queues on
+	m      sync.Mutex
+	views  map[string]*sharedView // by consumer tag
+	refs   int
+	closed bool
+}
+
+func newSharedChannel(ch Channel, probe func() (Channel, error)) *sharedChannel {
+	s := &sharedChannel{Channel: ch, probe: probe, views: make(map[string]*sharedView)}
+	go s.dispatch(ch.NotifyCancel(make(chan string, 1)))
+	return s
+}
+
+// view returns channel for one more consumer, false if channel is closed
+func (s *sharedChannel) view() (*sharedView, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	s.refs++
+	return &sharedView{Channel: s.Channel, s: s}, true
+}
+
+// dispatch cancel notifications till channel is closed
+func (s *sharedChannel) dispatch(cancels <-chan string) {
+	for tag := range cancels {
+		s.m.Lock()
+		if v, ok := s.views[tag]; ok && v.cancels != nil {
+			select {
+			case v.cancels <- tag:
+			default:
+			}
+		}
+		s.m.Unlock()
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = true
+	for _, v := range s.views {
+		v.closeCancels()
+	}
+}
+
+// sharedView is a channel of single consumer sharing channel
+type sharedView struct {
+	Channel
+	s        *sharedChannel
+	prefetch int
+	tag      string
+	cancels  chan string
+	done     bool
+}
+
+// Qos is applied along with Consume, so it doesn't affect other consumers
+func (v *sharedView) Qos(prefetchCount, prefetchSize int, global bool) error {
+	v.s.m.Lock()
+	defer v.s.m.Unlock()
+	v.prefetch = prefetchCount
+	return nil
+}
+
+func (v *sharedView) NotifyCancel(l chan string) chan string {
+	v.s.m.Lock()
+	defer v.s.m.Unlock()
+	if v.s.closed || v.done {
+		close(l)
+	} else {
+		v.cancels = l
+	}
+	return l
+}
+
+func (v *sharedView) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if err := v.s.check(queue); err != nil {
+		return nil, err
+	}
+
+	v.s.m.Lock()
+	defer v.s.m.Unlock()
+
+	// prefetch of basic.qos applies to consumers started after it
+	if err := v.s.Channel.Qos(v.prefetch, 0, false); err != nil {
+		return nil, err
+	}
+	deliveries, err := v.s.Channel.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	if err == nil {
+		v.tag = consumer
+		v.s.views[consumer] = v
+	}
+	return deliveries, err
+}
+
+// check declares queue passively on separate channel, so error of missing
+// queue doesn't close shared channel
+func (s *sharedChannel) check(queue string) error {
+	if s.probe == nil {
+		return nil
+	}
+	ch, err := s.probe()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if pd, ok := ch.(passiveDeclarer); ok {
+		_, err = pd.QueueDeclarePassive(queue, false, false, false, false, nil)
+	}
+	return err
+}
+
+// Close cancels consumer, shared channel is closed along with its last
+// consumer
+func (v *sharedView) Close() error {
+	v.s.m.Lock()
+	if v.done {
+		v.s.m.Unlock()
+		return nil
+	}
+	v.done = true
+	if v.s.views[v.tag] == v {
+		delete(v.s.views, v.tag)
+	}
+	v.closeCancels()
+	v.s.refs--
+	last := v.s.refs == 0 && !v.s.closed
+	if last {
+		v.s.closed = true
+	}
+	v.s.m.Unlock()
+
+	var err error
+	if v.tag != "" {
+		err = v.s.Channel.Cancel(v.tag, false)
+	}
+	if last {
+		err = v.s.Channel.Close()
+	}
+	return err
+}
+
+// closeCancels closes cancel notifications of consumer, should be called
+// with lock held
+func (v *sharedView) closeCancels() {
+	if v.cancels != nil {
+		close(v.cancels)
+		v.cancels = nil
+	}
+}
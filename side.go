@@ -0,0 +1,80 @@
+package cony
+
+import (
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+// errSideReturned is reported when message moved aside was returned by broker,
+// e.g. quarantine queue doesn't exist
+var errSideReturned = errors.New("Message moved aside was returned as unroutable")
+
+// errSideStopped is reported when consumer is cancelled while waiting for
+// confirmation of message moved aside
+var errSideStopped = errors.New("Consumer stopped before message moved aside was confirmed")
+
+// sidePublisher moves deliveries aside, e.g. to quarantine queue, on its own
+// channel in confirm mode, so they are acked only once broker took their
+// copy. Channel is opened on first use. It's used by consume goroutine only
+type sidePublisher struct {
+	client   owner
+	stop     <-chan struct{}
+	ch       mqChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// publish publishes pub to queue with mandatory flag and waits for its
+// confirmation
+func (s *sidePublisher) publish(queue string, pub amqp.Publishing) error {
+	if s.ch == nil {
+		ch, err := s.client.sideChannel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			_ = ch.Close()
+			return err
+		}
+		s.ch = ch
+		s.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+		s.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+
+	if err := s.ch.Publish("", queue, true, false, pub); err != nil {
+		s.close()
+		return err
+	}
+
+	select {
+	case c, ok := <-s.confirms:
+		if !ok {
+			s.close()
+			return amqp.ErrClosed
+		}
+		if !c.Ack {
+			return ErrNacked
+		}
+	case <-s.stop:
+		s.close()
+		return errSideStopped
+	}
+
+	// broker sends return before confirmation of returned message
+	select {
+	case _, ok := <-s.returns:
+		if ok {
+			return errSideReturned
+		}
+	default:
+	}
+	return nil
+}
+
+func (s *sidePublisher) close() {
+	if s.ch != nil {
+		_ = s.ch.Close()
+		s.ch = nil
+	}
+}
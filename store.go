@@ -0,0 +1,236 @@
+package cony
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Store persists publishings accepted by Outbox until they are published.
+// Implementations should be safe for concurrent use. Store backed by
+// embedded database, like bbolt or badger, could be plugged in by user.
+type Store interface {
+	// Append persists publishing with routing key, returns its id. Ids
+	// should grow in order of appending
+	Append(key string, pub amqp.Publishing) (uint64, error)
+	// Pending returns persisted publishings in order of appending. Error
+	// could be returned along with publishings which were read, e.g. if
+	// some of them are corrupted
+	Pending() ([]StoredPublishing, error)
+	// Remove forgets published publishing
+	Remove(id uint64) error
+}
+
+// StoredPublishing is a publishing persisted in Store
+type StoredPublishing struct {
+	ID         uint64
+	Key        string
+	Publishing amqp.Publishing
+}
+
+// memoryStore keeps publishings in memory, they don't survive restart
+type memoryStore struct {
+	m    sync.Mutex
+	seq  uint64
+	pubs []StoredPublishing
+}
+
+// NewMemoryStore returns in-memory Store, publishings are lost on restart
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Append(key string, pub amqp.Publishing) (uint64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seq++
+	s.pubs = append(s.pubs, StoredPublishing{ID: s.seq, Key: key, Publishing: pub})
+	return s.seq, nil
+}
+
+func (s *memoryStore) Pending() ([]StoredPublishing, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]StoredPublishing(nil), s.pubs...), nil
+}
+
+func (s *memoryStore) Remove(id uint64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i, p := range s.pubs {
+		if p.ID == id {
+			s.pubs = append(s.pubs[:i], s.pubs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func init() {
+	// types of amqp.Table values, transferred as interfaces by gob
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(amqp.Decimal{})
+	gob.Register(time.Time{})
+}
+
+const (
+	storeExt      = ".pub"
+	quarantineExt = ".bad"
+)
+
+// fileStore keeps every publishing in its own gob encoded file of directory
+type fileStore struct {
+	m   sync.Mutex
+	dir string
+	seq uint64
+}
+
+// NewFileStore returns Store keeping publishings in dir, one file per
+// publishing, so they survive restart. dir is created if missing. Files which
+// can't be decoded are renamed to .bad ones, so they don't block others, and
+// reported by Pending
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{dir: dir}
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		s.seq = ids[len(ids)-1]
+	}
+	return s, nil
+}
+
+func (s *fileStore) Append(key string, pub amqp.Publishing) (uint64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(StoredPublishing{ID: s.seq + 1, Key: key, Publishing: pub}); err != nil {
+		return 0, err
+	}
+
+	// rename is atomic, so partially written publishing is never pending,
+	// syncs make publishing survive power loss
+	tmp := filepath.Join(s.dir, fmt.Sprintf("%020d.tmp", s.seq+1))
+	if err := writeSync(tmp, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, s.path(s.seq+1)); err != nil {
+		return 0, err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return 0, err
+	}
+	s.seq++
+	return s.seq, nil
+}
+
+func (s *fileStore) Pending() ([]StoredPublishing, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	pubs := make([]StoredPublishing, 0, len(ids))
+	for _, id := range ids {
+		b, err := os.ReadFile(s.path(id))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		var p StoredPublishing
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&p); err != nil {
+			bad := strings.TrimSuffix(s.path(id), storeExt) + quarantineExt
+			errs = append(errs, fmt.Sprintf("decode %s, moved to %s: %v", s.path(id), bad, err))
+			_ = os.Rename(s.path(id), bad)
+			continue
+		}
+		pubs = append(pubs, p)
+	}
+
+	if len(errs) > 0 {
+		return pubs, errors.New(strings.Join(errs, "; "))
+	}
+	return pubs, nil
+}
+
+func (s *fileStore) Remove(id uint64) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ids returns sorted ids of stored publishings
+func (s *fileStore) ids() ([]uint64, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, storeExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, storeExt), 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (s *fileStore) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, storeExt))
+}
+
+// writeSync writes file and flushes it to disk
+func writeSync(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes directory entries to disk, e.g. after rename
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
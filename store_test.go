@@ -0,0 +1,87 @@
+package cony
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := amqp.Table{"n": int64(1), "nested": amqp.Table{"a": "b"}}
+	for _, body := range []string{"m1", "m2", "m3"} {
+		if _, err := s.Append("key", amqp.Publishing{Headers: headers, Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened store should keep pending publishings and sequence
+	s, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := s.Append("key", amqp.Publishing{Body: []byte("m4")}); id != 4 {
+		t.Error("sequence should survive reopening", id)
+	}
+
+	pending, err := s.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 || string(pending[0].Publishing.Body) != "m2" || string(pending[2].Publishing.Body) != "m4" {
+		t.Fatal("should return pending publishings in order", pending)
+	}
+
+	p := pending[0]
+	if p.Key != "key" || p.Publishing.Headers["n"] != int64(1) || p.Publishing.Headers["nested"].(amqp.Table)["a"] != "b" {
+		t.Error("should preserve key and headers", p)
+	}
+}
+
+func TestFileStore_corrupted(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := NewFileStore(dir)
+	s.Append("key", amqp.Publishing{Body: []byte("m1")})
+	s.Append("key", amqp.Publishing{Body: []byte("m2")})
+
+	if err := os.WriteFile(s.(*fileStore).path(1), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := s.Pending()
+	if err == nil {
+		t.Error("should report corrupted publishing")
+	}
+	if len(pending) != 1 || string(pending[0].Publishing.Body) != "m2" {
+		t.Error("corrupted publishing should not block others", pending)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000001.bad")); err != nil {
+		t.Error("corrupted publishing should be moved aside", err)
+	}
+	if _, err := s.Pending(); err != nil {
+		t.Error("moved publishing should not be reported again", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	s.Append("k1", amqp.Publishing{})
+	id, _ := s.Append("k2", amqp.Publishing{})
+	s.Remove(id)
+
+	pending, _ := s.Pending()
+	if len(pending) != 1 || pending[0].Key != "k1" {
+		t.Error("should keep not removed publishings", pending)
+	}
+}
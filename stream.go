@@ -0,0 +1,82 @@
+package cony
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// StreamOffset is a position in stream queue to start consuming from
+type StreamOffset struct {
+	value interface{}
+}
+
+// Well known stream positions
+var (
+	// OffsetFirst starts from the first message available in stream
+	OffsetFirst = StreamOffset{"first"}
+	// OffsetLast starts from the last written chunk of messages
+	OffsetLast = StreamOffset{"last"}
+	// OffsetNext starts from messages published after consumer is registered
+	OffsetNext = StreamOffset{"next"}
+)
+
+// OffsetAt starts from message with exact offset, e.g. checkpointed one
+func OffsetAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// OffsetTimestamp starts from messages published at t or later
+func OffsetTimestamp(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// errStreamQos is reported by stream consumers without prefetch or with
+// automatic acknowledgement, broker refuses them
+var errStreamQos = errors.New("stream consumer requires Qos prefetch and manual acknowledgement")
+
+// Offset returns stream offset of delivery, ok is false if delivery is not
+// from stream queue. Offset of processed delivery could be checkpointed and
+// passed to OffsetAt to resume.
+func Offset(d amqp.Delivery) (offset int64, ok bool) {
+	return toInt64(d.Headers["x-stream-offset"])
+}
+
+// consumeArgs returns consume arguments, stream consumer resumes after last
+// delivery it received
+func (c *Consumer) consumeArgs() amqp.Table {
+	next := atomic.LoadInt64(&c.stats.nextOffset)
+	if !c.stream || next == 0 {
+		return c.args
+	}
+
+	args := amqp.Table{}
+	for k, v := range c.args {
+		args[k] = v
+	}
+	args["x-stream-offset"] = next
+	return args
+}
+
+// trackOffset remembers offset of stream delivery to resume from
+func (c *Consumer) trackOffset(d *amqp.Delivery) {
+	if offset, ok := Offset(*d); ok {
+		atomic.StoreInt64(&c.stats.nextOffset, offset+1)
+	}
+}
+
+// FromOffset set this consumer to consume stream queue from offset, by
+// setting `x-stream-offset` consume argument. After reconnect consumer
+// resumes after the last delivery it received. Streams require Qos option and
+// manual acknowledgement.
+func FromOffset(offset StreamOffset) ConsumerOpt {
+	return func(c *Consumer) {
+		if c.args == nil {
+			c.args = amqp.Table{}
+		}
+		c.args["x-stream-offset"] = offset.value
+		c.stream = true
+	}
+}
@@ -0,0 +1,58 @@
+package cony
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestFromOffset(t *testing.T) {
+	var args []amqp.Table
+	deliveries := make(chan amqp.Delivery)
+
+	c := newTestConsumer(FromOffset(OffsetFirst), Qos(10))
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error { return nil },
+		_Consume: func(name string, tag string, autoAck bool, exclusive bool, noLocal bool, noWait bool, a amqp.Table) (<-chan amqp.Delivery, error) {
+			args = append(args, a)
+			if len(args) > 1 {
+				return nil, errors.New("stop")
+			}
+			return deliveries, nil
+		},
+	}
+
+	done := make(chan bool)
+	go func() {
+		c.serve(nil, ch1)
+		done <- true
+	}()
+
+	deliveries <- amqp.Delivery{Headers: amqp.Table{"x-stream-offset": int64(41)}}
+	d := <-c.Deliveries()
+	close(deliveries)
+	<-done
+
+	if offset, ok := Offset(d); !ok || offset != 41 {
+		t.Error("should expose delivery offset", offset)
+	}
+
+	if args[0]["x-stream-offset"] != "first" {
+		t.Error("should consume from requested offset", args[0])
+	}
+
+	c.serve(nil, ch1)
+	if args[1]["x-stream-offset"] != int64(42) {
+		t.Error("should resume after last delivery", args[1])
+	}
+}
+
+func TestFromOffset_requiresQos(t *testing.T) {
+	c := newTestConsumer(FromOffset(OffsetNext))
+	c.serve(nil, &mqChannelTest{})
+
+	if err := <-c.Errors(); err != errStreamQos {
+		t.Error("should refuse stream consumer without prefetch", err)
+	}
+}
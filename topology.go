@@ -0,0 +1,377 @@
+package cony
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Topology collects exchanges, queues and bindings and declares them in
+// dependency order: exchanges, then queues, then bindings. References of
+// bindings are validated before anything is declared.
+//
+//	t := cony.NewTopology().
+//		Bind(cony.Binding{Queue: q, Exchange: ex, Key: "a.#"}).
+//		Queue(q).
+//		Exchange(ex)
+//	err := client.DeclareTopology(t)
+type Topology struct {
+	exchanges []Exchange
+	queues    []*Queue
+	bindings  []Binding
+}
+
+// NewTopology is a Topology constructor
+func NewTopology() *Topology {
+	return &Topology{}
+}
+
+// Exchange adds exchange to topology
+func (t *Topology) Exchange(e Exchange) *Topology {
+	t.exchanges = append(t.exchanges, e)
+	return t
+}
+
+// Queue adds queue to topology, opts are applied like with DeclareQueue
+func (t *Topology) Queue(q *Queue, opts ...QueueOpt) *Topology {
+	for _, o := range opts {
+		o(q)
+	}
+	t.queues = append(t.queues, q)
+	return t
+}
+
+// Bind adds binding to topology. Its queue and exchange should be added to
+// topology too, unless exchange is a default one, like "" or amq.topic
+func (t *Topology) Bind(b Binding) *Topology {
+	t.bindings = append(t.bindings, b)
+	return t
+}
+
+// Declarations validates topology and returns its declarations in
+// dependency order. Error lists all unresolved references
+func (t *Topology) Declarations() ([]Declaration, error) {
+	exchanges := make(map[string]bool)
+	for _, e := range t.exchanges {
+		exchanges[e.Name] = true
+	}
+
+	queues := make(map[*Queue]bool)
+	for _, q := range t.queues {
+		queues[q] = true
+	}
+
+	var unresolved []string
+	for _, b := range t.bindings {
+		if b.Queue == nil || !queues[b.Queue] {
+			name := "<nil>"
+			if b.Queue != nil {
+				name = b.Queue.Name
+			}
+			unresolved = append(unresolved, fmt.Sprintf("queue %q", name))
+		}
+		if !exchanges[b.Exchange.Name] && !predeclared(b.Exchange.Name) {
+			unresolved = append(unresolved, fmt.Sprintf("exchange %q", b.Exchange.Name))
+		}
+	}
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("unresolved topology references: %s", strings.Join(unresolved, ", "))
+	}
+
+	ds := make([]Declaration, 0, len(t.exchanges)+len(t.queues)+len(t.bindings))
+	for _, e := range t.exchanges {
+		ds = append(ds, DeclareExchange(e))
+	}
+	for _, q := range t.queues {
+		ds = append(ds, DeclareQueue(q))
+	}
+	for _, b := range t.bindings {
+		ds = append(ds, DeclareBinding(b))
+	}
+	return ds, nil
+}
+
+// predeclared reports whether exchange exists on every broker
+func predeclared(name string) bool {
+	return name == "" || strings.HasPrefix(name, "amq.")
+}
+
+// DeclareTopology validates topology and declares it like Declare does.
+// Nothing is declared if topology has unresolved references
+func (c *Client) DeclareTopology(t *Topology) error {
+	ds, err := t.Declarations()
+	if err != nil {
+		return err
+	}
+	c.Declare(ds)
+	return nil
+}
+
+// TopologyMismatch describes declaration refused by broker, because entity
+// exists with different properties
+type TopologyMismatch struct {
+	Kind      string // queue, exchange or binding
+	Name      string
+	Reason    string // broker explanation, e.g. inequivalent arg 'durable'
+	Diffs     []PropertyDiff
+	Recreated bool // entity was deleted and declared again, see RecreateTransient
+}
+
+// PropertyDiff is a property of existing entity differing from declared one
+type PropertyDiff struct {
+	Property string // durable, auto_delete, exclusive, type or argument name
+	Desired  string
+	Current  string // none for missing argument
+}
+
+// Properties of existing queue or exchange compared by SyncTopology
+type Properties struct {
+	Kind       string // exchange type
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool // queues only
+	Args       amqp.Table
+}
+
+// Inspector looks up properties of existing queues and exchanges, e.g.
+// through management API, see conymgmt.Client.Inspector. kind is queue or
+// exchange, found is false if entity doesn't exist
+type Inspector interface {
+	Inspect(kind, name string) (props Properties, found bool, err error)
+}
+
+// SyncOpt is a functional option type for SyncTopology
+type SyncOpt func(*syncConfig)
+
+type syncConfig struct {
+	recreate bool
+	inspect  Inspector
+}
+
+// RecreateTransient SyncTopology option. Mismatched non-durable exchanges and
+// queues are deleted and declared again. Queues are deleted only if they are
+// empty, so no messages are lost.
+func RecreateTransient() SyncOpt {
+	return func(c *syncConfig) {
+		c.recreate = true
+	}
+}
+
+// Inspect SyncTopology option. Existing queues and exchanges are compared with
+// desired ones through i before they are declared, mismatches list every
+// differing property and are not declared at all.
+func Inspect(i Inspector) SyncOpt {
+	return func(c *syncConfig) {
+		c.inspect = i
+	}
+}
+
+// SyncTopology runs desired declarations one by one, each on its own channel,
+// and reports those refused by broker with PRECONDITION_FAILED, instead of
+// failing on the first of them. Other errors stop sync and are returned.
+// Diffs of mismatch hold property named by broker, or all differing
+// properties with Inspect option.
+//
+// WARNING: this is blocking call, see (*Client).WithChannel
+func (c *Client) SyncTopology(desired []Declaration, opts ...SyncOpt) ([]TopologyMismatch, error) {
+	cfg := syncConfig{}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	var mismatches []TopologyMismatch
+	for _, d := range desired {
+		var m TopologyMismatch
+		rec := &recordingDeclarer{}
+
+		diffs, err := cfg.diff(d, rec)
+		if err != nil {
+			return mismatches, err
+		}
+		if len(diffs) > 0 {
+			m = TopologyMismatch{Kind: rec.kind, Name: rec.name, Reason: diffReason(diffs), Diffs: diffs}
+		} else {
+			err = c.WithChannel(func(ch Channel) error {
+				rec.Declarer = ch
+				return d(rec)
+			})
+			if err == nil {
+				continue
+			}
+
+			amqpErr, ok := err.(*amqp.Error)
+			if !ok || amqpErr.Code != amqp.PreconditionFailed {
+				return mismatches, err
+			}
+			m = TopologyMismatch{Kind: rec.kind, Name: rec.name, Reason: amqpErr.Reason, Diffs: parseDiff(amqpErr.Reason)}
+		}
+
+		if cfg.recreate && !rec.props.Durable && rec.kind != "binding" {
+			err = c.WithChannel(func(ch Channel) error {
+				if err := rec.delete(ch); err != nil {
+					return err
+				}
+				return d(ch)
+			})
+			m.Recreated = err == nil
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, nil
+}
+
+// diff compares entity of declaration, dry run through dry, with existing
+// one, if Inspect option is used. Declarations of cony only report their
+// specs to dry, without side effects
+func (cfg *syncConfig) diff(d Declaration, dry *recordingDeclarer) ([]PropertyDiff, error) {
+	if cfg.inspect == nil {
+		return nil, nil
+	}
+
+	if err := d(dry); err != nil {
+		return nil, err
+	}
+	if dry.kind == "binding" || dry.name == "" {
+		return nil, nil
+	}
+
+	current, found, err := cfg.inspect.Inspect(dry.kind, dry.name)
+	if err != nil || !found {
+		return nil, err
+	}
+	return diffProperties(dry.kind, dry.props, current), nil
+}
+
+// diffProperties lists properties of current entity differing from desired
+// ones. x-queue-type of classic queues is implied
+func diffProperties(kind string, desired, current Properties) []PropertyDiff {
+	var diffs []PropertyDiff
+	add := func(property string, d, c interface{}) {
+		if ds, cs := formatProperty(d), formatProperty(c); ds != cs {
+			diffs = append(diffs, PropertyDiff{Property: property, Desired: ds, Current: cs})
+		}
+	}
+
+	if kind == "exchange" {
+		add("type", desired.Kind, current.Kind)
+	}
+	add("durable", desired.Durable, current.Durable)
+	add("auto_delete", desired.AutoDelete, current.AutoDelete)
+	if kind == "queue" {
+		add("exclusive", desired.Exclusive, current.Exclusive)
+	}
+
+	keys := make([]string, 0, len(desired.Args)+len(current.Args))
+	for k := range desired.Args {
+		keys = append(keys, k)
+	}
+	for k := range current.Args {
+		if _, ok := desired.Args[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		d, dok := desired.Args[k]
+		c, cok := current.Args[k]
+		if k == "x-queue-type" && !dok && c == "classic" {
+			continue
+		}
+		switch {
+		case !dok:
+			diffs = append(diffs, PropertyDiff{Property: k, Desired: "none", Current: formatProperty(c)})
+		case !cok:
+			diffs = append(diffs, PropertyDiff{Property: k, Desired: formatProperty(d), Current: "none"})
+		default:
+			add(k, d, c)
+		}
+	}
+	return diffs
+}
+
+// formatProperty formats property value, integer arguments decoded from JSON
+// as floats are formatted as integers
+func formatProperty(v interface{}) string {
+	if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return fmt.Sprint(int64(f))
+	}
+	return fmt.Sprint(v)
+}
+
+func diffReason(diffs []PropertyDiff) string {
+	parts := make([]string, len(diffs))
+	for i, d := range diffs {
+		parts[i] = fmt.Sprintf("'%s': desired %s but current is %s", d.Property, d.Desired, d.Current)
+	}
+	return "inequivalent " + strings.Join(parts, ", ")
+}
+
+// inequivalentArg matches PRECONDITION_FAILED explanation of RabbitMQ, like
+// inequivalent arg 'durable' for queue 'q' in vhost '/': received 'false' but
+// current is 'true'
+var inequivalentArg = regexp.MustCompile(`inequivalent arg '([^']+)'.*: received (?:the value )?('[^']*'|none)(?: of type '[^']*')? but current is (?:the value )?('[^']*'|none)`)
+
+// parseDiff extracts property named by broker explanation
+func parseDiff(reason string) []PropertyDiff {
+	m := inequivalentArg.FindStringSubmatch(reason)
+	if m == nil {
+		return nil
+	}
+	return []PropertyDiff{{Property: m[1], Desired: strings.Trim(m[2], "'"), Current: strings.Trim(m[3], "'")}}
+}
+
+// recordingDeclarer remembers the last entity declared through it. Without
+// Declarer it only records, dry running declarations
+type recordingDeclarer struct {
+	Declarer
+	kind  string
+	name  string
+	props Properties
+}
+
+func (r *recordingDeclarer) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	r.kind, r.name = "queue", name
+	r.props = Properties{Durable: durable, AutoDelete: autoDelete, Exclusive: exclusive, Args: args}
+	if r.Declarer == nil {
+		return amqp.Queue{Name: name}, nil
+	}
+	return r.Declarer.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (r *recordingDeclarer) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	r.kind, r.name = "exchange", name
+	r.props = Properties{Kind: kind, Durable: durable, AutoDelete: autoDelete, Args: args}
+	if r.Declarer == nil {
+		return nil
+	}
+	return r.Declarer.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+func (r *recordingDeclarer) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	r.kind, r.name, r.props = "binding", name+" -> "+exchange, Properties{}
+	if r.Declarer == nil {
+		return nil
+	}
+	return r.Declarer.QueueBind(name, key, exchange, noWait, args)
+}
+
+// dryRun reports whether declarations run through c only record their
+// specs, so they should not change queues or call their callbacks
+func dryRun(c Declarer) bool {
+	r, ok := c.(*recordingDeclarer)
+	return ok && r.Declarer == nil
+}
+
+// delete recorded entity
+func (r *recordingDeclarer) delete(ch Channel) error {
+	if r.kind == "queue" {
+		_, err := ch.QueueDelete(r.name, false, true, false)
+		return err
+	}
+	return ch.ExchangeDelete(r.name, false, false)
+}
@@ -0,0 +1,141 @@
+package cony
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestTopology_Declarations(t *testing.T) {
+	var order []string
+	td := &testDeclarer{
+		_QueueDeclare: func(name string) (amqp.Queue, error) {
+			order = append(order, "queue")
+			return amqp.Queue{Name: name}, nil
+		},
+		_ExchangeDeclare: func() error {
+			order = append(order, "exchange")
+			return nil
+		},
+		_QueueBind: func() error {
+			order = append(order, "binding")
+			return nil
+		},
+	}
+
+	q := &Queue{Name: "q1"}
+	ex := Exchange{Name: "ex1"}
+	ds, err := NewTopology().
+		Bind(Binding{Queue: q, Exchange: ex}).
+		Bind(Binding{Queue: q, Exchange: Exchange{Name: "amq.topic"}}).
+		Queue(q).
+		Exchange(ex).
+		Declarations()
+	if err != nil {
+		t.Fatal("topology should be valid", err)
+	}
+
+	for _, d := range ds {
+		d(td)
+	}
+
+	if strings.Join(order, ",") != "exchange,queue,binding,binding" {
+		t.Error("should declare in dependency order", order)
+	}
+}
+
+func TestTopology_unresolved(t *testing.T) {
+	_, err := NewTopology().
+		Bind(Binding{Queue: &Queue{Name: "q1"}, Exchange: Exchange{Name: "ex1"}}).
+		Declarations()
+
+	if err == nil || !strings.Contains(err.Error(), `queue "q1"`) || !strings.Contains(err.Error(), `exchange "ex1"`) {
+		t.Error("should report unresolved references", err)
+	}
+}
+
+func TestDiffProperties(t *testing.T) {
+	diffs := diffProperties("queue",
+		Properties{Durable: true, Args: amqp.Table{"x-max-priority": 10}},
+		Properties{Args: amqp.Table{"x-max-priority": float64(5), "x-queue-type": "classic", "x-expires": float64(86400000)}},
+	)
+
+	want := []PropertyDiff{
+		{Property: "durable", Desired: "true", Current: "false"},
+		{Property: "x-expires", Desired: "none", Current: "86400000"},
+		{Property: "x-max-priority", Desired: "10", Current: "5"},
+	}
+	if len(diffs) != len(want) {
+		t.Fatal("should list all differing properties", diffs)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Error("unexpected diff", diffs[i], want[i])
+		}
+	}
+
+	if diffs := diffProperties("exchange", Properties{Kind: "topic"}, Properties{Kind: "topic"}); len(diffs) != 0 {
+		t.Error("equal properties should not differ", diffs)
+	}
+}
+
+func TestParseDiff(t *testing.T) {
+	diffs := parseDiff("PRECONDITION_FAILED - inequivalent arg 'durable' for queue 'q1' in vhost '/': received 'false' but current is 'true'")
+	if len(diffs) != 1 || diffs[0] != (PropertyDiff{Property: "durable", Desired: "false", Current: "true"}) {
+		t.Error("should parse property", diffs)
+	}
+
+	diffs = parseDiff("PRECONDITION_FAILED - inequivalent arg 'x-max-priority' for queue 'q1' in vhost '/': received the value '10' of type 'signedint' but current is none")
+	if len(diffs) != 1 || diffs[0] != (PropertyDiff{Property: "x-max-priority", Desired: "10", Current: "none"}) {
+		t.Error("should parse argument", diffs)
+	}
+
+	if parseDiff("PRECONDITION_FAILED - unknown") != nil {
+		t.Error("should ignore unknown explanation")
+	}
+}
+
+type inspectorFunc func(kind, name string) (Properties, bool, error)
+
+func (f inspectorFunc) Inspect(kind, name string) (Properties, bool, error) {
+	return f(kind, name)
+}
+
+func TestSyncConfig_diff_dryRun(t *testing.T) {
+	var inspected []string
+	cfg := syncConfig{inspect: inspectorFunc(func(kind, name string) (Properties, bool, error) {
+		inspected = append(inspected, name)
+		return Properties{}, true, nil
+	})}
+
+	var names []string
+	tmp := TemporaryQueue(func(name string) { names = append(names, name) })
+	declareTmp := DeclareQueue(tmp)
+	declareTmp(&testDeclarer{_QueueDeclare: func(string) (amqp.Queue, error) {
+		return amqp.Queue{Name: "amq.gen-1"}, nil
+	}})
+
+	named := TemporaryQueue(func(name string) { names = append(names, name) })
+	named.Name = "q1"
+	ds := []Declaration{
+		declareTmp,
+		DeclareBinding(Binding{Queue: tmp, Exchange: Exchange{Name: "amq.topic"}, Key: "a"}),
+		DeclareQueue(named),
+	}
+	for _, d := range ds {
+		if _, err := cfg.diff(d, &recordingDeclarer{}); err != nil {
+			t.Fatal("diff should not fail", err)
+		}
+	}
+
+	if tmp.CurrentName() != "amq.gen-1" || named.CurrentName() != "q1" {
+		t.Error("diff should not change queue names", tmp.CurrentName(), named.CurrentName())
+	}
+	if len(names) != 1 {
+		t.Error("diff should not call declared callbacks", names)
+	}
+	if len(inspected) != 1 || inspected[0] != "q1" {
+		t.Error("should inspect named queue only", inspected)
+	}
+}
@@ -0,0 +1,103 @@
+package cony
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TimestampHeader holds publish time in milliseconds since epoch, set by
+// WithTTL like rabbitmq_message_timestamp plugin does. Timestamp property has
+// precision of seconds only
+const TimestampHeader = "timestamp_in_ms"
+
+// WithTTL Publisher's functional option. Publishings without Expiration
+// expire in queue after ttl, precision is milliseconds. Publish time is
+// stamped as Timestamp and TimestampHeader, so consumer could tell expired
+// messages with Expired.
+func WithTTL(ttl time.Duration) PublisherOpt {
+	return func(p *Publisher) {
+		p.ttl = ttl
+	}
+}
+
+// formatExpiration formats ttl as Expiration property, rounding it up to
+// milliseconds
+func formatExpiration(ttl time.Duration) string {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return strconv.FormatInt(int64((ttl+time.Millisecond-1)/time.Millisecond), 10)
+}
+
+// stampTTL sets Expiration and publish time of publishing, headers are copied
+func stampTTL(pub amqp.Publishing, ttl time.Duration, now time.Time) amqp.Publishing {
+	if pub.Expiration != "" {
+		return pub
+	}
+	pub.Expiration = formatExpiration(ttl)
+	if pub.Timestamp.IsZero() {
+		pub.Timestamp = now
+	}
+	if _, ok := pub.Headers[TimestampHeader]; !ok {
+		headers := amqp.Table{TimestampHeader: now.UnixNano() / int64(time.Millisecond)}
+		for k, v := range pub.Headers {
+			headers[k] = v
+		}
+		pub.Headers = headers
+	}
+	return pub
+}
+
+// Expired reports whether delivery outlived its Expiration at now, e.g.
+// while it was prefetched by consumer. Publish time is taken from
+// TimestampHeader or Timestamp property, deliveries without Expiration or
+// publish time never expire
+func Expired(d amqp.Delivery, now time.Time) bool {
+	if d.Expiration == "" {
+		return false
+	}
+	ms, err := strconv.ParseInt(d.Expiration, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	published := publishTime(d)
+	if published.IsZero() {
+		return false
+	}
+	return now.Sub(published) >= time.Duration(ms)*time.Millisecond
+}
+
+// publishTime returns publish time of delivery from TimestampHeader or
+// Timestamp property, zero if unknown
+func publishTime(d amqp.Delivery) time.Time {
+	if stamp, ok := toInt64(d.Headers[TimestampHeader]); ok {
+		return time.Unix(0, stamp*int64(time.Millisecond))
+	}
+	return d.Timestamp
+}
+
+// DropExpired Consumer's functional option. Expired deliveries are nacked
+// without requeue, so they're dead-lettered if queue has
+// dead-letter-exchange, instead of being passed to Deliveries. They're
+// counted in Stats
+func DropExpired() ConsumerOpt {
+	return func(c *Consumer) {
+		c.expiring = true
+	}
+}
+
+// expired drops expired delivery, returns true if it was dropped
+func (c *Consumer) expired(d *amqp.Delivery) bool {
+	if !Expired(*d, time.Now()) {
+		return false
+	}
+	atomic.AddUint64(&c.stats.expired, 1)
+	if !c.autoAck {
+		_ = d.Nack(false, false)
+	}
+	return true
+}
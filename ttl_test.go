@@ -0,0 +1,78 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestFormatExpiration(t *testing.T) {
+	for ttl, want := range map[time.Duration]string{
+		time.Second:             "1000",
+		1500 * time.Microsecond: "2",
+		-time.Second:            "0",
+	} {
+		if got := formatExpiration(ttl); got != want {
+			t.Errorf("ttl %s should be formatted as %s, got %s", ttl, want, got)
+		}
+	}
+}
+
+func TestWithTTL(t *testing.T) {
+	p := newTestPublisher(WithTTL(time.Minute))
+
+	own := amqp.Table{"k": "v"}
+	pubs, _ := p.prepare(amqp.Publishing{Headers: own}, p.key, nil)
+	pub := pubs[0]
+	if pub.Expiration != "60000" || pub.Timestamp.IsZero() || pub.Headers[TimestampHeader] == nil || pub.Headers["k"] != "v" {
+		t.Error("should stamp expiration and publish time", pub)
+	}
+	if len(own) != 1 {
+		t.Error("should not modify publishing headers", own)
+	}
+
+	pubs, _ = p.prepare(amqp.Publishing{Expiration: "5"}, p.key, nil)
+	if pubs[0].Expiration != "5" || pubs[0].Headers != nil {
+		t.Error("should keep own expiration", pubs[0])
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	stamp := now.Add(-2*time.Second).UnixNano() / int64(time.Millisecond)
+
+	tab := []struct {
+		d       amqp.Delivery
+		expired bool
+	}{
+		{amqp.Delivery{}, false},
+		{amqp.Delivery{Expiration: "1000"}, false},
+		{amqp.Delivery{Expiration: "1000", Headers: amqp.Table{TimestampHeader: stamp}}, true},
+		{amqp.Delivery{Expiration: "5000", Headers: amqp.Table{TimestampHeader: stamp}}, false},
+		{amqp.Delivery{Expiration: "1000", Timestamp: now.Add(-time.Minute)}, true},
+		{amqp.Delivery{Expiration: "bad", Timestamp: now.Add(-time.Minute)}, false},
+	}
+	for i, spec := range tab {
+		if got := Expired(spec.d, now); got != spec.expired {
+			t.Errorf("%d: expired should be %v", i, spec.expired)
+		}
+	}
+}
+
+func TestConsumer_expired(t *testing.T) {
+	c := newTestConsumer(DropExpired())
+	ack := &nackAcknowledger{}
+	d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Expiration: "1", Timestamp: time.Now().Add(-time.Hour)}
+	if !c.expired(&d) || len(ack.dropped) != 1 {
+		t.Error("should nack expired delivery without requeue", ack.dropped, ack.requeued)
+	}
+	if c.Stats().Expired != 1 {
+		t.Error("should count expired delivery")
+	}
+
+	d = amqp.Delivery{Acknowledger: ack}
+	if c.expired(&d) {
+		t.Error("should pass delivery without expiration")
+	}
+}
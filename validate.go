@@ -0,0 +1,74 @@
+package cony
+
+import "github.com/streadway/amqp"
+
+// ValidationErrorHeader holds validation error of message moved to invalid
+// message queue by Validate option
+const ValidationErrorHeader = "x-validation-error"
+
+// DecodeErrorHeader holds decompression error of message moved to queue by
+// Undecodable option
+const DecodeErrorHeader = "x-decode-error"
+
+// Validator checks delivery against message contract, e.g. JSON Schema or
+// protobuf descriptor, before it's shipped to Deliveries
+type Validator interface {
+	Validate(d amqp.Delivery) error
+}
+
+// ValidatorFunc is an adapter to use ordinary function as Validator
+type ValidatorFunc func(d amqp.Delivery) error
+
+// Validate calls f(d)
+func (f ValidatorFunc) Validate(d amqp.Delivery) error {
+	return f(d)
+}
+
+// invalid moves delivery failed validation to invalid message queue, or
+// rejects it if queue is not set
+func (c *Consumer) invalid(side *sidePublisher, d *amqp.Delivery) bool {
+	verr := c.validator.Validate(*d)
+	if verr == nil {
+		return false
+	}
+	c.sideline(side, d, c.invalidQ, ValidationErrorHeader, verr)
+	return true
+}
+
+// sideline moves delivery to queue with cause in header, or rejects it if
+// queue is not set. Delivery is acked once broker confirmed its copy, or
+// requeued if it can't be moved
+func (c *Consumer) sideline(side *sidePublisher, d *amqp.Delivery, queue, header string, cause error) {
+	if queue == "" {
+		if !c.autoAck {
+			_ = d.Reject(false)
+		}
+		return
+	}
+
+	pub := publishing(*d)
+	pub.Headers[header] = cause.Error()
+	if err := side.publish(queue, pub); err != nil {
+		c.reportErr(err)
+		if !c.autoAck {
+			_ = d.Nack(false, true)
+		}
+		return
+	}
+	if !c.autoAck {
+		_ = d.Ack(false)
+	}
+}
+
+// Validate set this consumer to check decoded deliveries with v. Invalid
+// deliveries are moved to invalidQueue with ValidationErrorHeader, instead of
+// shipping them to Deliveries. They are acked once broker confirmed the copy
+// and requeued if it fails. With empty invalidQueue they are rejected, so
+// dead-lettered if queue has dead-letter-exchange. invalidQueue should be
+// declared by user.
+func Validate(v Validator, invalidQueue string) ConsumerOpt {
+	return func(c *Consumer) {
+		c.validator = v
+		c.invalidQ = invalidQueue
+	}
+}